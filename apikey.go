@@ -0,0 +1,118 @@
+package racer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// APIKeyPrefix starts every api key, so keys are easy to spot in config and logs
+const APIKeyPrefix = "rk_"
+
+// Sender IDs from MinBotSenderID to MaxBotSenderID are reserved for api keys, so a bot can never send as a user.
+// The range is the top half of the 53 bits javascript clients can represent exactly.
+const (
+	MinBotSenderID = 1 << 52
+	MaxBotSenderID = 1<<53 - 1
+)
+
+// BotSender reports whether senderID is reserved for api keys, see MinBotSenderID.
+func BotSender(senderID int) bool {
+	return int64(senderID) >= MinBotSenderID && int64(senderID) <= MaxBotSenderID
+}
+
+// APIKey lets a bot or integration connect to racer as a sender of its own, restricted to the rooms and scopes it was granted.
+// Only a hash of the keys secret is kept, the key itself is shown once when it is created.
+type APIKey struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`     // describes what the key is for
+	SenderID int    `json:"senderID"` // stamped onto every message sent with the key
+	Grants   Grants `json:"grants"`
+	Created  int64  `json:"created"`
+	Hash     []byte `json:"hash,omitempty"` // sha256 of the keys secret
+}
+
+// APIKeyRepo stores api keys
+type APIKeyRepo interface {
+	PutKey(k *APIKey) error
+	FetchKey(ID string) (*APIKey, error) // returns nil if there is no key with the ID
+	Keys() ([]*APIKey, error)
+	DeleteKey(ID string) error
+}
+
+// NewAPIKey returns a new api key named name with grants, along with the key to hand to whoever uses it.
+// Its sender ID is derived from its ID unless senderID is not 0, in which case it must be reserved for api keys, see BotSender.
+func NewAPIKey(name string, senderID int, grants Grants) (*APIKey, string, error) {
+	if senderID != 0 && !BotSender(senderID) {
+		return nil, "", &InvalidError{Field: "senderID", Reason: fmt.Sprintf("must be from %d to %d, the range reserved for api keys", MinBotSenderID, MaxBotSenderID)}
+	}
+
+	id, secret := make([]byte, 8), make([]byte, 32)
+
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", errors.Wrap(err, "could not generate api key")
+	}
+
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", errors.Wrap(err, "could not generate api key")
+	}
+
+	if senderID == 0 {
+		senderID = int(MinBotSenderID | binary.BigEndian.Uint64(id)&(MinBotSenderID-1))
+	}
+
+	k := &APIKey{
+		ID:       hex.EncodeToString(id),
+		Name:     name,
+		SenderID: senderID,
+		Grants:   grants,
+		Created:  time.Now().UTC().UnixNano(),
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(encoded))
+	k.Hash = hash[:]
+
+	return k, APIKeyPrefix + k.ID + "_" + encoded, nil
+}
+
+// ParseAPIKey splits key into the ID of the api key and its secret.
+func ParseAPIKey(key string) (ID, secret string, err error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return "", "", errors.New("not an api key")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, APIKeyPrefix), "_", 2)
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("malformed api key")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// Verify reports whether secret is the secret of the key.
+func (k *APIKey) Verify(secret string) bool {
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], k.Hash) == 1
+}
+
+// Identity returns the identity of a client connecting with the key.
+func (k *APIKey) Identity() Identity {
+	grants := k.Grants
+
+	if grants == nil {
+		// a key without grants can do nothing, rather than anything
+		grants = Grants{}
+	}
+
+	return Identity{SenderID: k.SenderID, Grants: grants}
+}
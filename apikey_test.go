@@ -0,0 +1,35 @@
+package racer_test
+
+import (
+	"testing"
+
+	"github.com/tinylttl/racer"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	t.Run("It derives a sender ID reserved for api keys", func(t *testing.T) {
+		k, _, err := racer.NewAPIKey("bot", 0, racer.Grants{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !racer.BotSender(k.SenderID) {
+			t.Fatalf("got: %d, want: a sender ID from %d to %d", k.SenderID, racer.MinBotSenderID, racer.MaxBotSenderID)
+		}
+	})
+
+	t.Run("It only accepts sender IDs reserved for api keys", func(t *testing.T) {
+		for _, senderID := range []int{5, racer.MinBotSenderID - 1, racer.MaxBotSenderID + 1} {
+			if _, _, err := racer.NewAPIKey("bot", senderID, racer.Grants{}); err == nil {
+				t.Fatalf("got: %v, want: an error for sender ID %d", err, senderID)
+			}
+		}
+
+		k, _, err := racer.NewAPIKey("bot", racer.MinBotSenderID, racer.Grants{})
+
+		if err != nil || k.SenderID != racer.MinBotSenderID {
+			t.Fatalf("got: %v, want: a key sending as %d", err, racer.MinBotSenderID)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package boltdb
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+)
+
+var _ racer.APIKeyRepo = (*KeyRepo)(nil)
+
+// keysBucket holds every api key keyed by its ID. Rooms are buckets of their own at the top level,
+// the leading zero byte reserves the name so no room can be stored under it, see reserved.
+var keysBucket = []byte("\x00keys")
+
+// KeyRepo implements racer.APIKeyRepo
+type KeyRepo struct {
+	db *DB
+}
+
+// NewKeyRepo returns a new repository of api keys stored in db
+func NewKeyRepo(db *DB) *KeyRepo {
+	return &KeyRepo{db: db}
+}
+
+// PutKey stores k, replacing any key with the same ID.
+func (r *KeyRepo) PutKey(k *racer.APIKey) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(keysBucket)
+
+		if err != nil {
+			return errors.Wrap(err, "could not find or create keys bucket")
+		}
+
+		v, err := json.Marshal(k)
+
+		if err != nil {
+			return errors.Wrap(err, "could not encode api key")
+		}
+
+		return b.Put([]byte(k.ID), v)
+	})
+}
+
+// FetchKey fetches the key identified by ID, it returns nil if there is no such key.
+func (r *KeyRepo) FetchKey(ID string) (*racer.APIKey, error) {
+	var k *racer.APIKey
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(ID))
+
+		if v == nil {
+			return nil
+		}
+
+		k = &racer.APIKey{}
+
+		return errors.Wrap(json.Unmarshal(v, k), "could not decode api key")
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Keys fetches every key ordered by ID.
+func (r *KeyRepo) Keys() ([]*racer.APIKey, error) {
+	keys := make([]*racer.APIKey, 0)
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			k := &racer.APIKey{}
+
+			if err := json.Unmarshal(v, k); err != nil {
+				return errors.Wrap(err, "could not decode api key")
+			}
+
+			keys = append(keys, k)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// DeleteKey deletes the key identified by ID, revoking it. Deleting a key that does not exist is not an error.
+func (r *KeyRepo) DeleteKey(ID string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(ID))
+	})
+}
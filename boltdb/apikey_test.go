@@ -0,0 +1,99 @@
+package boltdb_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/boltdb"
+)
+
+func TestKeyRepo(t *testing.T) {
+	t.Run("it stores, fetches and revokes keys", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		repo := boltdb.NewKeyRepo(tr.db)
+
+		k, key, err := racer.NewAPIKey("bot", 0, racer.Grants{"23": {racer.ScopePost}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := repo.PutKey(k); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.FetchKey(k.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, k) {
+			t.Fatalf("got: %+v, want: %+v", got, k)
+		}
+
+		if _, secret, _ := racer.ParseAPIKey(key); !got.Verify(secret) {
+			t.Fatalf("got: a key that does not verify its own secret")
+		}
+
+		keys, err := repo.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 1 || keys[0].ID != k.ID {
+			t.Fatalf("got: %v, want: [%v]", keys, k)
+		}
+
+		if err := repo.DeleteKey(k.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, _ := repo.FetchKey(k.ID); got != nil {
+			t.Fatalf("got: %+v, want: nil", got)
+		}
+	})
+
+	t.Run("it keeps keys out of the rooms", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		k, _, _ := racer.NewAPIKey("bot", 0, nil)
+		boltdb.NewKeyRepo(tr.db).PutKey(k)
+
+		got, err := tr.repo.Unread(7)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != 0 {
+			t.Fatalf("got: %v, want: no rooms", got)
+		}
+	})
+	t.Run("it refuses to store a room in the bucket of the keys", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		k, _, _ := racer.NewAPIKey("bot", 0, nil)
+		repo := boltdb.NewKeyRepo(tr.db)
+		repo.PutKey(k)
+
+		if err := tr.repo.Put("\x00keys", &racer.Message{Body: "hi", Timestamp: 1}); err == nil {
+			t.Fatal("got: nil, want: an error")
+		}
+
+		if got, _ := tr.repo.FetchX("\x00keys", 10); len(got) != 0 {
+			t.Fatalf("got: %v, want: no messages", got)
+		}
+
+		got, err := repo.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != 1 || got[0].ID != k.ID {
+			t.Fatalf("got: %v, want: %v", got, []*racer.APIKey{k})
+		}
+	})
+}
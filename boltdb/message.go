@@ -1,15 +1,19 @@
 package boltdb
 
 import (
+	"bytes"
 	"encoding/binary"
-	"encoding/json"
+	"sort"
 
 	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
 	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/keyring"
 )
 
 var _ racer.MessageRepo = (*MessageRepo)(nil)
+var _ racer.ThreadRepo = (*MessageRepo)(nil)
+var _ racer.ReceiptRepo = (*MessageRepo)(nil)
 
 // MessageRepo provides an interface for interacting with a storage solution
 // type MessageRepo interface {
@@ -21,12 +25,28 @@ var _ racer.MessageRepo = (*MessageRepo)(nil)
 
 // MessageRepo implements racer.MessageRepo
 type MessageRepo struct {
-	db *DB
+	db      *DB
+	keyring *keyring.Keyring // wraps the data key of every room, nil to store messages as plaintext, see WithKeyring
 }
 
 // NewMessageRepo returns a new repository intialized with a default path
-func NewMessageRepo(db *DB) *MessageRepo {
-	return &MessageRepo{db: db}
+// It can take a variadic number of functional options.
+func NewMessageRepo(db *DB, opts ...func(*MessageRepo)) *MessageRepo {
+	r := &MessageRepo{db: db}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// WithKeyring encrypts every message the repo stores with the data key of its room, wrapped by the master keys of k.
+// Messages stored before the repo was encrypted stay readable as they are. Use with NewMessageRepo()
+func WithKeyring(k *keyring.Keyring) func(*MessageRepo) {
+	return func(r *MessageRepo) {
+		r.keyring = k
+	}
 }
 
 // func (r *Repo) Fetch(ID string) []*racer.Message {
@@ -103,8 +123,41 @@ func NewMessageRepo(db *DB) *MessageRepo {
 // 	return msgs, nil
 // }
 
-// Put stores any number of messages to the bucket identified with ID
+// Names of the buckets nested in the bucket of every room.
+var (
+	idsBucket   = []byte("ids")   // maps message ids to the key the message is stored under
+	editsBucket = []byte("edits") // holds a bucket for every edited message, of its previous versions keyed by the timestamp of the edit that replaced them
+
+	// holds a bucket for every changed message, of the edits and delete applied to it keyed by their timestamp, see record
+	changesBucket = []byte("changes")
+
+	// holds a bucket for every message reacted to, with a key for every reaction made by a sender, see reactionKey
+	reactionsBucket = []byte("reactions")
+
+	threadsBucket = []byte("threads")   // holds a bucket for every thread, of the keys of its replies
+	summaryBucket = []byte("summaries") // maps the id of every thread root to its reply count and the timestamp of its last reply
+	readsBucket   = []byte("reads")     // maps the id of every sender that has read the room to the key of the last message they read
+	seqsBucket    = []byte("seqs")      // maps the seq of every message to the key the message is stored under, see indexed
+)
+
+// maxUnread is the most unread messages counted in a single room
+const maxUnread = 1000
+
+// Put stores any number of messages to the bucket identified with ID.
+// Edits and deletes are applied to the message they change and kept apart from the rooms messages,
+// so only FetchSince returns them. The version an edit replaces is kept in the messages edit history, see Edits.
+// Deleting a message leaves a tombstone in its place and removes its edit history, reactions and the edits applied to it.
+//
+// Reactions are not stored as messages, they are tallied in a bucket of their own for the message they react to
+// so the message itself is never rewritten. The tally is filled in on every message fetched, see racer.Message.Reactions.
+// Replies are stored like any other message and are also added to the thread of their root, which keeps a summary of its replies
+// that is filled in on every message fetched in the same way. Read receipts are not stored as messages either,
+// they move the senders last read marker for the room forward, see Unread. Ephemeral messages are never stored.
 func (r *MessageRepo) Put(ID string, msgs ...*racer.Message) error {
+	if reserved([]byte(ID)) {
+		return &racer.InvalidError{Field: "chatID", Reason: "is reserved"}
+	}
+
 	err := r.db.Batch(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(ID))
 
@@ -112,19 +165,100 @@ func (r *MessageRepo) Put(ID string, msgs ...*racer.Message) error {
 			return errors.Wrap(err, "could not find or create bucket")
 		}
 
+		ids, err := b.CreateBucketIfNotExists(idsBucket)
+
+		if err != nil {
+			return errors.Wrap(err, "could not find or create id index")
+		}
+
+		s, err := r.sealer(tx, ID, true)
+
+		if err != nil {
+			return err
+		}
+
+		seqs, err := seqIndex(b, s)
+
+		if err != nil {
+			return err
+		}
+
+		if err := moveChanges(b, s); err != nil {
+			return err
+		}
+
 		for _, msg := range msgs {
-			marshalledbytes, err := json.Marshal(msg)
+			// ephemeral messages, like typing, only ever matter to the clients connected when they are sent
+			if msg.Ephemeral() {
+				continue
+			}
+
+			if msg.Reacts() {
+				if err := react(b, s, msg); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if msg.Type == racer.TypeRead {
+				if err := read(b, s, msg); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if msg.Changes() {
+				if err := change(b, s, msg); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			key := i64tob(msg.Timestamp)
+
+			// a message is put again when a backup is retried or replayed,
+			// once it has been changed the stored version is the one to keep
+			if stored := b.Get(key); stored != nil {
+				prev := &racer.Message{}
+
+				if err := s.unmarshal(stored, prev, key); err == nil && prev.Edited != 0 {
+					continue
+				}
+			}
+
+			marshalledbytes, err := s.marshal(msg, key)
 
 			if err != nil {
-				return errors.Wrap(err, "could not marshall msg")
+				return err
 			}
 
 			// store the timestamp converted to bytes askey, marshalled *racer.Message as data
-			err = b.Put([]byte(i64tob(msg.Timestamp)), marshalledbytes)
+			err = b.Put(key, marshalledbytes)
 
 			if err != nil {
 				return errors.Wrap(err, "could not store msg to database")
 			}
+
+			if msg.ID != "" {
+				if err := ids.Put([]byte(msg.ID), key); err != nil {
+					return errors.Wrap(err, "could not index msg")
+				}
+			}
+
+			if msg.Seq != 0 {
+				if err := seqs.Put(i64tob(int64(msg.Seq)), key); err != nil {
+					return errors.Wrap(err, "could not index msg by seq")
+				}
+			}
+
+			if msg.Replies() {
+				if err := reply(b, s, key, msg); err != nil {
+					return err
+				}
+			}
 		}
 
 		return nil
@@ -137,53 +271,941 @@ func (r *MessageRepo) Put(ID string, msgs ...*racer.Message) error {
 	return nil
 }
 
-// u64tob converts a uint64 into an 8-byte slice.
-func i64tob(v int64) []byte {
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, uint64(v))
-	return b
+// change applies an edit or delete to the message it changes in the bucket b and records it, sealing them and the edit history with s.
+// Changes to messages that were never stored, or that have already been applied, are ignored.
+func change(b *bolt.Bucket, s sealer, msg *racer.Message) error {
+	key, parent, err := find(b, s, msg.ParentID)
+
+	if err != nil || parent == nil || parent.Edited >= msg.Timestamp {
+		return err
+	}
+
+	// the version the change replaces is sealed to its place in the edit history
+	prev, err := s.marshal(parent, []byte(parent.ID), i64tob(msg.Timestamp))
+
+	if err != nil {
+		return err
+	}
+
+	if !parent.Apply(msg) {
+		return nil
+	}
+
+	edits, err := b.CreateBucketIfNotExists(editsBucket)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create edits bucket")
+	}
+
+	if msg.Type == racer.TypeDelete {
+		if err := edits.DeleteBucket([]byte(parent.ID)); err != nil && err != bolt.ErrBucketNotFound {
+			return errors.Wrap(err, "could not remove edit history")
+		}
+
+		if reactions := b.Bucket(reactionsBucket); reactions != nil {
+			if err := reactions.DeleteBucket([]byte(parent.ID)); err != nil && err != bolt.ErrBucketNotFound {
+				return errors.Wrap(err, "could not remove reactions")
+			}
+		}
+
+		// the edits carry the bodies the delete removed
+		if err := scrub(b, s, []byte(parent.ID)); err != nil {
+			return err
+		}
+	} else {
+		history, err := edits.CreateBucketIfNotExists([]byte(parent.ID))
+
+		if err != nil {
+			return errors.Wrap(err, "could not find or create edit history")
+		}
+
+		if err := history.Put(i64tob(msg.Timestamp), prev); err != nil {
+			return errors.Wrap(err, "could not store edit history")
+		}
+	}
+
+	if err := record(b, s, msg); err != nil {
+		return err
+	}
+
+	changed, err := s.marshal(parent, key)
+
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(b.Put(key, changed), "could not store changed msg")
 }
 
-// convert bytes pack to timestamps
-func btoi64(b []byte) int64 {
-	return int64(binary.BigEndian.Uint64(b[0:8]))
+// record stores the edit or delete msg in the bucket b, sealed with s, among the changes of the message it changes
+// and indexes it by its seq, so clients that resume can apply it.
+func record(b *bolt.Bucket, s sealer, msg *racer.Message) error {
+	changes, err := b.CreateBucketIfNotExists(changesBucket)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create changes bucket")
+	}
+
+	parentID := []byte(msg.ParentID)
+
+	records, err := changes.CreateBucketIfNotExists(parentID)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create changes of msg")
+	}
+
+	key := i64tob(msg.Timestamp)
+
+	v, err := s.marshal(msg, changesBucket, parentID, key)
+
+	if err != nil {
+		return err
+	}
+
+	if err := records.Put(key, v); err != nil {
+		return errors.Wrap(err, "could not store change")
+	}
+
+	if msg.Seq == 0 {
+		return nil
+	}
+
+	seqs, err := b.CreateBucketIfNotExists(seqsBucket)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create seq index")
+	}
+
+	// the index entry of a change names the message it changes after its key, see indexed
+	return errors.Wrap(seqs.Put(i64tob(int64(msg.Seq)), append(key, parentID...)), "could not index change by seq")
 }
 
-// FetchX fetches the latest x messages
-func (r *MessageRepo) FetchX(ID string, x int) ([]*racer.Message, error) {
-	var msg *racer.Message
-	msgs := make([]*racer.Message, 0, x)
+// scrub removes every change recorded in the bucket b, opened with s, for the message identified by msgID, along with their index entries.
+func scrub(b *bolt.Bucket, s sealer, msgID []byte) error {
+	changes := b.Bucket(changesBucket)
 
-	err := r.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(ID))
-		c := b.Cursor()
+	if changes == nil {
+		return nil
+	}
+
+	records := changes.Bucket(msgID)
+
+	if records == nil {
+		return nil
+	}
 
-		// wrap Cursors Next method to return nil after a certain thrshold limit
-		i := 1
-		cNextLimit := func() (key []byte, value []byte) {
+	if seqs := b.Bucket(seqsBucket); seqs != nil {
+		err := records.ForEach(func(k, v []byte) error {
+			msg := &racer.Message{}
 
-			if i == x {
-				return nil, nil
+			if err := s.unmarshal(v, msg, changesBucket, msgID, k); err != nil {
+				return err
 			}
 
-			key, value = c.Next()
+			if msg.Seq == 0 {
+				return nil
+			}
 
-			i++
+			return errors.Wrap(seqs.Delete(i64tob(int64(msg.Seq))), "could not remove change from seq index")
+		})
 
-			return key, value
+		if err != nil {
+			return err
 		}
+	}
 
-		for k, v := c.First(); k != nil; k, v = cNextLimit() {
-			err := json.Unmarshal(v, &msg)
+	return errors.Wrap(changes.DeleteBucket(msgID), "could not remove changes of msg")
+}
 
-			if err != nil {
-				return errors.Wrap(err, "could not marshall msg")
+// indexed returns the stored message the seq index entry v of the bucket b points to and the path it is sealed to,
+// or nil if there is no such message. Entries of changes name the message they change after the key, see record.
+func indexed(b *bolt.Bucket, v []byte) ([]byte, [][]byte) {
+	if len(v) <= 8 {
+		return b.Get(v), [][]byte{v}
+	}
+
+	key, msgID := v[:8], v[8:]
+
+	changes := b.Bucket(changesBucket)
+
+	if changes == nil || changes.Bucket(msgID) == nil {
+		return nil, nil
+	}
+
+	return changes.Bucket(msgID).Get(key), [][]byte{changesBucket, msgID, key}
+}
+
+// moveChanges moves the edits and deletes stored among the messages of the bucket b, opened with s, before they were kept apart
+// to where record keeps them, the first time anything is stored in the room since. Edits of messages that have been deleted are dropped.
+func moveChanges(b *bolt.Bucket, s sealer) error {
+	if b.Bucket(changesBucket) != nil {
+		return nil
+	}
+
+	if _, err := b.CreateBucket(changesBucket); err != nil {
+		return errors.Wrap(err, "could not create changes bucket")
+	}
+
+	// a bucket cannot be changed while it is walked
+	moved := make(map[string]*racer.Message)
+
+	err := b.ForEach(func(k, v []byte) error {
+		// nested buckets have no value
+		if v == nil {
+			return nil
+		}
+
+		msg := &racer.Message{}
+
+		if err := s.unmarshal(v, msg, k); err != nil {
+			return err
+		}
+
+		if msg.Changes() {
+			moved[string(k)] = msg
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	ids, seqs := b.Bucket(idsBucket), b.Bucket(seqsBucket)
+
+	for k, msg := range moved {
+		if err := b.Delete([]byte(k)); err != nil {
+			return errors.Wrap(err, "could not remove change from msgs")
+		}
+
+		if ids != nil && msg.ID != "" && bytes.Equal(ids.Get([]byte(msg.ID)), []byte(k)) {
+			if err := ids.Delete([]byte(msg.ID)); err != nil {
+				return errors.Wrap(err, "could not remove change from id index")
 			}
+		}
 
-			msgs = append(msgs, msg)
+		if seqs != nil && msg.Seq != 0 {
+			if err := seqs.Delete(i64tob(int64(msg.Seq))); err != nil {
+				return errors.Wrap(err, "could not remove change from seq index")
+			}
+		}
+	}
+
+	for _, msg := range moved {
+		_, parent, err := find(b, s, msg.ParentID)
+
+		if err != nil {
+			return err
+		}
+
+		if parent == nil || parent.Deleted && msg.Type == racer.TypeEdit {
+			continue
+		}
+
+		if err := record(b, s, msg); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// reply adds the reply msg, stored under key, to the thread of its root in the bucket b, sealing the summary of the thread with s.
+func reply(b *bolt.Bucket, s sealer, key []byte, msg *racer.Message) error {
+	threads, err := b.CreateBucketIfNotExists(threadsBucket)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create threads bucket")
+	}
+
+	thread, err := threads.CreateBucketIfNotExists([]byte(msg.ParentID))
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create thread")
+	}
+
+	// a reply is put again when a backup is retried or replayed and must only be counted once
+	if thread.Get(key) != nil {
+		return nil
+	}
 
+	if err := thread.Put(key, []byte(msg.ID)); err != nil {
+		return errors.Wrap(err, "could not add reply to thread")
+	}
+
+	rootID := []byte(msg.ParentID)
+
+	count, last, err := summary(b, s, rootID)
+
+	if err != nil {
+		return err
+	}
+
+	if msg.Timestamp > last {
+		last = msg.Timestamp
+	}
+
+	summaries, err := b.CreateBucketIfNotExists(summaryBucket)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create summaries bucket")
+	}
+
+	v, err := s.seal(encodeSummary(count+1, last), summaryBucket, rootID)
+
+	if err != nil {
+		return errors.Wrap(err, "could not seal thread summary")
+	}
+
+	return errors.Wrap(summaries.Put(rootID, v), "could not store thread summary")
+}
+
+// summary returns the reply count and the timestamp of the last reply of the thread of rootID in the bucket b, opened with s.
+func summary(b *bolt.Bucket, s sealer, rootID []byte) (count int, last int64, err error) {
+	summaries := b.Bucket(summaryBucket)
+
+	if summaries == nil {
+		return 0, 0, nil
+	}
+
+	v, err := s.open(summaries.Get(rootID), summaryBucket, rootID)
+
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not open thread summary")
+	}
+
+	count, last = decodeSummary(v)
+
+	return count, last, nil
+}
+
+// encodeSummary encodes the reply count and the timestamp of the last reply of a thread.
+func encodeSummary(count int, last int64) []byte {
+	return append(i64tob(int64(count)), i64tob(last)...)
+}
+
+// decodeSummary decodes a summary written by encodeSummary, a nil summary is a thread with no replies.
+func decodeSummary(v []byte) (count int, last int64) {
+	if len(v) != 16 {
+		return 0, 0
+	}
+
+	return int(btoi64(v[:8])), btoi64(v[8:])
+}
+
+// decorate fills in what is stored about msg outside of its own record in the bucket b, opened with s,
+// its reactions and the summary of its thread.
+func decorate(b *bolt.Bucket, s sealer, msg *racer.Message) error {
+	if msg.ID == "" {
+		return nil
+	}
+
+	var err error
+
+	if msg.Reactions, err = reactions(b, s, msg.ID); err != nil {
+		return err
+	}
+
+	msg.ReplyCount, msg.LastReply, err = summary(b, s, []byte(msg.ID))
+
+	return err
+}
+
+// read moves the last read marker of the sender of msg in the bucket b, sealed with s, forward to the message it read.
+// Receipts for messages that were never stored, or that were sent before the message the sender last read, are ignored.
+func read(b *bolt.Bucket, s sealer, msg *racer.Message) error {
+	ids := b.Bucket(idsBucket)
+
+	if ids == nil {
+		return nil
+	}
+
+	key := ids.Get([]byte(msg.ParentID))
+
+	if key == nil {
 		return nil
+	}
+
+	last, err := lastRead(b, s, msg.SenderID)
+
+	if err != nil || last != nil && bytes.Compare(last, key) >= 0 {
+		return err
+	}
+
+	reads, err := b.CreateBucketIfNotExists(readsBucket)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create reads bucket")
+	}
+
+	sender := i64tob(int64(msg.SenderID))
+	name := s.name(sender, readsBucket)
+
+	v, err := s.seal(key, readsBucket, name)
+
+	if err != nil {
+		return errors.Wrap(err, "could not seal last read marker")
+	}
+
+	if err := reads.Put(name, v); err != nil {
+		return errors.Wrap(err, "could not store last read marker")
+	}
+
+	// the marker stored before markers were sealed is replaced by the sealed one
+	if !bytes.Equal(name, sender) {
+		return errors.Wrap(reads.Delete(sender), "could not remove last read marker")
+	}
+
+	return nil
+}
+
+// lastRead returns the key of the last message senderID read in the bucket b, opened with s, nil if they have never read the room.
+// Markers are stored under the name of the sender, see sealer.name, those stored before markers were sealed under their id.
+func lastRead(b *bolt.Bucket, s sealer, senderID int) ([]byte, error) {
+	reads := b.Bucket(readsBucket)
+
+	if reads == nil {
+		return nil, nil
+	}
+
+	sender := i64tob(int64(senderID))
+	name := s.name(sender, readsBucket)
+
+	v := reads.Get(name)
+
+	if v == nil {
+		if v = reads.Get(sender); v == nil {
+			return nil, nil
+		}
+
+		name = sender
+	}
+
+	last, err := s.open(v, readsBucket, name)
+
+	return last, errors.Wrap(err, "could not open last read marker")
+}
+
+// unread counts the messages in the bucket b, opened with s, sent by anyone other than senderID after the last message they read, up to maxUnread.
+// It reports false if senderID has never read anything in the room.
+func unread(b *bolt.Bucket, s sealer, senderID int) (int, bool, error) {
+	last, err := lastRead(b, s, senderID)
+
+	if err != nil || last == nil {
+		return 0, false, err
+	}
+
+	n := 0
+	c := b.Cursor()
+
+	k, v := c.Seek(last)
+
+	if bytes.Equal(k, last) {
+		k, v = c.Next()
+	}
+
+	for ; k != nil && n < maxUnread; k, v = c.Next() {
+		// nested buckets have no value
+		if v == nil {
+			continue
+		}
+
+		msg := &racer.Message{}
+
+		if err := s.unmarshal(v, msg, k); err != nil {
+			return 0, false, err
+		}
+
+		if msg.SenderID != senderID && msg.Changeable() {
+			n++
+		}
+	}
+
+	return n, true, nil
+}
+
+// react adds or takes back the reaction msg makes in the bucket b, sealed with s.
+// A reaction is stored under the name of its key, see sealer.name, with the time it was made followed by its key as its value.
+func react(b *bolt.Bucket, s sealer, msg *racer.Message) error {
+	reactions, err := b.CreateBucketIfNotExists(reactionsBucket)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create reactions bucket")
+	}
+
+	parentID := []byte(msg.ParentID)
+	key := reactionKey(msg.Body, msg.SenderID)
+	name := s.name(key, reactionsBucket, parentID)
+
+	if msg.Type == racer.TypeUnreaction {
+		if r := reactions.Bucket(parentID); r != nil {
+			if err := r.Delete(name); err != nil {
+				return errors.Wrap(err, "could not remove reaction")
+			}
+
+			// reactions stored before they were sealed are kept under their key
+			return errors.Wrap(r.Delete(key), "could not remove reaction")
+		}
+
+		return nil
+	}
+
+	r, err := reactions.CreateBucketIfNotExists(parentID)
+
+	if err != nil {
+		return errors.Wrap(err, "could not find or create reactions")
+	}
+
+	// reacting twice keeps the time of the first reaction
+	if r.Get(name) != nil || r.Get(key) != nil {
+		return nil
+	}
+
+	v, err := s.seal(append(i64tob(msg.Timestamp), key...), reactionsBucket, parentID, name)
+
+	if err != nil {
+		return errors.Wrap(err, "could not seal reaction")
+	}
+
+	return errors.Wrap(r.Put(name, v), "could not store reaction")
+}
+
+// reactionKey returns the key of a reaction, the reaction followed by a zero byte and the id of the sender who made it.
+func reactionKey(body string, senderID int) []byte {
+	return append(append([]byte(body), 0), i64tob(int64(senderID))...)
+}
+
+// reactions tallies the reactions to the message identified by msgID in the bucket b, opened with s, ordered by reaction.
+func reactions(b *bolt.Bucket, s sealer, msgID string) ([]*racer.Reaction, error) {
+	all := b.Bucket(reactionsBucket)
+
+	if all == nil {
+		return nil, nil
+	}
+
+	r := all.Bucket([]byte(msgID))
+
+	if r == nil {
+		return nil, nil
+	}
+
+	var tally []*racer.Reaction
+	byBody := make(map[string]*racer.Reaction)
+
+	err := r.ForEach(func(name, v []byte) error {
+		v, err := s.open(v, reactionsBucket, []byte(msgID), name)
+
+		if err != nil {
+			return errors.Wrap(err, "could not open reaction")
+		}
+
+		// reactions stored before they were sealed hold only the time they were made, their name is their key
+		key := name
+		if len(v) > 8 {
+			key = v[8:]
+		}
+
+		body, senderID := string(key[:len(key)-9]), int(btoi64(key[len(key)-8:]))
+
+		reaction, ok := byBody[body]
+
+		if !ok {
+			reaction = &racer.Reaction{Body: body}
+			byBody[body] = reaction
+			tally = append(tally, reaction)
+		}
+
+		reaction.Count++
+		reaction.SenderIDs = append(reaction.SenderIDs, senderID)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// names are macs when reactions are sealed, so they are stored in no particular order
+	sort.Slice(tally, func(i, j int) bool { return tally[i].Body < tally[j].Body })
+
+	for _, reaction := range tally {
+		sort.Ints(reaction.SenderIDs)
+	}
+
+	return tally, nil
+}
+
+// find returns the message identified by msgID from the bucket b, opened with s, along with the key it is stored under,
+// or a nil message if there is no such message.
+// Messages stored before messages were indexed by id are found by walking the bucket from the newest message.
+func find(b *bolt.Bucket, s sealer, msgID string) ([]byte, *racer.Message, error) {
+	if ids := b.Bucket(idsBucket); ids != nil {
+		if key := ids.Get([]byte(msgID)); key != nil {
+			msg := &racer.Message{}
+
+			if err := s.unmarshal(b.Get(key), msg, key); err != nil {
+				return nil, nil, err
+			}
+
+			return key, msg, nil
+		}
+	}
+
+	c := b.Cursor()
+
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		// nested buckets have no value
+		if v == nil {
+			continue
+		}
+
+		msg := &racer.Message{}
+
+		if err := s.unmarshal(v, msg, k); err != nil {
+			return nil, nil, err
+		}
+
+		if msg.ID == msgID {
+			return k, msg, nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// u64tob converts a uint64 into an 8-byte slice.
+func i64tob(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// convert bytes pack to timestamps
+func btoi64(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b[0:8]))
+}
+
+// reserved reports whether name is one of the buckets the repo keeps its own data in rather than a rooms bucket,
+// see keysBucket and dataKeysBucket. Rooms can not be stored under these names.
+func reserved(name []byte) bool {
+	return bytes.HasPrefix(name, []byte{0})
+}
+
+// room returns the bucket of the room identified by ID, nil if nothing has been stored under ID.
+func room(tx *bolt.Tx, ID string) *bolt.Bucket {
+	if reserved([]byte(ID)) {
+		return nil
+	}
+
+	return tx.Bucket([]byte(ID))
+}
+
+// FetchX fetches the latest x messages, newest first.
+// If no messages have been stored under ID an empty slice is returned.
+func (r *MessageRepo) FetchX(ID string, x int) ([]*racer.Message, error) {
+	msgs := make([]*racer.Message, 0, x)
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := room(tx, ID)
+
+		if b == nil {
+			return nil
+		}
+
+		s, err := r.sealer(tx, ID, false)
+
+		if err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+
+		// keys are timestamps so walking backwards from the last key
+		// yields the most recent messages first
+		for k, v := c.Last(); k != nil && len(msgs) < x; k, v = c.Prev() {
+			// nested buckets have no value
+			if v == nil {
+				continue
+			}
+
+			msg := &racer.Message{}
+
+			if err := s.unmarshal(v, msg, k); err != nil {
+				return err
+			}
+
+			// a room nothing has been stored in since changes were kept apart still holds them among its messages, see moveChanges
+			if msg.Changes() {
+				continue
+			}
+
+			if err := decorate(b, s, msg); err != nil {
+				return err
+			}
+
+			msgs = append(msgs, msg)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// FetchSince fetches up to the latest x messages with a seq greater than seq, oldest first.
+// If no messages have been stored under ID an empty slice is returned.
+// Edits and deletes are fetched along with the messages so clients that resume can apply them, see Put.
+// Messages are found through their seq, so messages stored out of the order they were sequenced in,
+// like those replayed from a wal or imported from a dead letter file, are never missed.
+func (r *MessageRepo) FetchSince(ID string, seq uint64, x int) ([]*racer.Message, error) {
+	msgs := make([]*racer.Message, 0)
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := room(tx, ID)
+
+		if b == nil {
+			return nil
+		}
+
+		s, err := r.sealer(tx, ID, false)
+
+		if err != nil {
+			return err
+		}
+
+		seqs := b.Bucket(seqsBucket)
+
+		// a room nothing has been stored in since messages were indexed by seq has to be walked in full
+		if seqs == nil {
+			return b.ForEach(func(k, v []byte) error {
+				// nested buckets have no value
+				if v == nil {
+					return nil
+				}
+
+				msg := &racer.Message{}
+
+				if err := s.unmarshal(v, msg, k); err != nil {
+					return err
+				}
+
+				if msg.Seq <= seq {
+					return nil
+				}
+
+				// nor have the edits of messages deleted since been dropped, see moveChanges
+				if msg.Type == racer.TypeEdit {
+					if _, parent, err := find(b, s, msg.ParentID); err != nil || parent == nil || parent.Deleted {
+						return err
+					}
+				}
+
+				if err := decorate(b, s, msg); err != nil {
+					return err
+				}
+
+				msgs = append(msgs, msg)
+
+				return nil
+			})
+		}
+
+		c := seqs.Cursor()
+
+		for k, entry := c.Last(); k != nil && uint64(btoi64(k)) > seq && len(msgs) < x; k, entry = c.Prev() {
+			v, path := indexed(b, entry)
+
+			if v == nil {
+				continue
+			}
+
+			msg := &racer.Message{}
+
+			if err := s.unmarshal(v, msg, path...); err != nil {
+				return err
+			}
+
+			if err := decorate(b, s, msg); err != nil {
+				return err
+			}
+
+			msgs = append(msgs, msg)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+
+	if len(msgs) > x {
+		msgs = msgs[len(msgs)-x:]
+	}
+
+	return msgs, nil
+}
+
+// Fetch fetches the message identified by msgID from the bucket identified by ID, with any edits or delete applied,
+// its reactions tallied and the summary of its thread filled in.
+// If there is no such message nil is returned.
+func (r *MessageRepo) Fetch(ID string, msgID string) (*racer.Message, error) {
+	var msg *racer.Message
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := room(tx, ID)
+
+		if b == nil {
+			return nil
+		}
+
+		s, err := r.sealer(tx, ID, false)
+
+		if err != nil {
+			return err
+		}
+
+		if _, msg, err = find(b, s, msgID); msg == nil {
+			return err
+		}
+
+		return decorate(b, s, msg)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// FetchThread fetches up to x replies to the message identified by rootID from the bucket identified by ID,
+// oldest first, starting after the reply with the timestamp after. Pass the timestamp of the last reply fetched as after to fetch the next page.
+// If the message has no replies an empty slice is returned.
+func (r *MessageRepo) FetchThread(ID string, rootID string, after int64, x int) ([]*racer.Message, error) {
+	msgs := make([]*racer.Message, 0)
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := room(tx, ID)
+
+		if b == nil || b.Bucket(threadsBucket) == nil {
+			return nil
+		}
+
+		thread := b.Bucket(threadsBucket).Bucket([]byte(rootID))
+
+		if thread == nil {
+			return nil
+		}
+
+		s, err := r.sealer(tx, ID, false)
+
+		if err != nil {
+			return err
+		}
+
+		c := thread.Cursor()
+
+		for k, _ := c.Seek(i64tob(after + 1)); k != nil && len(msgs) < x; k, _ = c.Next() {
+			msg := &racer.Message{}
+
+			if err := s.unmarshal(b.Get(k), msg, k); err != nil {
+				return err
+			}
+
+			if err := decorate(b, s, msg); err != nil {
+				return err
+			}
+
+			msgs = append(msgs, msg)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// Unread counts the messages sent by anyone else after the last message the sender identified by senderID read, in every room they have read.
+// The counts are keyed by the ID of the rooms bucket, and stop at a thousand messages.
+// Only text and file messages that have not been deleted are counted.
+func (r *MessageRepo) Unread(senderID int) (map[string]int, error) {
+	counts := make(map[string]int)
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if reserved(name) {
+				return nil
+			}
+
+			s, err := r.sealer(tx, string(name), false)
+
+			if err != nil {
+				return err
+			}
+
+			n, ok, err := unread(b, s, senderID)
+
+			if ok {
+				counts[string(name)] = n
+			}
+
+			return err
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// Edits fetches the edit history of the message identified by msgID from the bucket identified by ID,
+// every version of the message an edit replaced, oldest first. Deleted messages have no edit history.
+func (r *MessageRepo) Edits(ID string, msgID string) ([]*racer.Message, error) {
+	msgs := make([]*racer.Message, 0)
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := room(tx, ID)
+
+		if b == nil || b.Bucket(editsBucket) == nil {
+			return nil
+		}
+
+		history := b.Bucket(editsBucket).Bucket([]byte(msgID))
+
+		if history == nil {
+			return nil
+		}
+
+		s, err := r.sealer(tx, ID, false)
+
+		if err != nil {
+			return err
+		}
+
+		return history.ForEach(func(k, v []byte) error {
+			msg := &racer.Message{}
+
+			if err := s.unmarshal(v, msg, []byte(msgID), k); err != nil {
+				return err
+			}
+
+			msgs = append(msgs, msg)
+			return nil
+		})
 	})
 
 	if err != nil {
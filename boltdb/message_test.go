@@ -3,6 +3,7 @@ package boltdb_test
 import (
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -121,4 +122,500 @@ func TestFetchX(t *testing.T) {
 			t.Fatalf("got: %+v want: %+v", got[0], want)
 		}
 	})
+	t.Run("it returns a distinct message for every record", func(t *testing.T) {
+		tr := newRepo()
+
+		defer tr.close()
+
+		msgs := []*racer.Message{
+			&racer.Message{ID: "a", Timestamp: 1, Body: "1"},
+			&racer.Message{ID: "b", Timestamp: 2, Body: "2"},
+			&racer.Message{ID: "c", Timestamp: 3, Body: "3"},
+		}
+
+		tr.repo.Put("ID", msgs...)
+
+		got, err := tr.repo.FetchX("ID", 3)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, msg := range got {
+			if want := msgs[len(msgs)-1-i]; msg.ID != want.ID || msg.Body != want.Body {
+				t.Fatalf("got: %+v want: %+v", msg, want)
+			}
+		}
+	})
+
+	t.Run("it returns no messages for an unknown ID", func(t *testing.T) {
+		tr := newRepo()
+
+		defer tr.close()
+
+		got, err := tr.repo.FetchX("unknown", 3)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != 0 {
+			t.Fatalf("got: %d want: %d", len(got), 0)
+		}
+	})
+}
+
+func TestFetchSince(t *testing.T) {
+	cases := []struct {
+		name string
+		seq  uint64
+		x    int
+		want []uint64
+	}{
+		{name: "It returns every message after seq oldest first", seq: 2, x: 10, want: []uint64{3, 4, 5}},
+		{name: "It returns only the latest x messages", seq: 0, x: 2, want: []uint64{4, 5}},
+		{name: "It returns nothing when seq is the latest", seq: 5, x: 10, want: []uint64{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := newRepo()
+
+			defer tr.close()
+
+			for i := 1; i <= 5; i++ {
+				tr.repo.Put("ID", &racer.Message{Timestamp: int64(i), Seq: uint64(i)})
+			}
+
+			got, err := tr.repo.FetchSince("ID", tc.seq, tc.x)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("got: %d messages, want: %d", len(got), len(tc.want))
+			}
+
+			for i, msg := range got {
+				if msg.Seq != tc.want[i] {
+					t.Fatalf("got: %d, want: %d", msg.Seq, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFetchSince_OutOfOrder(t *testing.T) {
+	t.Run("it finds messages stored with a seq out of timestamp order", func(t *testing.T) {
+		tr := newRepo()
+
+		defer tr.close()
+
+		// a message replayed from the wal or a dead letter can carry an older timestamp than messages after it
+		tr.repo.Put("ID", &racer.Message{Timestamp: 3, Seq: 4})
+		tr.repo.Put("ID", &racer.Message{Timestamp: 4, Seq: 5})
+		tr.repo.Put("ID", &racer.Message{Timestamp: 1, Seq: 6})
+		tr.repo.Put("ID", &racer.Message{Timestamp: 2, Seq: 7})
+
+		got, err := tr.repo.FetchSince("ID", 4, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []uint64{5, 6, 7}
+
+		if len(got) != len(want) {
+			t.Fatalf("got: %d messages, want: %d", len(got), len(want))
+		}
+
+		for i, msg := range got {
+			if msg.Seq != want[i] {
+				t.Fatalf("got: %d, want: %d", msg.Seq, want[i])
+			}
+		}
+	})
+}
+
+func TestReserveSeq(t *testing.T) {
+	cases := []struct {
+		name    string
+		reserve []uint64
+		want    uint64
+	}{
+		{name: "it returns 0 for a room that reserved nothing", want: 0},
+		{name: "it returns the last seq reserved", reserve: []uint64{1000, 2000}, want: 2000},
+		{name: "it never lowers the reserved seq", reserve: []uint64{2000, 1000}, want: 2000},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := newRepo()
+
+			defer tr.close()
+
+			for _, seq := range tc.reserve {
+				if err := tr.repo.ReserveSeq("ID", seq); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := tr.repo.LastSeq("ID")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("got: %d, want: %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPut_Changes(t *testing.T) {
+	original := func() *racer.Message {
+		return &racer.Message{ID: "a", Type: racer.TypeText, Timestamp: 1, Body: "helo", SenderID: 7}
+	}
+
+	t.Run("it applies edits and keeps the versions they replace", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		tr.repo.Put("ID", original())
+		tr.repo.Put("ID", &racer.Message{ID: "b", Type: racer.TypeEdit, ParentID: "a", Timestamp: 2, Body: "hello"})
+		tr.repo.Put("ID", &racer.Message{ID: "c", Type: racer.TypeEdit, ParentID: "a", Timestamp: 3, Body: "hello!"})
+
+		got, err := tr.repo.Fetch("ID", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Body != "hello!" || got.Edited != 3 {
+			t.Fatalf("got: %+v, want the body of the last edit", got)
+		}
+
+		edits, _ := tr.repo.Edits("ID", "a")
+		if len(edits) != 2 || edits[0].Body != "helo" || edits[1].Body != "hello" {
+			t.Fatalf("got: %+v, want: helo and hello", edits)
+		}
+
+		// the edits are kept apart from the rooms history, which holds the message as it was last edited
+		if history, _ := tr.repo.FetchX("ID", 10); len(history) != 1 || history[0].Body != "hello!" {
+			t.Fatalf("got: %+v, want only the edited message", history)
+		}
+	})
+
+	t.Run("it leaves a tombstone in place of a deleted message", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		tr.repo.Put("ID", original(), &racer.Message{ID: "b", Type: racer.TypeEdit, ParentID: "a", Timestamp: 2, Body: "hello"})
+		tr.repo.Put("ID", &racer.Message{ID: "c", Type: racer.TypeDelete, ParentID: "a", Timestamp: 3})
+
+		got, _ := tr.repo.Fetch("ID", "a")
+		if !got.Deleted || got.Body != "" || got.SenderID != 7 {
+			t.Fatalf("got: %+v, want a tombstone", got)
+		}
+
+		if edits, _ := tr.repo.Edits("ID", "a"); len(edits) != 0 {
+			t.Fatalf("got: %d edits, want: %d", len(edits), 0)
+		}
+
+		history, _ := tr.repo.FetchX("ID", 10)
+		if len(history) != 1 || history[0].ID != "a" || !history[0].Deleted {
+			t.Fatalf("got: %+v, want only the tombstone", history)
+		}
+	})
+
+	t.Run("it keeps edits of a deleted message from being fetched", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		msg := original()
+		msg.Seq = 1
+
+		tr.repo.Put("ID", msg, &racer.Message{ID: "b", Type: racer.TypeEdit, ParentID: "a", Timestamp: 2, Seq: 2, Body: "secret"})
+		tr.repo.Put("ID", &racer.Message{ID: "c", Type: racer.TypeDelete, ParentID: "a", Timestamp: 3, Seq: 3})
+
+		history, err := tr.repo.FetchX("ID", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, msg := range history {
+			if msg.Body == "secret" {
+				t.Fatalf("got: %+v, want the edited body gone", msg)
+			}
+		}
+
+		// clients that resume still learn of the delete
+		since, err := tr.repo.FetchSince("ID", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(since) != 2 || since[0].ID != "a" || since[1].ID != "c" {
+			t.Fatalf("got: %+v, want the tombstone and the delete", since)
+		}
+	})
+
+	t.Run("it fetches the edits made since a seq", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		msg := original()
+		msg.Seq = 1
+
+		tr.repo.Put("ID", msg, &racer.Message{ID: "b", Type: racer.TypeEdit, ParentID: "a", Timestamp: 2, Seq: 2, Body: "hello"})
+
+		since, err := tr.repo.FetchSince("ID", 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(since) != 1 || since[0].ID != "b" || since[0].Body != "hello" {
+			t.Fatalf("got: %+v, want the edit", since)
+		}
+	})
+
+	t.Run("it applies a change only once when messages are put again", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		edit := &racer.Message{ID: "b", Type: racer.TypeEdit, ParentID: "a", Timestamp: 2, Body: "hello"}
+
+		tr.repo.Put("ID", original(), edit)
+		tr.repo.Put("ID", original(), edit)
+
+		got, _ := tr.repo.Fetch("ID", "a")
+		if got.Body != "hello" {
+			t.Fatalf("got: %s, want: %s", got.Body, "hello")
+		}
+
+		if edits, _ := tr.repo.Edits("ID", "a"); len(edits) != 1 || edits[0].Body != "helo" {
+			t.Fatalf("got: %+v, want only helo", edits)
+		}
+	})
+}
+
+func TestFetch(t *testing.T) {
+	tr := newRepo()
+	defer tr.close()
+
+	tr.repo.Put("ID", &racer.Message{ID: "a", Timestamp: 1, Body: "1"}, &racer.Message{ID: "b", Timestamp: 2, Body: "2"})
+
+	cases := []struct {
+		name   string
+		chatID string
+		msgID  string
+		want   string
+	}{
+		{name: "it fetches a message by its id", chatID: "ID", msgID: "a", want: "1"},
+		{name: "it returns nil for an unknown message", chatID: "ID", msgID: "c"},
+		{name: "it returns nil for an unknown room", chatID: "unknown", msgID: "a"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tr.repo.Fetch(tc.chatID, tc.msgID)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (got == nil) != (tc.want == "") || (got != nil && got.Body != tc.want) {
+				t.Fatalf("got: %+v, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPut_Reactions(t *testing.T) {
+	react := func(typ, body string, senderID int) *racer.Message {
+		return &racer.Message{Type: typ, ParentID: "a", Body: body, SenderID: senderID, Timestamp: time.Now().UnixNano()}
+	}
+
+	cases := []struct {
+		name      string
+		reactions []*racer.Message
+		want      []racer.Reaction
+	}{
+		{
+			name:      "it tallies reactions by who made them",
+			reactions: []*racer.Message{react(racer.TypeReaction, "👍", 7), react(racer.TypeReaction, "👍", 8), react(racer.TypeReaction, "🎉", 7)},
+			want:      []racer.Reaction{{Body: "🎉", Count: 1, SenderIDs: []int{7}}, {Body: "👍", Count: 2, SenderIDs: []int{7, 8}}},
+		},
+		{
+			name:      "it counts a sender reacting twice once",
+			reactions: []*racer.Message{react(racer.TypeReaction, "👍", 7), react(racer.TypeReaction, "👍", 7)},
+			want:      []racer.Reaction{{Body: "👍", Count: 1, SenderIDs: []int{7}}},
+		},
+		{
+			name:      "it takes back reactions",
+			reactions: []*racer.Message{react(racer.TypeReaction, "👍", 7), react(racer.TypeReaction, "👍", 8), react(racer.TypeUnreaction, "👍", 7)},
+			want:      []racer.Reaction{{Body: "👍", Count: 1, SenderIDs: []int{8}}},
+		},
+		{
+			name:      "it drops the reactions to a deleted message",
+			reactions: []*racer.Message{react(racer.TypeReaction, "👍", 7), {ID: "b", Type: racer.TypeDelete, ParentID: "a", Timestamp: time.Now().UnixNano()}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := newRepo()
+			defer tr.close()
+
+			tr.repo.Put("ID", &racer.Message{ID: "a", Type: racer.TypeText, Timestamp: 1, Body: "hello", SenderID: 7})
+			tr.repo.Put("ID", tc.reactions...)
+
+			history, err := tr.repo.FetchX("ID", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// reactions never show up as messages of their own
+			got := history[len(history)-1]
+			if got.ID != "a" {
+				t.Fatalf("got: %+v, want message a", got)
+			}
+
+			if len(got.Reactions) != len(tc.want) {
+				t.Fatalf("got: %d reactions, want: %d", len(got.Reactions), len(tc.want))
+			}
+
+			for i, r := range got.Reactions {
+				if !reflect.DeepEqual(*r, tc.want[i]) {
+					t.Fatalf("got: %+v, want: %+v", *r, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFetchThread(t *testing.T) {
+	tr := newRepo()
+	defer tr.close()
+
+	msgs := []*racer.Message{{ID: "a", Type: racer.TypeText, Timestamp: 1}, {ID: "b", Type: racer.TypeText, Timestamp: 2}}
+	for i := int64(3); i <= 7; i++ {
+		msgs = append(msgs, &racer.Message{ID: string(rune('a' + i - 1)), Type: racer.TypeText, ParentID: "a", Timestamp: i})
+	}
+
+	tr.repo.Put("ID", msgs...)
+
+	// putting replies again must not count them twice
+	tr.repo.Put("ID", msgs[2:]...)
+
+	cases := []struct {
+		name  string
+		after int64
+		x     int
+		want  []string
+	}{
+		{name: "it fetches the first replies oldest first", x: 2, want: []string{"c", "d"}},
+		{name: "it fetches the replies after a reply", after: 4, x: 2, want: []string{"e", "f"}},
+		{name: "it fetches what is left on the last page", after: 6, x: 2, want: []string{"g"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tr.repo.FetchThread("ID", "a", tc.after, tc.x)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("got: %d replies, want: %d", len(got), len(tc.want))
+			}
+
+			for i, msg := range got {
+				if msg.ID != tc.want[i] {
+					t.Fatalf("got: %s, want: %s", msg.ID, tc.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("it summarizes the thread on its root", func(t *testing.T) {
+		root, _ := tr.repo.Fetch("ID", "a")
+
+		if root.ReplyCount != 5 || root.LastReply != 7 {
+			t.Fatalf("got: %d replies, last at %d, want: %d replies, last at %d", root.ReplyCount, root.LastReply, 5, 7)
+		}
+
+		if other, _ := tr.repo.Fetch("ID", "b"); other.ReplyCount != 0 {
+			t.Fatalf("got: %d replies, want: %d", other.ReplyCount, 0)
+		}
+	})
+}
+
+func TestPut_Ephemeral(t *testing.T) {
+	tr := newRepo()
+	defer tr.close()
+
+	tr.repo.Put("ID", &racer.Message{ID: "a", Type: racer.TypeTyping, Timestamp: 1}, &racer.Message{ID: "b", Type: racer.TypePresence, Timestamp: 2})
+
+	if got, _ := tr.repo.FetchX("ID", 10); len(got) != 0 {
+		t.Fatalf("got: %d messages, want: %d", len(got), 0)
+	}
+}
+
+func TestUnread(t *testing.T) {
+	put := func(tr *testrepo) {
+		tr.repo.Put("23",
+			&racer.Message{ID: "a", Type: racer.TypeText, Timestamp: 1, SenderID: 7},
+			&racer.Message{ID: "b", Type: racer.TypeText, Timestamp: 2, SenderID: 8},
+			&racer.Message{ID: "c", Type: racer.TypeText, Timestamp: 3, SenderID: 8},
+			&racer.Message{ID: "d", Type: racer.TypeText, Timestamp: 4, SenderID: 7},
+			&racer.Message{ID: "e", Type: racer.TypeDelete, ParentID: "c", Timestamp: 5, SenderID: 8},
+			&racer.Message{ID: "f", Type: racer.TypeText, Timestamp: 6, SenderID: 8},
+		)
+		tr.repo.Put("24", &racer.Message{ID: "a", Type: racer.TypeText, Timestamp: 1, SenderID: 8})
+	}
+
+	cases := []struct {
+		name     string
+		receipts []*racer.Message
+		want     map[string]int
+	}{
+		{
+			name:     "it counts the messages others sent after the last message read",
+			receipts: []*racer.Message{{Type: racer.TypeRead, ParentID: "a", SenderID: 7}},
+			want:     map[string]int{"23": 2},
+		},
+		{
+			name:     "it never moves the last read message back",
+			receipts: []*racer.Message{{Type: racer.TypeRead, ParentID: "d", SenderID: 7}, {Type: racer.TypeRead, ParentID: "a", SenderID: 7}},
+			want:     map[string]int{"23": 1},
+		},
+		{
+			name:     "it counts nothing for rooms that have not been read",
+			receipts: []*racer.Message{{Type: racer.TypeRead, ParentID: "a", SenderID: 8}},
+			want:     map[string]int{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := newRepo()
+			defer tr.close()
+
+			put(tr)
+			tr.repo.Put("23", tc.receipts...)
+
+			got, err := tr.repo.Unread(7)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
 }
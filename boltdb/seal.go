@@ -0,0 +1,350 @@
+package boltdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/keyring"
+)
+
+// dataKeysBucket maps the ID of every rooms bucket to the rooms data key, wrapped by a master key, see keyring.
+// Like keysBucket the leading zero byte reserves the name so no room can be stored under it.
+var dataKeysBucket = []byte("\x00datakeys")
+
+// sealer encodes and decodes the messages stored in the bucket of a single room.
+// A sealer with a data key seals every message it encodes, one without stores them as plaintext json.
+// Either decodes plaintext, so messages stored before the repo was encrypted stay readable.
+// Messages are sealed to the room and the keys they are stored under, see ad.
+type sealer struct {
+	key  []byte
+	room string
+}
+
+// ad returns the associated data a message stored under the keys of path in the bucket of the room is sealed with,
+// so a sealed message can not be moved to another room or key and still be opened.
+// Every part is prefixed with its length, so no two paths run together into the same associated data.
+func (s sealer) ad(path ...[]byte) []byte {
+	ad := make([]byte, 0, 64)
+
+	for _, part := range append([][]byte{[]byte(s.room)}, path...) {
+		ad = binary.AppendUvarint(ad, uint64(len(part)))
+		ad = append(ad, part...)
+	}
+
+	return ad
+}
+
+// marshal encodes msg to be stored under path
+func (s sealer) marshal(msg *racer.Message, path ...[]byte) ([]byte, error) {
+	v, err := json.Marshal(msg)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshall msg")
+	}
+
+	sealed, err := s.seal(v, path...)
+
+	return sealed, errors.Wrap(err, "could not seal msg")
+}
+
+// unmarshal decodes the message v stored under path into msg
+func (s sealer) unmarshal(v []byte, msg *racer.Message, path ...[]byte) error {
+	v, err := s.open(v, path...)
+
+	if err != nil {
+		return errors.Wrap(err, "could not open msg")
+	}
+
+	return errors.Wrap(json.Unmarshal(v, msg), "could not unmarshall msg")
+}
+
+// seal seals the value v to be stored under path, a sealer without a data key returns v as is.
+func (s sealer) seal(v []byte, path ...[]byte) ([]byte, error) {
+	if s.key == nil {
+		return v, nil
+	}
+
+	return keyring.Seal(s.key, v, s.ad(path...))
+}
+
+// open opens the value v stored under path, values stored as plaintext are returned as they are.
+func (s sealer) open(v []byte, path ...[]byte) ([]byte, error) {
+	if !keyring.Sealed(v) {
+		return v, nil
+	}
+
+	if s.key == nil {
+		return nil, errors.New("value is sealed but its room has no data key")
+	}
+
+	return keyring.Open(s.key, v, s.ad(path...))
+}
+
+// name returns the key that a record keyed by k is stored under at path. A sealer with a data key returns a mac of k,
+// so the key reveals nothing of k but the record can still be found by it. A sealer without one returns k as is.
+func (s sealer) name(k []byte, path ...[]byte) []byte {
+	if s.key == nil {
+		return k
+	}
+
+	return keyring.MAC(s.key, s.ad(append(path[:len(path):len(path)], k)...))
+}
+
+// sealer returns the sealer of the room identified by ID, messages are stored as plaintext if the repo has no keyring.
+// A room gets its data key the first time a message is stored in it, if create is set the data key is created when it does not exist yet.
+func (r *MessageRepo) sealer(tx *bolt.Tx, ID string, create bool) (sealer, error) {
+	if r.keyring == nil {
+		return sealer{room: ID}, nil
+	}
+
+	if b := tx.Bucket(dataKeysBucket); b != nil {
+		if wrapped := b.Get([]byte(ID)); wrapped != nil {
+			key, err := r.keyring.Unwrap(wrapped, []byte(ID))
+
+			return sealer{key: key, room: ID}, errors.Wrapf(err, "could not unwrap data key of %s", ID)
+		}
+	}
+
+	if !create {
+		return sealer{room: ID}, nil
+	}
+
+	b, err := tx.CreateBucketIfNotExists(dataKeysBucket)
+
+	if err != nil {
+		return sealer{}, errors.Wrap(err, "could not find or create data keys bucket")
+	}
+
+	key, wrapped, err := r.keyring.NewDataKey([]byte(ID))
+
+	if err != nil {
+		return sealer{}, err
+	}
+
+	return sealer{key: key, room: ID}, errors.Wrap(b.Put([]byte(ID), wrapped), "could not store data key")
+}
+
+// RotateDataKeys rewraps the data key of every room with the primary master key of the repos keyring, returning how many were rewrapped.
+// The keyring must still hold the master keys that wrapped them before. The messages the data keys seal are left as they are.
+func (r *MessageRepo) RotateDataKeys() (int, error) {
+	if r.keyring == nil {
+		return 0, errors.New("the repo has no keyring")
+	}
+
+	n := 0
+
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dataKeysBucket)
+
+		if b == nil {
+			return nil
+		}
+
+		// a bucket cannot be changed while it is walked
+		rewrapped := make(map[string][]byte)
+
+		err := b.ForEach(func(ID, wrapped []byte) error {
+			w, ok, err := r.keyring.Rewrap(wrapped, ID)
+
+			if err != nil {
+				return errors.Wrapf(err, "could not rewrap data key of %s", ID)
+			}
+
+			if ok {
+				rewrapped[string(ID)] = w
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for ID, wrapped := range rewrapped {
+			if err := b.Put([]byte(ID), wrapped); err != nil {
+				return errors.Wrap(err, "could not store data key")
+			}
+		}
+
+		n = len(rewrapped)
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Verification counts what Verify checked.
+type Verification struct {
+	DataKeys  int // rooms with a data key
+	Stale     int // data keys wrapped by a master key other than the primary, see RotateDataKeys
+	Sealed    int // messages, including the versions edits replaced and the edits and deletes applied, sealed with the data key of their room
+	Plaintext int // messages stored before the repo was encrypted
+
+	// Records counts the reactions, read markers and thread summaries sealed with the data key of their room,
+	// PlaintextRecords those stored before they were sealed.
+	Records          int
+	PlaintextRecords int
+}
+
+// Verify checks that the data key of every room can be unwrapped by the repos keyring and every message stored can be opened,
+// along with the reactions, read markers and thread summaries kept about them.
+// It returns an error for the first data key, message or record that cannot be, naming its room.
+func (r *MessageRepo) Verify() (*Verification, error) {
+	if r.keyring == nil {
+		return nil, errors.New("the repo has no keyring")
+	}
+
+	v := &Verification{}
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(dataKeysBucket); b != nil {
+			err := b.ForEach(func(ID, wrapped []byte) error {
+				if _, err := r.keyring.Unwrap(wrapped, ID); err != nil {
+					return errors.Wrapf(err, "could not unwrap data key of %s", ID)
+				}
+
+				v.DataKeys++
+
+				if r.keyring.WrappedBy(wrapped) != r.keyring.Primary() {
+					v.Stale++
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if reserved(name) {
+				return nil
+			}
+
+			s, err := r.sealer(tx, string(name), false)
+
+			if err != nil {
+				return err
+			}
+
+			check := func(stored []byte, path ...[]byte) error {
+				// nested buckets have no value
+				if stored == nil {
+					return nil
+				}
+
+				if err := s.unmarshal(stored, &racer.Message{}, path...); err != nil {
+					return errors.Wrapf(err, "room %s", name)
+				}
+
+				if keyring.Sealed(stored) {
+					v.Sealed++
+				} else {
+					v.Plaintext++
+				}
+
+				return nil
+			}
+
+			err = b.ForEach(func(k, stored []byte) error {
+				return check(stored, k)
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if edits := b.Bucket(editsBucket); edits != nil {
+				err := edits.ForEach(func(msgID, _ []byte) error {
+					if history := edits.Bucket(msgID); history != nil {
+						return history.ForEach(func(k, stored []byte) error {
+							return check(stored, msgID, k)
+						})
+					}
+
+					return nil
+				})
+
+				if err != nil {
+					return err
+				}
+			}
+
+			if changes := b.Bucket(changesBucket); changes != nil {
+				err := changes.ForEach(func(msgID, _ []byte) error {
+					if records := changes.Bucket(msgID); records != nil {
+						return records.ForEach(func(k, stored []byte) error {
+							return check(stored, changesBucket, msgID, k)
+						})
+					}
+
+					return nil
+				})
+
+				if err != nil {
+					return err
+				}
+			}
+
+			record := func(stored []byte, path ...[]byte) error {
+				if _, err := s.open(stored, path...); err != nil {
+					return errors.Wrapf(err, "room %s", name)
+				}
+
+				if keyring.Sealed(stored) {
+					v.Records++
+				} else {
+					v.PlaintextRecords++
+				}
+
+				return nil
+			}
+
+			if reactions := b.Bucket(reactionsBucket); reactions != nil {
+				err := reactions.ForEach(func(msgID, _ []byte) error {
+					if r := reactions.Bucket(msgID); r != nil {
+						return r.ForEach(func(k, stored []byte) error {
+							return record(stored, reactionsBucket, msgID, k)
+						})
+					}
+
+					return nil
+				})
+
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, bucket := range [][]byte{readsBucket, summaryBucket} {
+				if records := b.Bucket(bucket); records != nil {
+					err := records.ForEach(func(k, stored []byte) error {
+						return record(stored, bucket, k)
+					})
+
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
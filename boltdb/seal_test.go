@@ -0,0 +1,230 @@
+package boltdb_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/boltdb"
+	"github.com/tinylttl/racer/keyring"
+)
+
+// newKeyring returns a keyring of master keys derived from names, the first of them is the primary
+func newKeyring(t *testing.T, names ...string) *keyring.Keyring {
+	var masters [][]byte
+
+	for _, name := range names {
+		key := sha256.Sum256([]byte(name))
+		masters = append(masters, key[:])
+	}
+
+	k, err := keyring.New(masters[0], masters[1:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+func TestMessageRepo_Encryption(t *testing.T) {
+	t.Run("it never stores bodies in plaintext", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		repo := boltdb.NewMessageRepo(tr.db, boltdb.WithKeyring(newKeyring(t, "old")))
+
+		repo.Put("23",
+			&racer.Message{ID: "a", Body: "attack at dawn", SenderID: 7, Timestamp: 1},
+			&racer.Message{ID: "b", Type: racer.TypeEdit, ParentID: "a", Body: "attack at dusk", SenderID: 7, Timestamp: 2},
+		)
+
+		raw, err := ioutil.ReadFile(tr.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(raw, []byte("attack at")) {
+			t.Fatalf("got: a body in plaintext on disk, want every body sealed")
+		}
+
+		got, err := repo.Fetch("23", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Body != "attack at dusk" {
+			t.Fatalf("got: %q, want: %q", got.Body, "attack at dusk")
+		}
+
+		edits, err := repo.Edits("23", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(edits) != 1 || edits[0].Body != "attack at dawn" {
+			t.Fatalf("got: %v, want the version the edit replaced", edits)
+		}
+
+		if _, err := boltdb.NewMessageRepo(tr.db).Fetch("23", "a"); err == nil {
+			t.Fatalf("got: nil error, want a repo without the master key to fail")
+		}
+	})
+
+	t.Run("it rotates the master key without rewriting messages", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		// messages stored before the repo was encrypted stay as they are
+		boltdb.NewMessageRepo(tr.db).Put("23", &racer.Message{ID: "a", Body: "plain", Timestamp: 1})
+		boltdb.NewMessageRepo(tr.db, boltdb.WithKeyring(newKeyring(t, "old"))).Put("23", &racer.Message{ID: "b", Body: "sealed", Timestamp: 2})
+
+		rotating := boltdb.NewMessageRepo(tr.db, boltdb.WithKeyring(newKeyring(t, "new", "old")))
+
+		v, err := rotating.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := (boltdb.Verification{DataKeys: 1, Stale: 1, Sealed: 1, Plaintext: 1}); *v != want {
+			t.Fatalf("got: %+v, want: %+v", *v, want)
+		}
+
+		if n, err := rotating.RotateDataKeys(); err != nil || n != 1 {
+			t.Fatalf("got: %d %v, want: 1 rotated", n, err)
+		}
+
+		rotated := boltdb.NewMessageRepo(tr.db, boltdb.WithKeyring(newKeyring(t, "new")))
+
+		if v, err := rotated.Verify(); err != nil || v.Stale != 0 || v.Sealed != 1 {
+			t.Fatalf("got: %+v %v, want every data key wrapped by the new master key", v, err)
+		}
+
+		msgs, err := rotated.FetchX("23", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(msgs) != 2 || msgs[0].Body != "sealed" || msgs[1].Body != "plain" {
+			t.Fatalf("got: %v, want both messages", msgs)
+		}
+
+		if _, err := boltdb.NewMessageRepo(tr.db, boltdb.WithKeyring(newKeyring(t, "old"))).Verify(); err == nil {
+			t.Fatalf("got: nil error, want the old master key to no longer unwrap the data key")
+		}
+	})
+	t.Run("it refuses to open messages moved to another key", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		repo := boltdb.NewMessageRepo(tr.db, boltdb.WithKeyring(newKeyring(t, "old")))
+
+		repo.Put("23",
+			&racer.Message{ID: "a", Body: "attack at dawn", Timestamp: 1},
+			&racer.Message{ID: "b", Body: "retreat", Timestamp: 2},
+		)
+
+		key := func(timestamp int64) []byte {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, uint64(timestamp))
+			return k
+		}
+
+		err := tr.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("23"))
+			a, r := append([]byte(nil), b.Get(key(1))...), append([]byte(nil), b.Get(key(2))...)
+
+			if err := b.Put(key(1), r); err != nil {
+				return err
+			}
+
+			return b.Put(key(2), a)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := repo.Fetch("23", "a"); err == nil {
+			t.Fatalf("got: nil error, want a message swapped into another key to fail to open")
+		}
+
+		if _, err := repo.Verify(); err == nil {
+			t.Fatalf("got: nil error, want verify to catch the swapped messages")
+		}
+	})
+
+	t.Run("it seals reactions, read markers and thread summaries", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		repo := boltdb.NewMessageRepo(tr.db, boltdb.WithKeyring(newKeyring(t, "old")))
+
+		repo.Put("23",
+			&racer.Message{ID: "a", Body: "hi", SenderID: 7, Timestamp: 1},
+			&racer.Message{ID: "b", Body: "hey", ParentID: "a", SenderID: 8, Timestamp: 2},
+			&racer.Message{ID: "c", Type: racer.TypeReaction, ParentID: "a", Body: "secretreaction", SenderID: 8, Timestamp: 3},
+			&racer.Message{ID: "d", Type: racer.TypeRead, ParentID: "a", SenderID: 8, Timestamp: 4},
+		)
+
+		raw, err := ioutil.ReadFile(tr.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(raw, []byte("secretreaction")) {
+			t.Fatalf("got: a reaction in plaintext on disk, want every reaction sealed")
+		}
+
+		got, err := repo.Fetch("23", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got.Reactions) != 1 || got.Reactions[0].Body != "secretreaction" || got.ReplyCount != 1 || got.LastReply != 2 {
+			t.Fatalf("got: %+v, want the reaction and the summary of the thread", got)
+		}
+
+		if unread, err := repo.Unread(8); err != nil || len(unread) != 1 || unread["23"] != 0 {
+			t.Fatalf("got: %v %v, want nothing unread in 23", unread, err)
+		}
+
+		v, err := repo.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.Records != 3 || v.PlaintextRecords != 0 {
+			t.Fatalf("got: %+v, want the reaction, read marker and summary sealed", *v)
+		}
+	})
+
+	t.Run("it reads and takes back reactions stored before the repo was encrypted", func(t *testing.T) {
+		tr := newRepo()
+		defer tr.close()
+
+		boltdb.NewMessageRepo(tr.db).Put("23",
+			&racer.Message{ID: "a", Body: "hi", SenderID: 7, Timestamp: 1},
+			&racer.Message{ID: "b", Type: racer.TypeReaction, ParentID: "a", Body: "👍", SenderID: 8, Timestamp: 2},
+		)
+
+		repo := boltdb.NewMessageRepo(tr.db, boltdb.WithKeyring(newKeyring(t, "old")))
+
+		got, err := repo.Fetch("23", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got.Reactions) != 1 || got.Reactions[0].Body != "👍" {
+			t.Fatalf("got: %+v, want the plaintext reaction", got.Reactions)
+		}
+
+		repo.Put("23", &racer.Message{ID: "c", Type: racer.TypeUnreaction, ParentID: "a", Body: "👍", SenderID: 8, Timestamp: 3})
+
+		if got, _ := repo.Fetch("23", "a"); len(got.Reactions) != 0 {
+			t.Fatalf("got: %+v, want the reaction taken back", got.Reactions)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package boltdb
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+)
+
+var _ racer.SeqRepo = (*MessageRepo)(nil)
+
+// seqsReservedBucket maps the ID of every rooms bucket to the highest seq reserved for the room, see ReserveSeq.
+// Like keysBucket the leading zero byte reserves the name so no room can be stored under it.
+var seqsReservedBucket = []byte("\x00seqs")
+
+// LastSeq returns the highest seq reserved for the room identified by ID, 0 if none has been.
+func (r *MessageRepo) LastSeq(ID string) (uint64, error) {
+	var seq uint64
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(seqsReservedBucket); b != nil {
+			if v := b.Get([]byte(ID)); v != nil {
+				seq = uint64(btoi64(v))
+			}
+		}
+
+		return nil
+	})
+
+	return seq, err
+}
+
+// ReserveSeq records that seqs up to and including seq may be handed out in the room identified by ID.
+// The reserved seq of a room never goes down, reserving a lower seq than the last has no effect.
+func (r *MessageRepo) ReserveSeq(ID string, seq uint64) error {
+	if reserved([]byte(ID)) {
+		return &racer.InvalidError{Field: "chatID", Reason: "is reserved"}
+	}
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(seqsReservedBucket)
+
+		if err != nil {
+			return errors.Wrap(err, "could not find or create reserved seqs bucket")
+		}
+
+		if v := b.Get([]byte(ID)); v != nil && uint64(btoi64(v)) >= seq {
+			return nil
+		}
+
+		return errors.Wrap(b.Put([]byte(ID), i64tob(int64(seq))), "could not reserve seq")
+	})
+}
+
+// seqIndex returns the index of the messages in the bucket b by their seq, opened with s.
+// A room that was stored in before messages were indexed has the messages already in it indexed the first time.
+func seqIndex(b *bolt.Bucket, s sealer) (*bolt.Bucket, error) {
+	if seqs := b.Bucket(seqsBucket); seqs != nil {
+		return seqs, nil
+	}
+
+	seqs, err := b.CreateBucket(seqsBucket)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create seq index")
+	}
+
+	// a bucket cannot be changed while it is walked
+	keys := make(map[uint64][]byte)
+
+	err = b.ForEach(func(k, v []byte) error {
+		// nested buckets have no value
+		if v == nil {
+			return nil
+		}
+
+		msg := &racer.Message{}
+
+		if err := s.unmarshal(v, msg, k); err != nil {
+			return err
+		}
+
+		if msg.Seq != 0 {
+			keys[msg.Seq] = k
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for seq, k := range keys {
+		if err := seqs.Put(i64tob(int64(seq)), k); err != nil {
+			return nil, errors.Wrap(err, "could not index msg by seq")
+		}
+	}
+
+	return seqs, nil
+}
@@ -11,12 +11,13 @@ import (
 type Broker struct {
 	topics map[string]*Topic
 	//idgen	racer.id
-	mu     sync.Mutex
+	mu       sync.Mutex
+	creating map[string]chan struct{} // closed once the callback of the lookup that created the topic for a key returns
 }
 
 // NewBroker creates a new Broker. A new map is intialized by default if WithMap option is not passed in.
 func NewBroker(opts ...func(*Broker)) *Broker {
-	b := Broker{topics: make(map[string]*Topic)}
+	b := Broker{topics: make(map[string]*Topic), creating: make(map[string]chan struct{})}
 
 	for _, opt := range opts {
 		opt(&b)
@@ -69,22 +70,44 @@ func (b *Broker) Add(key string, t *Topic) bool {
 // If a topic is found, we will pass it in and set found to true.
 // If a topic is not found a new one is created and registered in the map, found will then be set to false and the new topic is passed to the cb.
 //
+// Lookups of a key whose topic is still being created wait for the callback of the lookup that created it to return,
+// then look again. So a callback that cannot start the topic it was passed can Remove it, and the lookups waiting on it create another.
+//
 // NOTE: If you would like to remove a topic from the manager, make sure you always call the BrokerManagers Remove method as it is thread safe.
 func (b *Broker) Lookup(key string, cb func(found bool, b *Topic)) {
-	b.mu.Lock()
-	topic, exists := b.topics[key]
-
-	if !exists {
-		topic := NewTopic(key)
-		b.topics[key] = topic
+	for {
+		b.mu.Lock()
+		topic, exists := b.topics[key]
+
+		if !exists {
+			topic := NewTopic(key)
+			created := make(chan struct{})
+			b.topics[key] = topic
+			b.creating[key] = created
+			b.mu.Unlock()
+
+			defer func() {
+				b.mu.Lock()
+				delete(b.creating, key)
+				b.mu.Unlock()
+
+				close(created)
+			}()
+
+			cb(false, topic)
+			return
+		}
+
+		created, creating := b.creating[key]
 		b.mu.Unlock()
 
-		cb(false, topic)
-		return
-	}
+		if !creating {
+			cb(true, topic)
+			return
+		}
 
-	b.mu.Unlock()
-	cb(true, topic)
+		<-created
+	}
 }
 
 // Size returns the size of the brokers underlying map
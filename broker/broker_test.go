@@ -1,6 +1,7 @@
 package broker_test
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -100,6 +101,42 @@ func TestLookupConcurrent(t *testing.T) {
 	}
 }
 
+// TestLookupRemoved tests that lookups waiting on a topic being created create another when the topic is removed
+func TestLookupRemoved(t *testing.T) {
+	t.Run("It creates a new topic for lookups waiting on one that was removed", func(t *testing.T) {
+		bm := broker.NewBroker()
+
+		entered := make(chan struct{})
+		var first *broker.Topic
+
+		go bm.Lookup("23", func(found bool, b *broker.Topic) {
+			first = b
+			close(entered)
+
+			// give the second lookup time to find the topic while it is still being created
+			time.Sleep(20 * time.Millisecond)
+			bm.Remove("23")
+		})
+
+		<-entered
+
+		var found bool
+		var second *broker.Topic
+
+		bm.Lookup("23", func(f bool, b *broker.Topic) {
+			found, second = f, b
+		})
+
+		if found {
+			t.Fatalf("got: %v, want: %v", found, false)
+		}
+
+		if second == first {
+			t.Fatalf("got: the removed topic, want: a new topic")
+		}
+	})
+}
+
 // TestRemoveConcurrent tests that multiple concurrent calls to
 // a managers remove function can be made safely.
 // These tests cover all code in the Remove function
@@ -147,7 +184,7 @@ func TestRemoveConcurrent(t *testing.T) {
 				go func(i int) {
 					if removed := manager.Remove(tc.keys[i]); !removed {
 						if got != tc.want {
-							t.Fatalf("got: %d, want: %d", got, tc.want)
+							t.Errorf("got: %d, want: %d", got, tc.want)
 						}
 					}
 					done <- struct{}{}
@@ -248,3 +285,174 @@ func TestStart(t *testing.T) {
 		})
 	}
 }
+
+func TestResume(t *testing.T) {
+	cases := []struct {
+		name     string
+		histsize int
+		since    uint64
+		want     []uint64
+		wantOK   bool
+	}{
+		{name: "It returns every message broadcast after since", histsize: 10, since: 2, want: []uint64{3, 4, 5}, wantOK: true},
+		{name: "It returns nothing to an up to date subscriber", histsize: 10, since: 5, want: []uint64{}, wantOK: true},
+		{name: "It reports when messages have fallen out of its history", histsize: 2, since: 1, want: []uint64{4, 5}, wantOK: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			topic := broker.NewTopic("x", broker.WithHistorySize(tc.histsize))
+			go topic.Start()
+
+			sub := make(chan *broker.Message, 10)
+			topic.Register() <- sub
+
+			for i := 0; i < 5; i++ {
+				topic.Broadcast() <- &broker.Message{Payload: i}
+			}
+
+			for i := 1; i <= 5; i++ {
+				if got := <-sub; got.Seq != uint64(i) {
+					t.Fatalf("got: %d, want: %d", got.Seq, i)
+				}
+			}
+
+			resumed := make(chan *broker.Message, 10)
+			missed, ok := topic.Resume(resumed, tc.since)
+
+			if ok != tc.wantOK {
+				t.Fatalf("got: %v, want: %v", ok, tc.wantOK)
+			}
+
+			if len(missed) != len(tc.want) {
+				t.Fatalf("got: %d messages, want: %d", len(missed), len(tc.want))
+			}
+
+			for i, msg := range missed {
+				if msg.Seq != tc.want[i] {
+					t.Fatalf("got: %d, want: %d", msg.Seq, tc.want[i])
+				}
+			}
+
+			// the resumed subscriber recieves live messages once it has caught up
+			topic.Broadcast() <- &broker.Message{Payload: 5}
+
+			if got := <-resumed; got.Seq != 6 {
+				t.Fatalf("got: %d, want: %d", got.Seq, 6)
+			}
+
+			topic.Unregister() <- sub
+			topic.Unregister() <- resumed
+		})
+	}
+}
+
+func TestWithSeq(t *testing.T) {
+	t.Run("It counts up from the seeded sequence number", func(t *testing.T) {
+		topic := broker.NewTopic("x", broker.WithSeq(41))
+		go topic.Start()
+
+		sub := make(chan *broker.Message, 1)
+		topic.Register() <- sub
+		topic.Broadcast() <- &broker.Message{}
+
+		if got := <-sub; got.Seq != 42 {
+			t.Fatalf("got: %d, want: %d", got.Seq, 42)
+		}
+
+		topic.Unregister() <- sub
+	})
+}
+
+func TestWithSeqReservation(t *testing.T) {
+	t.Run("It reserves a block of sequence numbers before handing out the first of them", func(t *testing.T) {
+		var reserved []uint64
+
+		topic := broker.NewTopic("x", broker.WithSeq(10), broker.WithSeqReservation(3, func(seq uint64) error {
+			reserved = append(reserved, seq)
+			return nil
+		}))
+		go topic.Start()
+
+		sub := make(chan *broker.Message, 5)
+		topic.Register() <- sub
+
+		for i := 0; i < 5; i++ {
+			topic.Broadcast() <- &broker.Message{}
+			<-sub
+		}
+
+		topic.Unregister() <- sub
+
+		want := []uint64{13, 16}
+
+		if len(reserved) != len(want) || reserved[0] != want[0] || reserved[1] != want[1] {
+			t.Fatalf("got: %v, want: %v", reserved, want)
+		}
+	})
+
+	t.Run("It tries again for the next message when reserving fails", func(t *testing.T) {
+		var calls int
+
+		topic := broker.NewTopic("x", broker.WithSeqReservation(10, func(seq uint64) error {
+			calls++
+			return errors.New("unavailable")
+		}))
+		go topic.Start()
+
+		sub := make(chan *broker.Message, 2)
+		topic.Register() <- sub
+
+		for i := 1; i <= 2; i++ {
+			topic.Broadcast() <- &broker.Message{}
+
+			if got := <-sub; got.Seq != uint64(i) {
+				t.Fatalf("got: %d, want: %d", got.Seq, i)
+			}
+		}
+
+		topic.Unregister() <- sub
+
+		if calls != 2 {
+			t.Fatalf("got: %d, want: %d", calls, 2)
+		}
+	})
+}
+
+func TestQuery(t *testing.T) {
+	topic := broker.NewTopic("x")
+	go topic.Start()
+
+	sub := make(chan *broker.Message, 10)
+	topic.Register() <- sub
+
+	for i := 1; i <= 3; i++ {
+		topic.Broadcast() <- &broker.Message{Payload: i}
+	}
+
+	topic.Broadcast() <- &broker.Message{Payload: 4, Ephemeral: true}
+
+	cases := []struct {
+		name    string
+		match   func(*broker.Message) bool
+		wantSeq uint64
+	}{
+		{name: "It finds the most recent match", match: func(m *broker.Message) bool { return m.Payload.(int) < 3 }, wantSeq: 2},
+		{name: "It never finds ephemeral messages", match: func(m *broker.Message) bool { return m.Payload.(int) == 4 }},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &broker.Query{Match: tc.match, Reply: make(chan *broker.Message, 1)}
+			topic.Query() <- q
+
+			got := <-q.Reply
+
+			if (got == nil) != (tc.wantSeq == 0) || (got != nil && got.Seq != tc.wantSeq) {
+				t.Fatalf("got: %+v, want seq: %d", got, tc.wantSeq)
+			}
+		})
+	}
+
+	topic.Unregister() <- sub
+}
@@ -10,27 +10,115 @@ import (
 type Topic struct {
 	subscribers map[chan<- *Message]bool
 	register    chan chan<- *Message
+	resume      chan *resumption
+	query       chan *Query
 	broadcast   chan *Message
 	unregister  chan chan<- *Message
+	history     []*Message // the most recently broadcast messages, oldest first
+	histsize    int
+	seq         uint64          // sequence number of the last message broadcast
+	recorder    chan<- *Message // recieves every message that is not ephemeral, may be nil
 	ID          string
+
+	reserve     func(seq uint64) error // reserves sequence numbers before they are handed out, may be nil, see WithSeqReservation
+	reserveSize uint64
+	reserved    uint64 // the highest sequence number reserved
 }
 
 // Message is sent through the brokers broadcast channel and relayed to any listeners through
 // their respective send channels.
 type Message struct {
-	Recieved time.Time   // when the topic got the message on its broadcast channel
-	Sent     time.Time   // when the topic sent the message to all its registered client channels
-	Payload  interface{} // any clients using the same topic should be expecting the same type of message
+	Recieved  time.Time   // when the topic got the message on its broadcast channel
+	Sent      time.Time   // when the topic sent the message to all its registered client channels
+	Seq       uint64      // assigned by the topic, every message broadcast has a higher sequence number than the last
+	Ephemeral bool        // ephemeral messages are not kept in the topics history or sent to its recorder
+	Payload   interface{} // any clients using the same topic should be expecting the same type of message
+}
+
+// resumption is a request to register a subscriber and recieve everything it missed since a sequence number
+type resumption struct {
+	subscriber chan<- *Message
+	since      uint64
+	reply      chan resumed
+}
+
+type resumed struct {
+	missed []*Message
+	ok     bool
+}
+
+// Query asks a topic for the most recent message in its history that Match returns true for.
+// The topic sends the message, or nil if none match, on Reply which must be buffered.
+// Match is called from the topics goroutine and must not block.
+type Query struct {
+	Match func(*Message) bool
+	Reply chan *Message
 }
 
-// NewTopic creates a new Topic
-func NewTopic(ID string) *Topic {
-	return &Topic{
+// DefaultHistorySize is the default number of recent messages a topic holds on to for subscribers that resume.
+const DefaultHistorySize = 256
+
+// NewTopic creates a new Topic. It can take a variadic number of functional options.
+func NewTopic(ID string, opts ...func(*Topic)) *Topic {
+	t := &Topic{
 		ID:          ID,
 		subscribers: make(map[chan<- *Message]bool),
 		broadcast:   make(chan *Message),
 		register:    make(chan chan<- *Message),
+		resume:      make(chan *resumption),
+		query:       make(chan *Query),
 		unregister:  make(chan chan<- *Message),
+		histsize:    DefaultHistorySize,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+// WithHistorySize sets the number of recent messages the topic holds on to.
+// Use with NewTopic()
+func WithHistorySize(size int) func(*Topic) {
+	return func(t *Topic) {
+		t.histsize = size
+	}
+}
+
+// WithSeq sets the sequence number the topic counts up from, the first message broadcast will have seq + 1.
+// Seeding a topic with the last sequence number it handed out keeps sequence numbers increasing across restarts.
+// Use with NewTopic() or on a topic that has not been started.
+func WithSeq(seq uint64) func(*Topic) {
+	return func(t *Topic) {
+		t.seq = seq
+	}
+}
+
+// WithSeqReservation has the topic reserve sequence numbers in blocks of size before it hands any of them out,
+// by calling reserve with the highest sequence number of the block. Seeding a topic that starts again with the last sequence number
+// reserved keeps it from handing out a sequence number twice, whatever became of the messages they were handed to.
+// A message is still broadcast when reserving fails, the topic tries again for the next message.
+// reserve is called from the topics goroutine. A size of 0 reserves one sequence number at a time.
+// Use with NewTopic() or on a topic that has not been started.
+func WithSeqReservation(size uint64, reserve func(seq uint64) error) func(*Topic) {
+	return func(t *Topic) {
+		if size == 0 {
+			size = 1
+		}
+
+		t.reserve = reserve
+		t.reserveSize = size
+	}
+}
+
+// WithRecorder sets a channel that recieves every message broadcast that is not ephemeral, in the order they were broadcast.
+// Unlike a subscriber the recorder is never dropped for falling behind, the topic waits for it instead,
+// and it does not keep the topic running. The channel is closed once the topic stops.
+// Use with NewTopic() or on a topic that has not been started.
+func WithRecorder(recorder chan<- *Message) func(*Topic) {
+	return func(t *Topic) {
+		t.recorder = recorder
 	}
 }
 
@@ -38,6 +126,24 @@ func NewTopic(ID string) *Topic {
 // whenever there is a message sent to the brokers broadcast channel.
 func (t *Topic) Register() chan chan<- *Message { return t.register }
 
+// Resume registers a new send channel with the topic just like Register, and returns every message
+// broadcast after the sequence number since, oldest first. Registering and collecting the missed messages happen together
+// so the subscriber will not miss or recieve twice any message broadcast in between.
+// ok is false if the topic no longer holds every message broadcast after since, in which case missed holds those it does have.
+//
+// NOTE: Resume blocks until the topic is started.
+func (t *Topic) Resume(subscriber chan<- *Message, since uint64) (missed []*Message, ok bool) {
+	r := &resumption{subscriber: subscriber, since: since, reply: make(chan resumed, 1)}
+
+	t.resume <- r
+	res := <-r.reply
+
+	return res.missed, res.ok
+}
+
+// Query exposes a topics internal channel for searching its history, see Query.
+func (t *Topic) Query() chan<- *Query { return t.query }
+
 // Broadcast exposes a topics internal broadcast channel.
 // Use this to send messages to other clients that subscribe to this topic.
 func (t *Topic) Broadcast() chan<- *Message { return t.broadcast }
@@ -51,21 +157,58 @@ func (t *Topic) Unregister() chan chan<- *Message { return t.unregister }
 // If a client is unregistered from the Topic it will remove it from its list of subscribers and close its channel
 // If the Brokers boradcast channel recieves a message, it will relay that message to all subscribers in its map through their respective send channels
 func (t *Topic) Start() {
+	if t.recorder != nil {
+		defer close(t.recorder)
+	}
+
 loop:
 	for {
 		select {
 		case client := <-t.register:
 			t.subscribers[client] = true
 
+		case r := <-t.resume:
+			t.subscribers[r.subscriber] = true
+
+			missed, ok := t.since(r.since)
+			r.reply <- resumed{missed: missed, ok: ok}
+
+		case q := <-t.query:
+			q.Reply <- t.find(q.Match)
+
 		case unregistered := <-t.unregister:
-			delete(t.subscribers, unregistered)
-			close(unregistered)
+			// a subscriber that was too slow to recieve has already been removed and had its channel closed
+			if _, ok := t.subscribers[unregistered]; ok {
+				delete(t.subscribers, unregistered)
+				close(unregistered)
+			}
 
 			if len(t.subscribers) == 0 {
 				break loop
 			}
 
 		case msg := <-t.broadcast:
+			t.seq++
+			msg.Seq = t.seq
+
+			if t.reserve != nil && t.seq > t.reserved {
+				if err := t.reserve(t.seq + t.reserveSize - 1); err == nil {
+					t.reserved = t.seq + t.reserveSize - 1
+				}
+			}
+
+			if !msg.Ephemeral && t.histsize > 0 {
+				t.history = append(t.history, msg)
+
+				if len(t.history) > t.histsize {
+					t.history = t.history[1:]
+				}
+			}
+
+			if !msg.Ephemeral && t.recorder != nil {
+				t.recorder <- msg
+			}
+
 			for client := range t.subscribers {
 				select {
 				case client <- msg:
@@ -78,3 +221,36 @@ loop:
 		}
 	}
 }
+
+// find returns the most recent message in the topics history that match returns true for.
+func (t *Topic) find(match func(*Message) bool) *Message {
+	for i := len(t.history) - 1; i >= 0; i-- {
+		if match(t.history[i]) {
+			return t.history[i]
+		}
+	}
+
+	return nil
+}
+
+// since returns the messages in the topics history broadcast after the sequence number seq
+// and whether the history reaches back far enough to hold all of them.
+func (t *Topic) since(seq uint64) ([]*Message, bool) {
+	if seq >= t.seq {
+		return nil, true
+	}
+
+	i := len(t.history)
+	for i > 0 && t.history[i-1].Seq > seq {
+		i--
+	}
+
+	missed := make([]*Message, len(t.history)-i)
+	copy(missed, t.history[i:])
+
+	// if every held message came after seq, the first of them must directly follow seq for nothing to have been dropped.
+	// An ephemeral message directly after seq makes this report false, which only costs the caller a needless lookup elsewhere
+	ok := i > 0 || (len(t.history) > 0 && t.history[0].Seq == seq+1)
+
+	return missed, ok
+}
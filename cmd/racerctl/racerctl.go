@@ -0,0 +1,383 @@
+// Command racerctl administers the data racerd leaves on disk.
+//
+// Usage:
+//
+//	racerctl import-dead-letters [-db path] [-dead-letter path] [-master-key-file path]
+//	racerctl keys create [-db path] -name name -grant room=scope,... [-grant ...] [-sender id]
+//	racerctl keys list [-db path]
+//	racerctl keys revoke [-db path] id
+//	racerctl encryption genkey
+//	racerctl encryption rotate [-db path] [-master-key-file path] -old-master-key-file path [-old-master-key-file ...]
+//	racerctl encryption verify [-db path] [-master-key-file path] [-old-master-key-file ...]
+//
+// import-dead-letters puts every batch of messages racerd could not back up into the database.
+// Batches that fail to import are left in the dead letter file to be tried again, and an import that was interrupted
+// picks up after the last batch it finished. Batches racerd sealed under a master key need the same master key to be imported.
+//
+// encryption manages the master key stored messages are encrypted under. Every room has a data key of its own,
+// stored wrapped by the master key, which is read from -master-key-file or $RACER_MASTER_KEY just like racerd does.
+// genkey prints a new master key. rotate rewraps every data key with the master key, unwrapping them with the old master keys,
+// without rewriting a single message. Once it is done racerd can be restarted with the new master key alone.
+// verify checks that every data key and message can be decrypted and counts the messages still stored as plaintext.
+// racerd also seals its wal and dead letter file under the master key, which rotate leaves as they are,
+// so import the dead letters and let racerd replay its wal under the old master key before rotating.
+//
+// keys manages the api keys bots and integrations connect with. A grant names a room, or * for every room,
+// and the scopes granted in it: read, post or admin. The key itself is only ever printed when it is created.
+// racerd holds the database open while it runs, so use its admin api at /v1/admin/keys instead while it is up.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/boltdb"
+	"github.com/tinylttl/racer/deadletter"
+	"github.com/tinylttl/racer/keyring"
+)
+
+const usage = `usage: racerctl <command> [flags]
+
+commands:
+  import-dead-letters  import the batches racerd could not back up into the database
+  keys                 create, list or revoke api keys
+  encryption           generate, rotate or verify the master key stored messages are encrypted under
+`
+
+const keysUsage = `usage: racerctl keys <create|list|revoke> [flags]`
+
+const encryptionUsage = `usage: racerctl encryption <genkey|rotate|verify> [flags]`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command named by the first argument
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "import-dead-letters":
+		return importDeadLetters(args[1:], out)
+	case "keys":
+		return keys(args[1:], out)
+	case "encryption":
+		return encryption(args[1:], out)
+	default:
+		return errors.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+// importDeadLetters imports the dead letter file into the database
+func importDeadLetters(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import-dead-letters", flag.ContinueOnError)
+
+	dbPath := fs.String("db", "", "path of the database, defaults to the racerd default")
+	file := fs.String("dead-letter", defaultPath("deadletter.jsonl"), "dead letter file to import")
+	masterKeyFile := fs.String("master-key-file", "", "file holding the master key racerd encrypts messages under, defaults to $"+keyring.EnvMasterKey)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var k *keyring.Keyring
+
+	if key, err := keyring.Load(*masterKeyFile); err != nil {
+		return err
+	} else if key != nil {
+		if k, err = keyring.New(key); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB(*dbPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	n, err := deadletter.NewFile(*file, deadletter.WithKeyring(k)).Import(boltdb.NewMessageRepo(db, boltdb.WithKeyring(k)))
+
+	fmt.Fprintf(out, "imported %d batches\n", n)
+
+	return err
+}
+
+// openDB opens the database at path, or the racerd default if path is empty
+func openDB(path string) (*boltdb.DB, error) {
+	var opts []func(*boltdb.DB)
+
+	if path != "" {
+		opts = append(opts, boltdb.WithPath(path))
+	}
+
+	db := boltdb.NewDB(opts...)
+
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// keys runs the keys subcommand named by the first argument
+func keys(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	fs := flag.NewFlagSet("keys "+args[0], flag.ContinueOnError)
+	dbPath := fs.String("db", "", "path of the database, defaults to the racerd default")
+
+	var (
+		name   *string
+		sender *int
+		grants = grantsFlag{}
+	)
+
+	switch args[0] {
+	case "create":
+		name = fs.String("name", "", "what the key is for")
+		sender = fs.Int("sender", 0, "sender id of the messages sent with the key, one reserved for api keys from 2^52 to 2^53-1, derived from the key if 0")
+		fs.Var(grants, "grant", "room=scope,... granted to the key, may be repeated")
+	case "list", "revoke":
+	default:
+		return errors.Errorf("unknown keys command %q\n%s", args[0], keysUsage)
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if args[0] == "create" && len(grants) == 0 {
+		return errors.New("a key must be granted at least one room with -grant")
+	}
+
+	if args[0] == "revoke" && fs.NArg() != 1 {
+		return errors.New("usage: racerctl keys revoke [-db path] id")
+	}
+
+	db, err := openDB(*dbPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	repo := boltdb.NewKeyRepo(db)
+
+	switch args[0] {
+	case "create":
+		k, key, err := racer.NewAPIKey(*name, *sender, racer.Grants(grants))
+
+		if err != nil {
+			return err
+		}
+
+		if err := repo.PutKey(k); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "created key %s for sender %d, it will not be shown again:\n%s\n", k.ID, k.SenderID, key)
+	case "list":
+		ks, err := repo.Keys()
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range ks {
+			fmt.Fprintf(out, "%s\t%s\t%d\t%s\n", k.ID, k.Name, k.SenderID, grantsFlag(k.Grants))
+		}
+	case "revoke":
+		if err := repo.DeleteKey(fs.Arg(0)); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "revoked key %s\n", fs.Arg(0))
+	}
+
+	return nil
+}
+
+// encryption runs the encryption subcommand named by the first argument
+func encryption(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(encryptionUsage)
+	}
+
+	if args[0] == "genkey" {
+		key, err := keyring.Generate()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(out, key)
+
+		return nil
+	}
+
+	fs := flag.NewFlagSet("encryption "+args[0], flag.ContinueOnError)
+	dbPath := fs.String("db", "", "path of the database, defaults to the racerd default")
+	masterKeyFile := fs.String("master-key-file", "", "file holding the master key, defaults to $"+keyring.EnvMasterKey)
+
+	var oldKeyFiles filesFlag
+	fs.Var(&oldKeyFiles, "old-master-key-file", "file holding a master key data keys may still be wrapped by, may be repeated")
+
+	switch args[0] {
+	case "rotate", "verify":
+	default:
+		return errors.Errorf("unknown encryption command %q\n%s", args[0], encryptionUsage)
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if args[0] == "rotate" && len(oldKeyFiles) == 0 {
+		return errors.New("rotating needs the master keys to rotate away from with -old-master-key-file")
+	}
+
+	primary, err := keyring.Load(*masterKeyFile)
+
+	if err != nil {
+		return err
+	}
+
+	if primary == nil {
+		return errors.Errorf("no master key, pass -master-key-file or set $%s", keyring.EnvMasterKey)
+	}
+
+	var previous [][]byte
+
+	for _, path := range oldKeyFiles {
+		key, err := keyring.Load(path)
+
+		if err != nil {
+			return err
+		}
+
+		previous = append(previous, key)
+	}
+
+	k, err := keyring.New(primary, previous...)
+
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(*dbPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	repo := boltdb.NewMessageRepo(db, boltdb.WithKeyring(k))
+
+	switch args[0] {
+	case "rotate":
+		n, err := repo.RotateDataKeys()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "rewrapped %d data keys with master key %s\n", n, k.Primary())
+	case "verify":
+		v, err := repo.Verify()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "%d data keys, %d wrapped by a master key other than %s\n", v.DataKeys, v.Stale, k.Primary())
+		fmt.Fprintf(out, "%d messages encrypted, %d stored as plaintext\n", v.Sealed, v.Plaintext)
+	}
+
+	return nil
+}
+
+// filesFlag collects the paths of a repeated flag
+type filesFlag []string
+
+func (f *filesFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *filesFlag) Set(path string) error {
+	*f = append(*f, path)
+	return nil
+}
+
+// grantsFlag parses repeated room=scope,... flags into grants
+type grantsFlag racer.Grants
+
+func (g grantsFlag) String() string {
+	rooms := make([]string, 0, len(g))
+
+	for room := range g {
+		rooms = append(rooms, room)
+	}
+
+	sort.Strings(rooms)
+
+	var grants []string
+
+	for _, room := range rooms {
+		scopes := make([]string, 0, len(g[room]))
+
+		for _, scope := range g[room] {
+			scopes = append(scopes, string(scope))
+		}
+
+		grants = append(grants, room+"="+strings.Join(scopes, ","))
+	}
+
+	return strings.Join(grants, " ")
+}
+
+func (g grantsFlag) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return errors.Errorf("grant %q must be room=scope,...", v)
+	}
+
+	for _, scope := range strings.Split(kv[1], ",") {
+		switch s := racer.Scope(strings.TrimSpace(scope)); s {
+		case racer.ScopeRead, racer.ScopePost, racer.ScopeAdmin:
+			g[kv[0]] = append(g[kv[0]], s)
+		default:
+			return errors.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	return nil
+}
+
+// defaultPath returns the path of name alongside the default database in the users home directory
+func defaultPath(name string) string {
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, "racer", name)
+}
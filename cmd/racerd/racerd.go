@@ -1,21 +1,322 @@
 package main
 
 import (
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/tinylttl/racer"
 	"github.com/tinylttl/racer/boltdb"
+	"github.com/tinylttl/racer/deadletter"
+	"github.com/tinylttl/racer/gorilla"
 	rhttp "github.com/tinylttl/racer/http"
+	"github.com/tinylttl/racer/keyring"
+	"github.com/tinylttl/racer/wal"
 )
 
+// config holds the settings racerd is started with
+type config struct {
+	addr   string
+	walDir string // an empty dir disables the write-ahead log
+	conn   *gorilla.Options
+	backup backupConfig
+	keys   [][2]string // the id and secret of every token signing key, oldest first, none allows anonymous clients
+	oidc   oidcConfig
+
+	masterKey []byte // wraps the data keys stored, logged and dead lettered messages are encrypted with, nil keeps them as plaintext
+}
+
+// oidcConfig holds the settings of the OpenID Connect provider users log in with
+type oidcConfig struct {
+	issuer       string // an empty issuer disables logging in
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	landing      string
+}
+
+// backupConfig holds the settings of every backupper
+type backupConfig struct {
+	interval   time.Duration
+	capacity   int
+	attempts   int
+	retryDelay time.Duration
+	maxDelay   time.Duration
+	maxHeld    int
+	deadletter string // an empty path disables dead lettering
+}
+
+// parseConfig parses the command line arguments into a config.
+// Any setting not passed in falls back to its default.
+func parseConfig(args []string) (*config, error) {
+	c := &config{conn: gorilla.NewOptions()}
+	b := &c.backup
+
+	fs := flag.NewFlagSet("racerd", flag.ContinueOnError)
+
+	fs.StringVar(&c.addr, "addr", ":80", "address to listen on")
+	fs.StringVar(&c.walDir, "wal-dir", defaultPath("wal"), "directory messages are logged to until they are backed up, empty to disable")
+	fs.IntVar(&c.conn.ReadBufferSize, "read-buffer", c.conn.ReadBufferSize, "websocket read buffer size in bytes")
+	fs.IntVar(&c.conn.WriteBufferSize, "write-buffer", c.conn.WriteBufferSize, "websocket write buffer size in bytes")
+	fs.Int64Var(&c.conn.MaxMessageSize, "max-message-size", c.conn.MaxMessageSize, "maximum size in bytes of a message read from a client")
+	fs.DurationVar(&c.conn.PongWait, "pong-wait", c.conn.PongWait, "time allowed to read the next pong from a client")
+	fs.DurationVar(&c.conn.WriteWait, "write-wait", c.conn.WriteWait, "time allowed to write a message to a client")
+	fs.IntVar(&c.conn.ReadChanSize, "read-chan-size", c.conn.ReadChanSize, "buffer size of a connections read channel")
+	fs.IntVar(&c.conn.WriteChanSize, "write-chan-size", c.conn.WriteChanSize, "buffer size of a connections write channel")
+	fs.BoolVar(&c.conn.EnableCompression, "compression", c.conn.EnableCompression, "negotiate permessage-deflate compression with clients")
+	fs.IntVar(&c.conn.CompressionLevel, "compression-level", c.conn.CompressionLevel, "flate compression level from -2 to 9")
+	fs.IntVar(&c.conn.CompressionThreshold, "compression-threshold", c.conn.CompressionThreshold, "messages smaller than this many bytes are sent uncompressed")
+	fs.IntVar(&c.conn.MaxBodySize, "max-body-size", c.conn.MaxBodySize, "maximum size in bytes of the body of a message sent by a client")
+	sanitize := fs.String("sanitize", "escape", "how html in messages sent by clients is made safe: escape, strip or none")
+	fs.DurationVar(&b.interval, "backup-interval", racer.DefaultBackupInterval, "how often held messages are backed up")
+	fs.IntVar(&b.capacity, "backup-capacity", racer.DefaultBackupCapacity, "number of held messages that triggers a backup")
+	fs.IntVar(&b.attempts, "backup-attempts", racer.DefaultBackupAttempts, "attempts made to back up a batch of messages before it is dead lettered")
+	fs.DurationVar(&b.retryDelay, "backup-retry-delay", racer.DefaultBackupRetryDelay, "delay before the first backup retry, doubled for every retry after")
+	fs.DurationVar(&b.maxDelay, "backup-max-delay", racer.DefaultBackupMaxDelay, "longest delay between backup retries")
+	fs.IntVar(&b.maxHeld, "backup-max-held", racer.DefaultBackupMaxHeld, "most messages a room holds on to while backups fail and cannot be dead lettered, the oldest are dropped")
+	fs.StringVar(&b.deadletter, "dead-letter", defaultPath("deadletter.jsonl"), "file batches that could not be backed up are spilled to, empty to disable")
+	origins := fs.String("origins", "", "comma separated list of origins allowed to connect, * may be used as a wildcard, empty to allow only the origin racerd is served from")
+	fs.StringVar(&c.oidc.issuer, "oidc-issuer", "", "url of the OpenID Connect provider users log in with, empty to disable logging in")
+	fs.StringVar(&c.oidc.clientID, "oidc-client-id", "", "client id racerd is registered with at the provider")
+	fs.StringVar(&c.oidc.clientSecret, "oidc-client-secret", "", "client secret racerd is registered with at the provider, empty for a public client")
+	fs.StringVar(&c.oidc.redirectURL, "oidc-redirect-url", "", "url of racerds /v1/login/callback endpoint as registered with the provider")
+	fs.StringVar(&c.oidc.landing, "oidc-landing", "", "url users are sent to once logged in, empty to respond with their token")
+	keys := fs.String("token-keys", "", "comma separated list of id=secret keys client tokens are signed with, oldest first, empty to allow anonymous clients")
+	masterKeyFile := fs.String("master-key-file", "", "file holding the master key messages are encrypted under in the database, wal and dead letter file, defaults to $"+keyring.EnvMasterKey+", neither keeps them as plaintext")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	for _, origin := range strings.Split(*origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			c.conn.AllowedOrigins = append(c.conn.AllowedOrigins, origin)
+		}
+	}
+
+	for _, check := range []func() error{c.checkConn, c.checkBackup} {
+		if err := check(); err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+
+	switch *sanitize {
+	case "escape":
+		c.conn.Sanitizer = racer.EscapeHTML
+	case "strip":
+		c.conn.Sanitizer = racer.StripHTML
+	case "none":
+		c.conn.Sanitizer = nil
+	default:
+		err := fmt.Errorf("invalid value %q for flag -sanitize: must be escape, strip or none", *sanitize)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	for _, key := range strings.Split(*keys, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+
+		kv := strings.SplitN(key, "=", 2)
+
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			err := fmt.Errorf("invalid value for flag -token-keys: key %q must be id=secret", kv[0])
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+
+		c.keys = append(c.keys, [2]string{kv[0], kv[1]})
+	}
+
+	if c.oidc.issuer != "" && (len(c.keys) == 0 || c.oidc.clientID == "" || c.oidc.redirectURL == "") {
+		err := errors.New("logging in with -oidc-issuer needs -token-keys, -oidc-client-id and -oidc-redirect-url")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	masterKey, err := keyring.Load(*masterKeyFile)
+
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	c.masterKey = masterKey
+
+	return c, nil
+}
+
+// checkConn reports the first connection setting that a connection cannot run with
+func (c *config) checkConn() error {
+	o := c.conn
+
+	switch {
+	case o.ReadBufferSize <= 0 || o.WriteBufferSize <= 0:
+		return errors.New("invalid value for flags -read-buffer and -write-buffer: must be positive")
+	case o.MaxMessageSize <= 0:
+		return errors.New("invalid value for flag -max-message-size: must be positive")
+	case o.PongWait <= 0:
+		return errors.New("invalid value for flag -pong-wait: must be positive")
+	case o.WriteWait <= 0:
+		return errors.New("invalid value for flag -write-wait: must be positive")
+	case o.ReadChanSize <= 0 || o.WriteChanSize <= 0:
+		return errors.New("invalid value for flags -read-chan-size and -write-chan-size: must be positive")
+	case o.CompressionLevel < flate.HuffmanOnly || o.CompressionLevel > flate.BestCompression:
+		return fmt.Errorf("invalid value for flag -compression-level: must be from %d to %d", flate.HuffmanOnly, flate.BestCompression)
+	case o.MaxBodySize <= 0:
+		return errors.New("invalid value for flag -max-body-size: must be positive")
+	case o.MaxMessageSize < int64(o.MaxBodySize)+gorilla.EnvelopeOverhead:
+		return fmt.Errorf("invalid value for flag -max-message-size: must be at least -max-body-size plus %d bytes for the rest of the frame", gorilla.EnvelopeOverhead)
+	}
+
+	return nil
+}
+
+// checkBackup reports the first backup setting that a backupper cannot run with
+func (c *config) checkBackup() error {
+	switch b := c.backup; {
+	case b.interval <= 0:
+		return errors.New("invalid value for flag -backup-interval: must be positive")
+	case b.capacity <= 0:
+		return errors.New("invalid value for flag -backup-capacity: must be positive")
+	case b.attempts <= 0:
+		return errors.New("invalid value for flag -backup-attempts: must be positive")
+	case b.retryDelay < 0 || b.maxDelay < 0:
+		return errors.New("invalid value for flags -backup-retry-delay and -backup-max-delay: must not be negative")
+	case b.maxHeld < b.capacity:
+		return errors.New("invalid value for flag -backup-max-held: must be at least -backup-capacity")
+	}
+
+	return nil
+}
+
+// defaultPath returns the path of name alongside the default database in the users home directory
+func defaultPath(name string) string {
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, "racer", name)
+}
+
+// connOptions returns the functional options that apply the configured connection settings
+func (c *config) connOptions() []func(*gorilla.Options) {
+	return []func(*gorilla.Options){
+		gorilla.WithBufferSizes(c.conn.ReadBufferSize, c.conn.WriteBufferSize),
+		gorilla.WithMaxMessageSize(c.conn.MaxMessageSize),
+		gorilla.WithPongWait(c.conn.PongWait),
+		gorilla.WithWriteWait(c.conn.WriteWait),
+		gorilla.WithChanSizes(c.conn.ReadChanSize, c.conn.WriteChanSize),
+		gorilla.WithCompression(c.conn.EnableCompression, c.conn.CompressionLevel, c.conn.CompressionThreshold),
+		gorilla.WithAllowedOrigins(c.conn.AllowedOrigins...),
+		gorilla.WithMaxBodySize(c.conn.MaxBodySize),
+		gorilla.WithSanitizer(c.conn.Sanitizer),
+	}
+}
+
+// tokenAuth returns the TokenAuth that verifies client tokens with the configured keys, nil if there are none
+func (c *config) tokenAuth() *rhttp.TokenAuth {
+	if len(c.keys) == 0 {
+		return nil
+	}
+
+	var opts []func(*rhttp.TokenAuth)
+
+	for _, k := range c.keys {
+		opts = append(opts, rhttp.WithSigningKey(k[0], []byte(k[1])))
+	}
+
+	return rhttp.NewTokenAuth(opts...)
+}
+
+// masterKeyring returns the keyring of the configured master key, nil if there is none
+func (c *config) masterKeyring() (*keyring.Keyring, error) {
+	if c.masterKey == nil {
+		return nil, nil
+	}
+
+	return keyring.New(c.masterKey)
+}
+
+// backupOptions returns the functional options that apply the configured backup settings,
+// batches are dead lettered sealed by k unless it is nil
+func (c *config) backupOptions(k *keyring.Keyring) []func(*racer.Backupper) {
+	opts := []func(*racer.Backupper){
+		racer.WithInterval(c.backup.interval),
+		racer.WithCapacity(c.backup.capacity),
+		racer.WithRetry(c.backup.attempts, c.backup.retryDelay, c.backup.maxDelay),
+		racer.WithMaxHeld(c.backup.maxHeld),
+	}
+
+	if c.backup.deadletter != "" {
+		opts = append(opts, racer.WithDeadLetter(deadletter.NewFile(c.backup.deadletter, deadletter.WithKeyring(k))))
+	}
+
+	return opts
+}
+
 func main() {
+	cfg, err := parseConfig(os.Args[1:])
+
+	if err != nil {
+		os.Exit(2)
+	}
+
 	db := boltdb.NewDB()
 
 	if err := db.Open(); err != nil {
 		panic(err)
 	}
-	
-	repo := boltdb.NewMessageRepo(db)
+
+	k, err := cfg.masterKeyring()
+
+	if err != nil {
+		log.Fatalf("could not load master key: %v", err)
+	}
+
+	repo := boltdb.NewMessageRepo(db, boltdb.WithKeyring(k))
+
+	opts := []func(*rhttp.Handler){
+		rhttp.WithConnOptions(cfg.connOptions()...),
+		rhttp.WithBackupOptions(cfg.backupOptions(k)...),
+		rhttp.WithAPIKeys(boltdb.NewKeyRepo(db)),
+	}
+
+	if auth := cfg.tokenAuth(); auth != nil {
+		opts = append(opts, rhttp.WithAuthenticator(auth.Authenticate))
+
+		if cfg.oidc.issuer != "" {
+			opts = append(opts, rhttp.WithOIDC(rhttp.NewOIDC(cfg.oidc.issuer, cfg.oidc.clientID, cfg.oidc.redirectURL, auth,
+				rhttp.WithClientSecret(cfg.oidc.clientSecret),
+				rhttp.WithLanding(cfg.oidc.landing),
+			)))
+		}
+	}
+
+	if cfg.walDir != "" {
+		journal := wal.NewJournal(cfg.walDir, wal.WithKeyring(k))
+
+		// recover any messages that were not backed up before racerd last exited
+		if err := journal.Replay(repo); err != nil {
+			log.Fatalf("could not replay wal: %v", err)
+		}
+
+		opts = append(opts, rhttp.WithJournal(journal))
+	}
+
+	handler := rhttp.NewHandler(repo, opts...)
 
 	// TODO: switch to actual Server struct because these default settings are bad
-	http.ListenAndServe(":80", rhttp.NewHandler(repo))
+	http.ListenAndServe(cfg.addr, handler)
 }
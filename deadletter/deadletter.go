@@ -0,0 +1,290 @@
+// Package deadletter implements racer.DeadLetter with a spill file on the local disk.
+//
+// Every batch of messages that could not be backed up is appended to the file as a single line of json, see Batch.
+// Batches are put back into a racer.MessageRepo with Import, usually by running racerctl once the store has recovered.
+//
+// A file with a keyring seals the messages of every batch it spills with a data key of the batches own,
+// which is kept wrapped by the keyrings master key alongside them, see Batch.
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/keyring"
+)
+
+var _ racer.DeadLetter = &File{}
+
+const (
+	// importingExt is added to the name of a spill file while it is being imported,
+	// batches spilled during an import start a new file.
+	importingExt = ".importing"
+
+	// progressExt is added to the name of a spill file being imported for the file that holds the offset
+	// of the first batch yet to be imported, so an interrupted import never imports a batch twice.
+	progressExt = ".progress"
+)
+
+// Batch is a single batch of messages for a room that could not be backed up.
+// The messages of a sealed batch are left out, they are sealed with the data key DataKey wraps instead, bound to the id of the room.
+type Batch struct {
+	ID       string           `json:"id"`
+	Reason   string           `json:"reason"`
+	Spilled  time.Time        `json:"spilled"`
+	Messages []*racer.Message `json:"messages,omitempty"`
+	DataKey  []byte           `json:"dataKey,omitempty"`
+	Sealed   []byte           `json:"sealed,omitempty"`
+}
+
+// File is a spill file of dead lettered batches.
+type File struct {
+	mu      sync.Mutex
+	path    string
+	keyring *keyring.Keyring // wraps the data key of every batch, nil to spill batches as plaintext, see WithKeyring
+}
+
+// NewFile returns a dead letter that spills batches to the file at path, which is created on the first spill.
+// It can take a variadic number of functional options.
+func NewFile(path string, opts ...func(*File)) *File {
+	f := &File{path: path}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
+}
+
+// WithKeyring seals the messages of every batch spilled with a data key of the batches own, wrapped by the master keys of k.
+// Batches spilled before the file was encrypted are still imported as they are. Use with NewFile()
+func WithKeyring(k *keyring.Keyring) func(*File) {
+	return func(f *File) {
+		f.keyring = k
+	}
+}
+
+// Spill appends msgs to the file as a single batch and syncs it to disk.
+func (f *File) Spill(id string, reason error, msgs ...*racer.Message) error {
+	b := &Batch{ID: id, Spilled: time.Now().UTC(), Messages: msgs}
+
+	if reason != nil {
+		b.Reason = reason.Error()
+	}
+
+	if err := f.seal(b); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(b)
+
+	if err != nil {
+		return errors.Wrap(err, "could not marshall batch")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the file is opened for every spill so an import can move it aside at any time
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return errors.Wrap(err, "could not open dead letter file")
+	}
+
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "could not write batch")
+	}
+
+	return errors.Wrap(file.Sync(), "could not sync dead letter file")
+}
+
+// Import puts every batch in the file into repo and returns the number of batches imported.
+// Batches that fail to import again are spilled back into the file.
+// It is safe to import while the file is being spilled to, even from another process.
+// The progress of an import is saved after every batch, an import that was interrupted picks up after the last batch it finished.
+func (f *File) Import(repo racer.MessageRepo) (int, error) {
+	importing := f.path + importingExt
+	progress := importing + progressExt
+
+	// an import that was interrupted left its file behind, finish it before starting on anything new
+	if _, err := os.Stat(importing); os.IsNotExist(err) {
+		// the progress of an import that finished but was interrupted while cleaning up does not apply to a new one
+		if err := os.Remove(progress); err != nil && !os.IsNotExist(err) {
+			return 0, errors.Wrap(err, "could not remove import progress")
+		}
+
+		if err := os.Rename(f.path, importing); os.IsNotExist(err) {
+			return 0, nil
+		} else if err != nil {
+			return 0, errors.Wrap(err, "could not move dead letter file aside")
+		}
+	}
+
+	file, err := os.Open(importing)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "could not open dead letter file")
+	}
+
+	defer file.Close()
+
+	offset, err := readProgress(progress)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, errors.Wrap(err, "could not seek to the first batch yet to be imported")
+	}
+
+	imported := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		b := &Batch{}
+
+		if err := json.Unmarshal(scanner.Bytes(), b); err != nil {
+			return imported, errors.Wrap(err, "could not unmarshall batch")
+		}
+
+		if err := f.open(b); err != nil {
+			return imported, err
+		}
+
+		if err := repo.Put(b.ID, b.Messages...); err != nil {
+			if err := f.Spill(b.ID, err, b.Messages...); err != nil {
+				return imported, err
+			}
+		} else {
+			imported++
+		}
+
+		// every line ends with a newline, which the scanner drops
+		offset += int64(len(scanner.Bytes())) + 1
+
+		if err := writeProgress(progress, offset); err != nil {
+			return imported, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return imported, errors.Wrap(err, "could not read dead letter file")
+	}
+
+	if err := os.Remove(importing); err != nil {
+		return imported, errors.Wrap(err, "could not remove imported dead letter file")
+	}
+
+	return imported, errors.Wrap(os.Remove(progress), "could not remove import progress")
+}
+
+// seal replaces the messages of b with their sealed form, if the file has a keyring.
+func (f *File) seal(b *Batch) error {
+	if f.keyring == nil {
+		return nil
+	}
+
+	msgs, err := json.Marshal(b.Messages)
+
+	if err != nil {
+		return errors.Wrap(err, "could not marshall messages")
+	}
+
+	key, wrapped, err := f.keyring.NewDataKey([]byte(b.ID))
+
+	if err != nil {
+		return err
+	}
+
+	if b.Sealed, err = keyring.Seal(key, msgs, []byte(b.ID)); err != nil {
+		return errors.Wrap(err, "could not seal messages")
+	}
+
+	b.DataKey, b.Messages = wrapped, nil
+
+	return nil
+}
+
+// open restores the messages of b if it was sealed.
+func (f *File) open(b *Batch) error {
+	if b.Sealed == nil {
+		return nil
+	}
+
+	if f.keyring == nil {
+		return errors.Errorf("batch for %s is sealed but the file has no keyring", b.ID)
+	}
+
+	key, err := f.keyring.Unwrap(b.DataKey, []byte(b.ID))
+
+	if err != nil {
+		return errors.Wrapf(err, "could not unwrap data key of batch for %s", b.ID)
+	}
+
+	msgs, err := keyring.Open(key, b.Sealed, []byte(b.ID))
+
+	if err != nil {
+		return errors.Wrapf(err, "could not open batch for %s", b.ID)
+	}
+
+	b.DataKey, b.Sealed = nil, nil
+
+	return errors.Wrap(json.Unmarshal(msgs, &b.Messages), "could not unmarshall messages")
+}
+
+// readProgress returns the offset saved in the progress file at path, 0 if an import has made no progress yet.
+func readProgress(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read import progress")
+	}
+
+	offset, err := strconv.ParseInt(string(data), 10, 64)
+
+	return offset, errors.Wrap(err, "could not parse import progress")
+}
+
+// writeProgress durably replaces the progress file at path with offset.
+// The offset is written to a file of its own which is then renamed over the old one, so a crash never leaves it half written.
+func writeProgress(path string, offset int64) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return errors.Wrap(err, "could not create import progress")
+	}
+
+	_, err = file.WriteString(strconv.FormatInt(offset, 10))
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "could not write import progress")
+	}
+
+	return errors.Wrap(os.Rename(tmp, path), "could not save import progress")
+}
@@ -0,0 +1,209 @@
+package deadletter_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/deadletter"
+	"github.com/tinylttl/racer/keyring"
+)
+
+// testrepo records every message put into it, puts to a room in fail return err and a put to the crash room panics
+type testrepo struct {
+	msgs  map[string][]*racer.Message
+	fail  map[string]bool
+	crash string
+}
+
+func newTestRepo(fail ...string) *testrepo {
+	tr := &testrepo{msgs: make(map[string][]*racer.Message), fail: make(map[string]bool)}
+
+	for _, id := range fail {
+		tr.fail[id] = true
+	}
+
+	return tr
+}
+
+func (tr *testrepo) Fetch(ID string, msgID string) (*racer.Message, error) { return nil, nil }
+func (tr *testrepo) FetchX(ID string, x int) ([]*racer.Message, error)     { return nil, nil }
+func (tr *testrepo) FetchSince(ID string, seq uint64, x int) ([]*racer.Message, error) {
+	return nil, nil
+}
+
+func (tr *testrepo) Put(ID string, msgs ...*racer.Message) error {
+	if tr.fail[ID] {
+		return errors.New("repo failed")
+	}
+
+	if ID == tr.crash {
+		panic("crashed importing " + ID)
+	}
+
+	tr.msgs[ID] = append(tr.msgs[ID], msgs...)
+	return nil
+}
+
+// newFile returns a dead letter file in a fresh temporary directory along with a func that removes it
+func newFile(t *testing.T) (*deadletter.File, string, func()) {
+	dir, err := ioutil.TempDir("", "deadletter")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "deadletter.jsonl")
+
+	return deadletter.NewFile(path), path, func() { os.RemoveAll(dir) }
+}
+
+func TestFile_Import(t *testing.T) {
+	t.Run("It imports every spilled batch", func(t *testing.T) {
+		f, path, cleanup := newFile(t)
+		defer cleanup()
+
+		f.Spill("a", errors.New("down"), &racer.Message{ID: "1"}, &racer.Message{ID: "2"})
+		f.Spill("b", errors.New("down"), &racer.Message{ID: "3"})
+
+		repo := newTestRepo()
+		n, err := f.Import(repo)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 2 {
+			t.Fatalf("got: %d batches, want: %d", n, 2)
+		}
+
+		if len(repo.msgs["a"]) != 2 || len(repo.msgs["b"]) != 1 {
+			t.Fatalf("got: %d and %d messages, want: 2 and 1", len(repo.msgs["a"]), len(repo.msgs["b"]))
+		}
+
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("the dead letter file was not removed")
+		}
+	})
+
+	t.Run("It keeps batches that fail to import", func(t *testing.T) {
+		f, _, cleanup := newFile(t)
+		defer cleanup()
+
+		f.Spill("a", errors.New("down"), &racer.Message{ID: "1"})
+		f.Spill("b", errors.New("down"), &racer.Message{ID: "2"})
+
+		if n, err := f.Import(newTestRepo("b")); err != nil || n != 1 {
+			t.Fatalf("got: %d, %v, want: %d, nil", n, err, 1)
+		}
+
+		repo := newTestRepo()
+		if n, err := f.Import(repo); err != nil || n != 1 {
+			t.Fatalf("got: %d, %v, want: %d, nil", n, err, 1)
+		}
+
+		if got := repo.msgs["b"]; len(got) != 1 || got[0].ID != "2" {
+			t.Fatalf("got: %+v, want message 2", got)
+		}
+	})
+
+	t.Run("It resumes an interrupted import after the last batch it finished", func(t *testing.T) {
+		f, path, cleanup := newFile(t)
+		defer cleanup()
+
+		f.Spill("a", errors.New("down"), &racer.Message{ID: "1"})
+		f.Spill("b", errors.New("down"), &racer.Message{ID: "2"})
+		f.Spill("c", errors.New("down"), &racer.Message{ID: "3"})
+
+		crashing := newTestRepo()
+		crashing.crash = "b"
+
+		func() {
+			defer func() { recover() }()
+			f.Import(crashing)
+		}()
+
+		repo := newTestRepo()
+		if n, err := f.Import(repo); err != nil || n != 2 {
+			t.Fatalf("got: %d, %v, want: %d, nil", n, err, 2)
+		}
+
+		if len(repo.msgs["a"]) != 0 || len(repo.msgs["b"]) != 1 || len(repo.msgs["c"]) != 1 {
+			t.Fatalf("got: %d, %d and %d messages, want: 0, 1 and 1", len(repo.msgs["a"]), len(repo.msgs["b"]), len(repo.msgs["c"]))
+		}
+
+		f.Spill("d", errors.New("down"), &racer.Message{ID: "4"})
+
+		if n, err := f.Import(repo); err != nil || n != 1 || len(repo.msgs["d"]) != 1 {
+			t.Fatalf("got: %d, %v, want the next import to start from the first batch of the new file", n, err)
+		}
+
+		if matches, _ := filepath.Glob(path + "*"); len(matches) != 0 {
+			t.Fatalf("got: %v, want every file of the import removed", matches)
+		}
+	})
+
+	t.Run("It imports nothing when nothing has been spilled", func(t *testing.T) {
+		f, _, cleanup := newFile(t)
+		defer cleanup()
+
+		if n, err := f.Import(newTestRepo()); err != nil || n != 0 {
+			t.Fatalf("got: %d, %v, want: %d, nil", n, err, 0)
+		}
+	})
+}
+
+func TestFile_Encryption(t *testing.T) {
+	master := sha256.Sum256([]byte("master"))
+	k, err := keyring.New(master[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("It never spills bodies in plaintext", func(t *testing.T) {
+		_, path, cleanup := newFile(t)
+		defer cleanup()
+
+		f := deadletter.NewFile(path, deadletter.WithKeyring(k))
+		f.Spill("23", errors.New("down"), &racer.Message{ID: "1", Body: "attack at dawn"})
+
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(raw, []byte("attack at")) {
+			t.Fatalf("got: a body in plaintext on disk, want every batch sealed")
+		}
+
+		repo := newTestRepo()
+		if n, err := f.Import(repo); err != nil || n != 1 {
+			t.Fatalf("got: %d %v, want: 1 batch imported", n, err)
+		}
+
+		if got := repo.msgs["23"]; len(got) != 1 || got[0].Body != "attack at dawn" {
+			t.Fatalf("got: %+v, want the sealed message", got)
+		}
+	})
+
+	t.Run("It refuses to import sealed batches without the master key", func(t *testing.T) {
+		_, path, cleanup := newFile(t)
+		defer cleanup()
+
+		deadletter.NewFile(path, deadletter.WithKeyring(k)).Spill("23", errors.New("down"), &racer.Message{ID: "1"})
+
+		repo := newTestRepo()
+		if _, err := deadletter.NewFile(path).Import(repo); err == nil {
+			t.Fatalf("got: nil error, want the sealed batch to be left for a file with the master key")
+		}
+
+		if n, err := deadletter.NewFile(path, deadletter.WithKeyring(k)).Import(repo); err != nil || n != 1 {
+			t.Fatalf("got: %d %v, want the batch imported once the master key is passed", n, err)
+		}
+	})
+}
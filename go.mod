@@ -1,10 +1,19 @@
 module github.com/tinylttl/racer
 
+go 1.20
+
 require (
 	github.com/boltdb/bolt v1.3.1
+	github.com/fxamacker/cbor/v2 v2.9.4
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/gorilla/websocket v1.4.0
 	github.com/pkg/errors v0.8.1
 	github.com/speps/go-hashids v2.0.0+incompatible
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
 )
@@ -0,0 +1,76 @@
+package gorilla
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols for the racer.v1 protocol encoded with a binary codec.
+// Binary codecs produce much smaller frames than json which matters to mobile clients.
+const (
+	SubprotocolV1MsgPack = SubprotocolV1 + ".msgpack"
+	SubprotocolV1CBOR    = SubprotocolV1 + ".cbor"
+)
+
+// Codec encodes and decodes the frames sent over a connection.
+// Struct fields are named by their json tags regardless of the codec,
+// so a message looks the same to every client no matter how it is encoded.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+
+	// MessageType is the websocket message type frames are sent as,
+	// websocket.TextMessage or websocket.BinaryMessage.
+	MessageType() int
+}
+
+// Codecs that are available by default
+var (
+	JSON    Codec = jsonCodec{}
+	MsgPack Codec = msgpackCodec{}
+	CBOR    Codec = cborCodec{}
+)
+
+// jsonCodec encodes frames as json text
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) MessageType() int                           { return websocket.TextMessage }
+
+// msgpackCodec encodes frames as MessagePack
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
+
+func (msgpackCodec) MessageType() int { return websocket.BinaryMessage }
+
+// cborCodec encodes frames as CBOR, cbor falls back to json tags on its own
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+func (cborCodec) MessageType() int                           { return websocket.BinaryMessage }
@@ -0,0 +1,107 @@
+package gorilla_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/gorilla"
+)
+
+func TestCodecs(t *testing.T) {
+	cases := []struct {
+		name  string
+		codec gorilla.Codec
+	}{
+		{name: "json", codec: gorilla.JSON},
+		{name: "msgpack", codec: gorilla.MsgPack},
+		{name: "cbor", codec: gorilla.CBOR},
+	}
+
+	for _, tc := range cases {
+		t.Run("It round trips a message using "+tc.name, func(t *testing.T) {
+			want := &racer.Message{
+				ID:        "a",
+				Version:   racer.SchemaVersion,
+				Type:      racer.TypeFile,
+				ParentID:  "b",
+				Timestamp: 1551042839000000000,
+				Body:      "Test",
+				SenderID:  7,
+				Meta:      map[string]string{racer.MetaFileName: "test.png", racer.MetaFileSize: "1024"},
+			}
+
+			data, err := tc.codec.Marshal(&gorilla.Envelope{Type: gorilla.FrameChat, ID: "ref", Data: want})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got struct {
+				Type string         `json:"type"`
+				ID   string         `json:"id"`
+				Data *racer.Message `json:"data"`
+			}
+
+			if err := tc.codec.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Type != gorilla.FrameChat || got.ID != "ref" || !reflect.DeepEqual(got.Data, want) {
+				t.Fatalf("got: %+v %+v, want: %+v", got, got.Data, want)
+			}
+		})
+	}
+
+	t.Run("Binary codecs produce smaller frames than json", func(t *testing.T) {
+		env := &gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{ID: "a", Timestamp: 1551042839000000000, Body: "Test"}}
+
+		js, _ := gorilla.JSON.Marshal(env)
+		for _, codec := range []gorilla.Codec{gorilla.MsgPack, gorilla.CBOR} {
+			data, _ := codec.Marshal(env)
+
+			if len(data) >= len(js) {
+				t.Fatalf("got: %d bytes, want less than json's %d", len(data), len(js))
+			}
+		}
+	})
+}
+
+func TestNewConnection_Subprotocols(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []func(*gorilla.Options)
+		request []string
+		want    string
+	}{
+		{name: "It prefers binary codecs", request: []string{gorilla.SubprotocolV1, gorilla.SubprotocolV1MsgPack}, want: gorilla.SubprotocolV1MsgPack},
+		{name: "It ignores unknown subprotocols", request: []string{"racer.v9", gorilla.SubprotocolV1}, want: gorilla.SubprotocolV1},
+		{name: "It falls back to the legacy protocol", request: []string{"racer.v9"}, want: ""},
+		{
+			name:    "It speaks codecs added with WithCodec",
+			opts:    []func(*gorilla.Options){gorilla.WithCodec("racer.v1.custom", gorilla.JSON)},
+			request: []string{gorilla.SubprotocolV1CBOR, "racer.v1.custom"},
+			want:    "racer.v1.custom",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := newServer(tc.opts...)
+			defer srv.Close()
+
+			d := &websocket.Dialer{Subprotocols: tc.request}
+			conn, resp, err := d.Dial(wsURL(srv), nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if got := resp.Header.Get("Sec-Websocket-Protocol"); got != tc.want {
+				t.Fatalf("got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
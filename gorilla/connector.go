@@ -1,8 +1,13 @@
 package gorilla
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -11,26 +16,20 @@ import (
 )
 
 const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
-
 	// time format for a racer.Message
 	timeFmt = "01/02/06 3:04 pm"
+
+	// maxCloseReason is the most bytes the reason of a close frame can take up
+	maxCloseReason = 123
 )
 
 // Check that the Connector implementation can be assigned to a racer.Connector interface
 // this ensures they are compatable
 // var _ racer.Connector = (*Connector)(nil) // written this way I think yields no extra allocations but i'm not really sure exactly whats happening so I switched to the way I understand
 var _ racer.Connector = &Connector{}
+var _ racer.HistoryWriter = &Connector{}
+var _ racer.Closer = &Connector{}
+var _ racer.Terminator = &Connector{}
 
 // Connector represents a single socket connection that can be held by a client
 // It provides read and write channels that can be used to read data from the socket
@@ -38,17 +37,28 @@ var _ racer.Connector = &Connector{}
 type Connector struct {
 	conn         *websocket.Conn
 	rchan, wchan chan *racer.Message // read and write channels for communicating messages recieved through socket
+	frames       chan interface{}    // frames generated by the connector itself, such as acks, that are written ahead of any messages
+	proto        protocol
+	opts         *Options
+
+	done   chan struct{} // closed by Close to stop the write goroutine
+	mu     sync.Mutex
+	closed bool  // set once Close is called, errors caused by closing the conn are expected
+	err    error // the first error that ended the connection
 }
 
 // NewConnection returns a connector with a newly upgraded socket connection
-// Connector implements racer.Connector interface
-func NewConnection(w http.ResponseWriter, r *http.Request) (*Connector, error) {
+// Connector implements racer.Connector interface.
+// The connection uses the default Options unless any functional options are passed in.
+func NewConnection(w http.ResponseWriter, r *http.Request, opts ...func(*Options)) (*Connector, error) {
+	o := NewOptions(opts...)
+
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		ReadBufferSize:    o.ReadBufferSize,
+		WriteBufferSize:   o.WriteBufferSize,
+		CheckOrigin:       o.checkOrigin,
+		EnableCompression: o.EnableCompression,
+		Subprotocols:      o.Subprotocols,
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -57,10 +67,19 @@ func NewConnection(w http.ResponseWriter, r *http.Request) (*Connector, error) {
 		return nil, errors.Wrapf(err, "could not upgrade connection")
 	}
 
+	if err := conn.SetCompressionLevel(o.CompressionLevel); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "could not set compression level")
+	}
+
 	return &Connector{
-		conn:  conn,
-		rchan: make(chan *racer.Message, 10),
-		wchan: make(chan *racer.Message, 10),
+		conn:   conn,
+		rchan:  make(chan *racer.Message, o.ReadChanSize),
+		wchan:  make(chan *racer.Message, o.WriteChanSize),
+		frames: make(chan interface{}, o.WriteChanSize),
+		proto:  negotiate(conn.Subprotocol(), o.Codecs),
+		opts:   o,
+		done:   make(chan struct{}),
 	}, nil
 }
 
@@ -70,44 +89,261 @@ func (c *Connector) Read() <-chan *racer.Message {
 		// Defer the closing of the con and deregistration to when this function terminates
 		// it will only terminate if the client disconnects or there is an error
 		defer func() {
-			c.conn.Close()
+			c.Close()
 			close(c.rchan)
 		}()
 
-		// The maximum bytes our read routines can read in from the con is 512 bytes so 512 1 byte asci characters
 		// Every time a pong occurs on the con, our read routine will add more time before it times out
-		c.conn.SetReadLimit(maxMessageSize)
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-
-		// remember that this *message has a val of nil, so to use unmarshall
-		// we need to pass its refrence, so that the mem address *message points to can be filled with a value
-		// if we just pass chatmsg it would be passing nil to the unmarshall func.
-		// we could also declare message as a concrete type (without *) and pass its &refrence, doing so intializes the 0 val for chatmsg
-		// and we pass it the address of that.
-		chatmsg := racer.Message{Sent: time.Now().Format(timeFmt), Timestamp: time.Now().UTC().UnixNano()}
+		c.conn.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+		c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(c.opts.PongWait)); return nil })
+
 		for {
-			err := c.conn.ReadJSON(&chatmsg)
-			// v := json.Unmarshal()
-			// fmt.Printf("Chat message %#v\n", chatmsg)
+			frame, err := c.readFrame()
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("error: %v", err)
+				c.readFailed(err)
+				return
+			}
+
+			chatmsg, ref, err := c.proto.decode(frame)
+			if err == nil {
+				err = c.check(chatmsg)
+			}
+
+			if ferr, ok := err.(*frameError); ok {
+				if !c.reply(c.proto.fail(ref, ferr)) {
+					return
 				}
+				continue
+			}
+
+			c.ingest(chatmsg)
+
+			// acknowledge the message before passing it on so the ack reaches the peer ahead of any echo
+			if !c.reply(c.proto.ack(ref, chatmsg)) {
+				return
+			}
+
+			// nobody drains rchan once the connection is closed
+			select {
+			case c.rchan <- chatmsg:
+			case <-c.done:
 				return
 			}
-			c.rchan <- &chatmsg
-			// fmt.Printf("Chat message %#v\n", brokermsg)
 		}
 	}()
 
 	return c.rchan
 }
 
+// readFrame reads the next frame sent by the peer. The maximum bytes a frame can take up is MaxMessageSize,
+// reading a larger frame returns websocket.ErrReadLimit without reading the rest of it.
+func (c *Connector) readFrame() ([]byte, error) {
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := ioutil.ReadAll(io.LimitReader(r, c.opts.MaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(frame)) > c.opts.MaxMessageSize {
+		return nil, websocket.ErrReadLimit
+	}
+
+	return frame, nil
+}
+
+// readFailed records why reading from the peer failed and closes the connection with a close code telling the peer why.
+// A peer that closed the connection itself did not fail, and a peer that broke the websocket protocol has already been sent a close frame.
+func (c *Connector) readFailed(err error) {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure) {
+		return
+	}
+
+	c.fail(errors.Wrap(err, "could not read from conn"))
+
+	if err == websocket.ErrReadLimit {
+		c.CloseWith(CloseFrameTooBig, fmt.Sprintf("frames can be at most %d bytes", c.opts.MaxMessageSize))
+		return
+	}
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		c.CloseWith(CloseGoingAway, "no pong recieved in time")
+	}
+}
+
+// check validates a newly decoded message and sanitizes it if it is valid.
+// An invalid message is returned as a frameError for the peer to be told about.
+func (c *Connector) check(chatmsg *racer.Message) error {
+	if err := chatmsg.Validate(c.opts.MaxBodySize); err != nil {
+		return &frameError{ErrorData{Code: ErrInvalidMessage, Message: err.Error(), MessageID: chatmsg.ID}}
+	}
+
+	chatmsg.Sanitize(c.opts.Sanitizer)
+
+	return nil
+}
+
+// ingest stamps a newly decoded message, see Stamp.
+func (c *Connector) ingest(chatmsg *racer.Message) { Stamp(chatmsg) }
+
+// Stamp stamps a message the server recieved from a client, over a connection or otherwise.
+// The server is the only authority on when a message was recieved and what it is called,
+// so any timestamp or id supplied by the client is overwritten. The id is derived from the timestamp, see racer.StampID.
+// Messages are always stamped with the current schema version, and fields only a MessageRepo fills in are cleared.
+func Stamp(chatmsg *racer.Message) {
+	now := time.Now()
+
+	chatmsg.Version = racer.SchemaVersion
+	chatmsg.Sent = now.Format(timeFmt)
+	chatmsg.Timestamp = stamp(now)
+	chatmsg.ID = racer.StampID(chatmsg.Timestamp)
+	chatmsg.Edited, chatmsg.Deleted, chatmsg.Reactions = 0, false, nil
+	chatmsg.ReplyCount, chatmsg.LastReply = 0, 0
+}
+
+// reply queues a reply to a frame read from the peer, such as an ack, to be written to the peer.
+// A peer that sends frames faster than it reads the replies to them is closed with ClosePolicy rather than lose a reply,
+// reply reports whether the connection is still open.
+func (c *Connector) reply(frame interface{}) bool {
+	if frame == nil {
+		return true
+	}
+
+	select {
+	case c.frames <- frame:
+		return true
+	default:
+	}
+
+	c.fail(errors.New("peer is not reading the replies to its frames"))
+	c.CloseWith(ClosePolicy, "too many replies waiting to be read")
+
+	return false
+}
+
+// WriteHistory sends msgs from the room identified by chatID, oldest first, to the peer in a single history frame.
+// The frame is written ahead of any messages waiting to be written, WriteHistory blocks until it can be queued or the connection is closed.
+// Peers using the legacy protocol have no history frame and recieve nothing.
+func (c *Connector) WriteHistory(chatID string, msgs []*racer.Message) {
+	frame := c.proto.history(chatID, msgs)
+
+	if frame == nil {
+		return
+	}
+
+	select {
+	case c.frames <- frame:
+	case <-c.done:
+	}
+}
+
+// Close tells the peer the server is going away and closes the underlying connection without waiting for the peer.
+// Anything still waiting to be written is discarded.
+func (c *Connector) Close() error {
+	return c.CloseWith(CloseGoingAway, "")
+}
+
+// CloseWith sends the peer a close frame with code and reason, then closes the underlying connection without waiting for the peer.
+// A reason too long for a close frame is cut short. Only the first call to CloseWith or Close has any effect.
+func (c *Connector) CloseWith(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	close(c.done)
+
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+
+	// the peer may already be gone, in which case there is nobody to tell
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(c.opts.WriteWait))
+
+	return c.conn.Close()
+}
+
+// Terminate closes the connection with a close code telling the peer why the client failed with err, see racer.Terminator.
+// A client that fell behind is told to reconnect, any other failure is the servers.
+func (c *Connector) Terminate(err error) error {
+	if errors.Cause(err) == racer.ErrFellBehind {
+		return c.CloseWith(CloseTryAgain, "fell too far behind, reconnect to resume")
+	}
+
+	return c.CloseWith(CloseInternal, "internal error")
+}
+
+// Err returns the error that ended the connection, or nil if it was closed cleanly.
+// Errors caused by calling Close are never reported.
+func (c *Connector) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// fail records the first error that ends the connection.
+func (c *Connector) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil && !c.closed {
+		c.err = err
+	}
+}
+
+// Subprotocol returns the subprotocol negotiated with the peer,
+// an empty string means the peer is using the legacy protocol.
+func (c *Connector) Subprotocol() string { return c.conn.Subprotocol() }
+
+// encode writes v to the connection using the negotiated codec.
+// If compression was negotiated only messages at or above the compression threshold are compressed.
+func (c *Connector) encode(v interface{}) error {
+	codec := c.proto.codec()
+	data, err := codec.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	c.conn.EnableWriteCompression(len(data) >= c.opts.CompressionThreshold)
+
+	return c.conn.WriteMessage(codec.MessageType(), data)
+}
+
+// lastStamp is the most recent timestamp handed out by stamp.
+var lastStamp int64
+
+// stamp converts t into a unix nano timestamp that is guaranteed to be greater than
+// any other timestamp stamp has returned. Messages are keyed by their timestamp in the store,
+// so two messages recieved in the same nanosecond must never share one.
+func stamp(t time.Time) int64 {
+	ts := t.UTC().UnixNano()
+
+	for {
+		last := atomic.LoadInt64(&lastStamp)
+
+		next := ts
+		if next <= last {
+			next = last + 1
+		}
+
+		if atomic.CompareAndSwapInt64(&lastStamp, last, next) {
+			return next
+		}
+	}
+}
+
 // Write the client should use data from their send channel to update their con
 func (c *Connector) Write() chan<- *racer.Message {
 	go func() {
-		ticker := time.NewTicker(pingPeriod)
+		ticker := time.NewTicker(c.opts.pingPeriod())
 
 		defer func() {
 			ticker.Stop()
@@ -118,21 +354,36 @@ func (c *Connector) Write() chan<- *racer.Message {
 		// triggering their pong handlers which intern rerefreshes their read deadlines
 		// var chatmsg *message
 		for {
+			// frames generated by the connector, like acks and history, are written ahead of any waiting messages
 			select {
-			case msg, ok := <-c.wchan:
-				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			case frame := <-c.frames:
+				if err := c.writeFrame(frame); err != nil {
+					return
+				}
+				continue
+			default:
+			}
 
+			select {
+			case frame := <-c.frames:
+				if err := c.writeFrame(frame); err != nil {
+					return
+				}
+
+			case msg, ok := <-c.wchan:
 				// If the clients send channel has been closed by the broker then there was an error
 				// and this peer will send a close message to the con, meaining that it (the clients) connection will be closed
 				if !ok {
-					c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+					c.CloseWith(CloseNormal, "")
 					return
 				}
 
-				err := c.conn.WriteJSON(msg)
-				if err != nil {
-					c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-					log.Println("Error writing json to conn. ", err)
+				frame := c.proto.encode(msg)
+				if frame == nil {
+					continue
+				}
+
+				if err := c.writeFrame(frame); err != nil {
 					return
 				}
 
@@ -143,13 +394,31 @@ func (c *Connector) Write() chan<- *racer.Message {
 
 				// }
 			case <-ticker.C:
-				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.conn.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
 				if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					c.fail(errors.Wrap(err, "could not ping conn"))
 					return
 				}
+
+			case <-c.done:
+				return
 			}
 		}
 	}()
 
 	return c.wchan
 }
+
+// writeFrame writes a single frame to the con, if it cannot be written
+// the connection is closed as an internal error and the error is returned.
+func (c *Connector) writeFrame(frame interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+
+	err := c.encode(frame)
+	if err != nil {
+		c.fail(errors.Wrap(err, "could not write frame to conn"))
+		c.CloseWith(CloseInternal, "could not write frame")
+	}
+
+	return err
+}
@@ -0,0 +1,626 @@
+package gorilla_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/gorilla"
+)
+
+// newServer starts a test server that upgrades every request and relays
+// everything read from the resulting connector onto the returned channel.
+func newServer(opts ...func(*gorilla.Options)) (*httptest.Server, <-chan *racer.Message) {
+	msgs := make(chan *racer.Message, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := gorilla.NewConnection(w, r, opts...)
+
+		if err != nil {
+			return
+		}
+
+		for msg := range conn.Read() {
+			msgs <- msg
+		}
+	}))
+
+	return srv, msgs
+}
+
+// newEchoServer starts a test server that sends history to every new connection,
+// followed by a presence message and then echoes back every message it reads.
+func newEchoServer(history []*racer.Message, opts ...func(*gorilla.Options)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := gorilla.NewConnection(w, r, opts...)
+
+		if err != nil {
+			return
+		}
+
+		conn.WriteHistory("23", history)
+
+		write := conn.Write()
+		write <- racer.NewPresence("23", racer.PresenceJoin)
+
+		for msg := range conn.Read() {
+			write <- msg
+		}
+	}))
+}
+
+// dialV1 opens a connection to srv using the racer.v1 subprotocol
+func dialV1(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	d := &websocket.Dialer{Subprotocols: []string{gorilla.SubprotocolV1}}
+	conn, resp, err := d.Dial(wsURL(srv), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := resp.Header.Get("Sec-Websocket-Protocol"); got != gorilla.SubprotocolV1 {
+		t.Fatalf("got subprotocol: %q, want: %q", got, gorilla.SubprotocolV1)
+	}
+
+	return conn
+}
+
+// envelope is an Envelope as decoded by a client
+type envelope struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id"`
+	Room string          `json:"room"`
+	Data json.RawMessage `json:"data"`
+}
+
+// readEnvelope reads the next envelope from conn and checks that it has the wanted type
+func readEnvelope(t *testing.T, conn *websocket.Conn, want string) envelope {
+	var env envelope
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatal(err)
+	}
+
+	if env.Type != want {
+		t.Fatalf("got frame type: %q, want: %q (data: %s)", env.Type, want, env.Data)
+	}
+
+	return env
+}
+
+func dial(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func wsURL(srv *httptest.Server) string { return "ws" + strings.TrimPrefix(srv.URL, "http") }
+
+func TestNewConnection_Origins(t *testing.T) {
+	cases := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{name: "It allows requests without an origin", origin: "", want: true},
+		{name: "It rejects cross origin requests by default", origin: "https://evil.com", want: false},
+		{name: "It allows an exact match", allowed: []string{"https://racer.chat"}, origin: "https://racer.chat", want: true},
+		{name: "It ignores the case of the origin", allowed: []string{"https://racer.chat"}, origin: "https://Racer.Chat", want: true},
+		{name: "It allows wildcard subdomains", allowed: []string{"https://*.racer.chat"}, origin: "https://eu.racer.chat", want: true},
+		{name: "It allows wildcard ports", allowed: []string{"http://localhost:*"}, origin: "http://localhost:3000", want: true},
+		{name: "It allows every origin with a lone wildcard", allowed: []string{"*"}, origin: "https://evil.com", want: true},
+		{name: "It rejects origins that do not match", allowed: []string{"https://*.racer.chat"}, origin: "https://racer.chat.evil.com", want: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := newServer(gorilla.WithAllowedOrigins(tc.allowed...))
+			defer srv.Close()
+
+			header := http.Header{}
+			if tc.origin != "" {
+				header.Set("Origin", tc.origin)
+			}
+
+			conn, resp, err := websocket.DefaultDialer.Dial(wsURL(srv), header)
+
+			if got := err == nil; got != tc.want {
+				t.Fatalf("got: %v, want: %v", got, tc.want)
+			}
+
+			if err == nil {
+				conn.Close()
+			} else if resp != nil && resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("got status: %d, want: %d", resp.StatusCode, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	t.Run("It ignores settings a connection cannot run with", func(t *testing.T) {
+		got := gorilla.NewOptions(
+			gorilla.WithBufferSizes(-1, 0),
+			gorilla.WithMaxMessageSize(0),
+			gorilla.WithPongWait(-time.Second),
+			gorilla.WithWriteWait(0),
+			gorilla.WithChanSizes(-1, -1),
+			gorilla.WithCompression(true, 10, 0),
+		)
+
+		want := gorilla.NewOptions()
+
+		if got.ReadBufferSize != want.ReadBufferSize || got.WriteBufferSize != want.WriteBufferSize {
+			t.Fatalf("got buffer sizes: %d %d, want: %d %d", got.ReadBufferSize, got.WriteBufferSize, want.ReadBufferSize, want.WriteBufferSize)
+		}
+
+		if got.MaxMessageSize != want.MaxMessageSize {
+			t.Fatalf("got max message size: %d, want: %d", got.MaxMessageSize, want.MaxMessageSize)
+		}
+
+		if got.PongWait != want.PongWait || got.WriteWait != want.WriteWait {
+			t.Fatalf("got waits: %v %v, want: %v %v", got.PongWait, got.WriteWait, want.PongWait, want.WriteWait)
+		}
+
+		if got.ReadChanSize != want.ReadChanSize || got.WriteChanSize != want.WriteChanSize {
+			t.Fatalf("got chan sizes: %d %d, want: %d %d", got.ReadChanSize, got.WriteChanSize, want.ReadChanSize, want.WriteChanSize)
+		}
+
+		if got.CompressionLevel != want.CompressionLevel {
+			t.Fatalf("got compression level: %d, want: %d", got.CompressionLevel, want.CompressionLevel)
+		}
+	})
+}
+
+func TestNewConnection_Compression(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []func(*gorilla.Options)
+		want bool
+	}{
+		{name: "It negotiates permessage-deflate by default", want: true},
+		{name: "It does not negotiate compression when disabled", opts: []func(*gorilla.Options){gorilla.WithCompression(false, 1, 0)}, want: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := newServer(tc.opts...)
+			defer srv.Close()
+
+			d := &websocket.Dialer{EnableCompression: true}
+			conn, resp, err := d.Dial(wsURL(srv), nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ext := resp.Header.Get("Sec-Websocket-Extensions")
+			if got := strings.Contains(ext, "permessage-deflate"); got != tc.want {
+				t.Fatalf("got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConnector_Read(t *testing.T) {
+	t.Run("It allocates a new message for every frame", func(t *testing.T) {
+		srv, msgs := newServer()
+		defer srv.Close()
+
+		conn := dial(t, srv)
+		defer conn.Close()
+
+		bodies := []string{"1", "2", "3"}
+		for _, body := range bodies {
+			conn.WriteJSON(&racer.Message{Body: body})
+		}
+
+		got := make([]*racer.Message, 0, len(bodies))
+		for range bodies {
+			select {
+			case msg := <-msgs:
+				got = append(got, msg)
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for message")
+			}
+		}
+
+		for i, msg := range got {
+			if msg.Body != bodies[i] {
+				t.Fatalf("got: %s, want: %s", msg.Body, bodies[i])
+			}
+
+			for _, other := range got[:i] {
+				if msg == other {
+					t.Fatalf("messages %q and %q share a pointer", other.Body, msg.Body)
+				}
+
+				if msg.ID == other.ID {
+					t.Fatalf("messages %q and %q share the id %s", other.Body, msg.Body, msg.ID)
+				}
+
+				if msg.Timestamp <= other.Timestamp {
+					t.Fatalf("got timestamp: %d, want greater than: %d", msg.Timestamp, other.Timestamp)
+				}
+			}
+		}
+	})
+
+	t.Run("It ignores timestamps and ids supplied by the client", func(t *testing.T) {
+		srv, msgs := newServer()
+		defer srv.Close()
+
+		conn := dial(t, srv)
+		defer conn.Close()
+
+		before := time.Now().UTC().UnixNano()
+		conn.WriteJSON(&racer.Message{ID: "mine", Timestamp: 1, Sent: "yesterday", Body: "Test"})
+
+		select {
+		case got := <-msgs:
+			if want := racer.StampID(got.Timestamp); got.ID != want {
+				t.Fatalf("got id: %q, want: %q", got.ID, want)
+			}
+
+			if got.Timestamp < before {
+				t.Fatalf("got timestamp: %d, want at least: %d", got.Timestamp, before)
+			}
+
+			if got.Sent == "yesterday" {
+				t.Fatalf("got sent: %q, want the server recieve time", got.Sent)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message")
+		}
+	})
+
+	t.Run("It reads a message with the largest body allowed by default", func(t *testing.T) {
+		srv, msgs := newServer()
+		defer srv.Close()
+
+		conn := dial(t, srv)
+		defer conn.Close()
+
+		body := strings.Repeat("a", racer.DefaultMaxBodySize)
+		conn.WriteJSON(&racer.Message{Type: racer.TypeText, ChatID: strings.Repeat("c", 128), ParentID: strings.Repeat("p", 128), Body: body})
+
+		select {
+		case got := <-msgs:
+			if got.Body != body {
+				t.Fatalf("got: %d bytes, want: %d", len(got.Body), len(body))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message")
+		}
+	})
+
+	t.Run("It closes the connection as too big when a message exceeds the maximum size", func(t *testing.T) {
+		srv, msgs := newServer(gorilla.WithMaxMessageSize(16))
+		defer srv.Close()
+
+		conn := dial(t, srv)
+		defer conn.Close()
+
+		conn.WriteJSON(&racer.Message{Body: "this body is far larger than sixteen bytes"})
+
+		select {
+		case msg, ok := <-msgs:
+			if ok {
+				t.Fatalf("got: %+v, want no message", msg)
+			}
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, gorilla.CloseFrameTooBig) {
+			t.Fatalf("got: %v, want the connection to be closed with %d", err, gorilla.CloseFrameTooBig)
+		}
+	})
+}
+
+func TestConnector_CloseWith(t *testing.T) {
+	cases := []struct {
+		name  string
+		close func(conn *gorilla.Connector)
+		code  int
+	}{
+		{name: "It tells the peer the server is going away when it is closed", close: func(conn *gorilla.Connector) { conn.Close() }, code: gorilla.CloseGoingAway},
+		{name: "It tells a client that fell behind to try again", close: func(conn *gorilla.Connector) { conn.Terminate(errors.Wrap(racer.ErrFellBehind, "dropped")) }, code: gorilla.CloseTryAgain},
+		{name: "It tells the peer about any other failure as an internal error", close: func(conn *gorilla.Connector) { conn.Terminate(errors.New("repo failed")) }, code: gorilla.CloseInternal},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if conn, err := gorilla.NewConnection(w, r); err == nil {
+					tc.close(conn)
+				}
+			}))
+			defer srv.Close()
+
+			conn := dial(t, srv)
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, tc.code) {
+				t.Fatalf("got: %v, want the connection to be closed with %d", err, tc.code)
+			}
+		})
+	}
+}
+
+func TestConnector_ProtocolV1(t *testing.T) {
+	history := []*racer.Message{{ID: "a", Body: "1"}, {ID: "b", Body: "2"}}
+
+	t.Run("It sends history and presence in typed envelopes", func(t *testing.T) {
+		srv := newEchoServer(history)
+		defer srv.Close()
+
+		conn := dialV1(t, srv)
+		defer conn.Close()
+
+		var got []*racer.Message
+		if err := json.Unmarshal(readEnvelope(t, conn, gorilla.FrameHistory).Data, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != len(history) || got[0].ID != "a" || got[1].ID != "b" {
+			t.Fatalf("got: %+v, want: %+v", got, history)
+		}
+
+		var presence racer.Message
+		json.Unmarshal(readEnvelope(t, conn, gorilla.FramePresence).Data, &presence)
+
+		if presence.Body != racer.PresenceJoin {
+			t.Fatalf("got: %q, want: %q", presence.Body, racer.PresenceJoin)
+		}
+	})
+
+	t.Run("It never drops history frames", func(t *testing.T) {
+		rooms := 3 * gorilla.DefaultChanSize
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := gorilla.NewConnection(w, r)
+			if err != nil {
+				return
+			}
+
+			conn.Write()
+
+			for i := 0; i < rooms; i++ {
+				conn.WriteHistory(strconv.Itoa(i), history)
+			}
+
+			for range conn.Read() {
+			}
+		}))
+		defer srv.Close()
+
+		conn := dialV1(t, srv)
+		defer conn.Close()
+
+		for i := 0; i < rooms; i++ {
+			if env := readEnvelope(t, conn, gorilla.FrameHistory); env.Room != strconv.Itoa(i) {
+				t.Fatalf("got history of: %q, want: %q", env.Room, strconv.Itoa(i))
+			}
+		}
+	})
+
+	t.Run("It acknowledges chat frames with the server assigned id", func(t *testing.T) {
+		srv := newEchoServer(nil)
+		defer srv.Close()
+
+		conn := dialV1(t, srv)
+		defer conn.Close()
+
+		readEnvelope(t, conn, gorilla.FrameHistory)
+		readEnvelope(t, conn, gorilla.FramePresence)
+
+		conn.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, ID: "ref-1", Data: &racer.Message{Body: "Test"}})
+
+		ack := readEnvelope(t, conn, gorilla.FrameAck)
+		if ack.ID != "ref-1" {
+			t.Fatalf("got ack for: %q, want: %q", ack.ID, "ref-1")
+		}
+
+		var data gorilla.AckData
+		json.Unmarshal(ack.Data, &data)
+
+		chat := readEnvelope(t, conn, gorilla.FrameChat)
+
+		var msg racer.Message
+		json.Unmarshal(chat.Data, &msg)
+
+		if msg.Body != "Test" || msg.ID != data.ID || chat.ID != data.ID || msg.Timestamp != data.Timestamp {
+			t.Fatalf("got message: %+v in frame %q, want it to match ack: %+v", msg, chat.ID, data)
+		}
+	})
+
+	t.Run("It relays file frames with their metadata", func(t *testing.T) {
+		srv := newEchoServer(nil)
+		defer srv.Close()
+
+		conn := dialV1(t, srv)
+		defer conn.Close()
+
+		readEnvelope(t, conn, gorilla.FrameHistory)
+		readEnvelope(t, conn, gorilla.FramePresence)
+
+		meta := map[string]string{racer.MetaFileName: "cat.png", racer.MetaFileURL: "https://example.com/cat.png"}
+		conn.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameFile, ID: "ref-1", Data: &racer.Message{ParentID: "a", Meta: meta}})
+
+		readEnvelope(t, conn, gorilla.FrameAck)
+
+		var msg racer.Message
+		json.Unmarshal(readEnvelope(t, conn, gorilla.FrameFile).Data, &msg)
+
+		if msg.Type != racer.TypeFile || msg.ParentID != "a" || msg.Meta[racer.MetaFileName] != "cat.png" || msg.Version != racer.SchemaVersion {
+			t.Fatalf("got: %+v, want a file message replying to a", msg)
+		}
+	})
+
+	t.Run("It relays typing frames without acknowledging them", func(t *testing.T) {
+		srv := newEchoServer(nil)
+		defer srv.Close()
+
+		conn := dialV1(t, srv)
+		defer conn.Close()
+
+		readEnvelope(t, conn, gorilla.FrameHistory)
+		readEnvelope(t, conn, gorilla.FramePresence)
+
+		conn.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameTyping, ID: "ref-1"})
+		readEnvelope(t, conn, gorilla.FrameTyping)
+	})
+
+	t.Run("It replies to unsupported frames with an error and keeps the connection open", func(t *testing.T) {
+		srv := newEchoServer(nil)
+		defer srv.Close()
+
+		conn := dialV1(t, srv)
+		defer conn.Close()
+
+		readEnvelope(t, conn, gorilla.FrameHistory)
+		readEnvelope(t, conn, gorilla.FramePresence)
+
+		conn.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameSystem, ID: "ref-1", Data: &racer.Message{Body: "I am the server"}})
+
+		env := readEnvelope(t, conn, gorilla.FrameError)
+
+		var data gorilla.ErrorData
+		json.Unmarshal(env.Data, &data)
+
+		if env.ID != "ref-1" || data.Code != gorilla.ErrUnsupportedFrame {
+			t.Fatalf("got: %s %+v, want: %s %s", env.ID, data, "ref-1", gorilla.ErrUnsupportedFrame)
+		}
+
+		conn.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "Test"}})
+		readEnvelope(t, conn, gorilla.FrameAck)
+		readEnvelope(t, conn, gorilla.FrameChat)
+	})
+
+	t.Run("It sends rejected messages as error frames naming the message", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := gorilla.NewConnection(w, r)
+			if err != nil {
+				return
+			}
+
+			conn.Write() <- &racer.Message{Type: racer.TypeError, ChatID: "23", ParentID: "m-1", Body: "nope", Meta: map[string]string{racer.MetaErrorCode: racer.CodeForbidden}}
+
+			for range conn.Read() {
+			}
+		}))
+		defer srv.Close()
+
+		conn := dialV1(t, srv)
+		defer conn.Close()
+
+		var data gorilla.ErrorData
+		json.Unmarshal(readEnvelope(t, conn, gorilla.FrameError).Data, &data)
+
+		if want := (gorilla.ErrorData{Code: gorilla.ErrForbidden, Message: "nope", MessageID: "m-1"}); data != want {
+			t.Fatalf("got: %+v, want: %+v", data, want)
+		}
+	})
+}
+
+func TestConnector_Validation(t *testing.T) {
+	cases := []struct {
+		name      string
+		frame     string
+		code      string
+		ref       string // the frame id echoed back, a frame that cannot be decoded has none
+		messageID string // the id the client sent the rejected message with
+	}{
+		{name: "It rejects frames that cannot be decoded", frame: `{"type":"chat","id":"ref-1","data":`, code: gorilla.ErrMalformedFrame},
+		{name: "It rejects bodies that are too long", frame: `{"type":"chat","id":"ref-1","data":{"id":"m-1","body":"` + strings.Repeat("a", 65) + `"}}`, code: gorilla.ErrInvalidMessage, ref: "ref-1", messageID: "m-1"},
+		{name: "It rejects control characters", frame: `{"type":"chat","id":"ref-1","data":{"body":"a\u0007b"}}`, code: gorilla.ErrInvalidMessage, ref: "ref-1"},
+		{name: "It rejects empty chat messages", frame: `{"type":"chat","id":"ref-1","data":{"id":"m-1","body":"  "}}`, code: gorilla.ErrInvalidMessage, ref: "ref-1", messageID: "m-1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name+" and keeps the connection open", func(t *testing.T) {
+			srv := newEchoServer(nil, gorilla.WithMaxBodySize(64))
+			defer srv.Close()
+
+			conn := dialV1(t, srv)
+			defer conn.Close()
+
+			readEnvelope(t, conn, gorilla.FrameHistory)
+			readEnvelope(t, conn, gorilla.FramePresence)
+
+			conn.WriteMessage(websocket.TextMessage, []byte(tc.frame))
+
+			env := readEnvelope(t, conn, gorilla.FrameError)
+
+			var data gorilla.ErrorData
+			json.Unmarshal(env.Data, &data)
+
+			if env.ID != tc.ref || data.Code != tc.code || data.MessageID != tc.messageID {
+				t.Fatalf("got: %q %+v, want: %q %s %q", env.ID, data, tc.ref, tc.code, tc.messageID)
+			}
+
+			conn.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "Test"}})
+			readEnvelope(t, conn, gorilla.FrameAck)
+			readEnvelope(t, conn, gorilla.FrameChat)
+		})
+	}
+
+	t.Run("It sanitizes messages and clears fields only the server sets", func(t *testing.T) {
+		srv := newEchoServer(nil)
+		defer srv.Close()
+
+		conn := dialV1(t, srv)
+		defer conn.Close()
+
+		readEnvelope(t, conn, gorilla.FrameHistory)
+		readEnvelope(t, conn, gorilla.FramePresence)
+
+		conn.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "<b>hi</b>", Deleted: true, ReplyCount: 3}})
+		readEnvelope(t, conn, gorilla.FrameAck)
+
+		var got racer.Message
+		json.Unmarshal(readEnvelope(t, conn, gorilla.FrameChat).Data, &got)
+
+		if got.Body != "&lt;b&gt;hi&lt;/b&gt;" || got.Deleted || got.ReplyCount != 0 {
+			t.Fatalf("got: %+v, want an escaped body and no server fields", got)
+		}
+	})
+}
+
+func TestConnector_ProtocolLegacy(t *testing.T) {
+	t.Run("It only sends bare chat messages to clients without a subprotocol", func(t *testing.T) {
+		srv := newEchoServer([]*racer.Message{{Body: "old"}})
+		defer srv.Close()
+
+		conn := dial(t, srv)
+		defer conn.Close()
+
+		conn.WriteJSON(&racer.Message{Body: "Test"})
+
+		var got racer.Message
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Body != "Test" || got.Type != racer.TypeText {
+			t.Fatalf("got: %+v, want the echoed chat message", got)
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package gorilla
+
+import (
+	"compress/flate"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tinylttl/racer"
+)
+
+const (
+	// DefaultBufferSize is the default size in bytes of a connections read and write buffers.
+	DefaultBufferSize = 1024
+
+	// EnvelopeOverhead is the most bytes a frame takes up beyond the body of the message it carries,
+	// for its envelope and the other fields of the message such as its ids and the metadata of a file.
+	// A frame can carry a body of MaxBodySize bytes only if MaxMessageSize leaves this much room besides.
+	EnvelopeOverhead = 4096
+
+	// DefaultMaxMessageSize is the default maximum message size allowed from peer,
+	// enough for a message with a body of racer.DefaultMaxBodySize bytes.
+	DefaultMaxMessageSize = racer.DefaultMaxBodySize + EnvelopeOverhead
+
+	// DefaultPongWait is the default time allowed to read the next pong message from the peer.
+	DefaultPongWait = 60 * time.Second
+
+	// DefaultWriteWait is the default time allowed to write a message to the peer.
+	DefaultWriteWait = 10 * time.Second
+
+	// DefaultChanSize is the default buffer size of a connectors read and write channels.
+	DefaultChanSize = 10
+
+	// DefaultCompressionLevel is the default flate level used for compressed messages.
+	DefaultCompressionLevel = flate.BestSpeed
+
+	// DefaultCompressionThreshold is the default size in bytes below which messages are sent uncompressed,
+	// small messages gain little from compression and cost cpu to deflate.
+	DefaultCompressionThreshold = 256
+)
+
+// Options holds the settings used by NewConnection to upgrade and run a connection.
+type Options struct {
+	ReadBufferSize  int
+	WriteBufferSize int
+	MaxMessageSize  int64
+	PongWait        time.Duration // pings are sent to the peer at 9/10ths of this period
+	WriteWait       time.Duration
+	ReadChanSize    int
+	WriteChanSize   int
+
+	// EnableCompression negotiates permessage-deflate with clients that support it.
+	// Messages smaller than CompressionThreshold bytes are always sent uncompressed.
+	EnableCompression    bool
+	CompressionLevel     int
+	CompressionThreshold int
+
+	// Subprotocols lists the racer.v1 subprotocols the server speaks, most preferred first,
+	// Codecs holds the codec each of them is encoded with.
+	// Clients that do not request one of these subprotocols use the legacy json protocol.
+	Subprotocols []string
+	Codecs       map[string]Codec
+
+	// AllowedOrigins lists the origins that may open a connection.
+	// Entries may contain shell style wildcards, so "https://*.racer.chat" allows every subdomain
+	// and "*" allows every origin. If the list is empty only same origin requests are allowed.
+	AllowedOrigins []string
+
+	// MaxBodySize is the most bytes the body of a message read from the peer can take up, see racer.Message.Validate.
+	// Sanitizer is applied to the text of every message read from the peer that is valid, nil leaves it as is.
+	MaxBodySize int
+	Sanitizer   racer.Sanitizer
+}
+
+// NewOptions returns Options initialized with the default settings,
+// any number of functional options can be passed to override them.
+func NewOptions(opts ...func(*Options)) *Options {
+	o := &Options{
+		ReadBufferSize:  DefaultBufferSize,
+		WriteBufferSize: DefaultBufferSize,
+		MaxMessageSize:  DefaultMaxMessageSize,
+		PongWait:        DefaultPongWait,
+		WriteWait:       DefaultWriteWait,
+		ReadChanSize:    DefaultChanSize,
+		WriteChanSize:   DefaultChanSize,
+
+		EnableCompression:    true,
+		CompressionLevel:     DefaultCompressionLevel,
+		CompressionThreshold: DefaultCompressionThreshold,
+
+		MaxBodySize: racer.DefaultMaxBodySize,
+		Sanitizer:   racer.EscapeHTML,
+
+		Subprotocols: []string{SubprotocolV1CBOR, SubprotocolV1MsgPack, SubprotocolV1},
+		Codecs: map[string]Codec{
+			SubprotocolV1CBOR:    CBOR,
+			SubprotocolV1MsgPack: MsgPack,
+			SubprotocolV1:        JSON,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithBufferSizes sets the size in bytes of the connections read and write buffers.
+// A size that is not positive leaves that buffer as it is.
+func WithBufferSizes(read, write int) func(*Options) {
+	return func(o *Options) {
+		if read > 0 {
+			o.ReadBufferSize = read
+		}
+
+		if write > 0 {
+			o.WriteBufferSize = write
+		}
+	}
+}
+
+// WithMaxMessageSize sets the maximum size in bytes of a message read from the peer.
+// A peer that sends a larger message is disconnected with CloseFrameTooBig. A size that is not positive is ignored.
+func WithMaxMessageSize(size int64) func(*Options) {
+	return func(o *Options) {
+		if size > 0 {
+			o.MaxMessageSize = size
+		}
+	}
+}
+
+// WithPongWait sets how long the connection waits for a pong before it is considered dead.
+// Pings are sent more often than d, so a d that is not positive is ignored.
+func WithPongWait(d time.Duration) func(*Options) {
+	return func(o *Options) {
+		if d > 0 {
+			o.PongWait = d
+		}
+	}
+}
+
+// WithWriteWait sets the time allowed to write a single message to the peer. A d that is not positive is ignored.
+func WithWriteWait(d time.Duration) func(*Options) {
+	return func(o *Options) {
+		if d > 0 {
+			o.WriteWait = d
+		}
+	}
+}
+
+// WithChanSizes sets the buffer sizes of the connectors read and write channels.
+// The write channel size also bounds the replies to the peers frames waiting to be written.
+// A size that is not positive leaves that channel as it is.
+func WithChanSizes(read, write int) func(*Options) {
+	return func(o *Options) {
+		if read > 0 {
+			o.ReadChanSize = read
+		}
+
+		if write > 0 {
+			o.WriteChanSize = write
+		}
+	}
+}
+
+// WithCompression enables or disables permessage-deflate compression.
+// Level is a compress/flate level, from flate.HuffmanOnly to flate.BestCompression, any other level is ignored.
+// Messages smaller than threshold bytes are sent uncompressed.
+func WithCompression(enable bool, level, threshold int) func(*Options) {
+	return func(o *Options) {
+		o.EnableCompression = enable
+		o.CompressionThreshold = threshold
+
+		if level >= flate.HuffmanOnly && level <= flate.BestCompression {
+			o.CompressionLevel = level
+		}
+	}
+}
+
+// WithCodec makes the racer.v1 protocol available under subprotocol, with frames encoded by codec.
+// A newly added subprotocol is preferred over any existing ones.
+func WithCodec(subprotocol string, codec Codec) func(*Options) {
+	return func(o *Options) {
+		if _, exists := o.Codecs[subprotocol]; !exists {
+			o.Subprotocols = append([]string{subprotocol}, o.Subprotocols...)
+		}
+
+		o.Codecs[subprotocol] = codec
+	}
+}
+
+// WithAllowedOrigins sets the origins that are allowed to open a connection.
+func WithAllowedOrigins(origins ...string) func(*Options) {
+	return func(o *Options) {
+		o.AllowedOrigins = origins
+	}
+}
+
+// WithMaxBodySize sets the most bytes the body of a message read from the peer can take up.
+func WithMaxBodySize(size int) func(*Options) {
+	return func(o *Options) {
+		o.MaxBodySize = size
+	}
+}
+
+// WithSanitizer sets the sanitizer applied to every message read from the peer, nil to leave messages as they are sent.
+func WithSanitizer(s racer.Sanitizer) func(*Options) {
+	return func(o *Options) {
+		o.Sanitizer = s
+	}
+}
+
+// pingPeriod returns how often pings are sent to the peer. It must be less than the pong wait, and positive for a ticker to tick at it.
+func (o *Options) pingPeriod() time.Duration {
+	if p := (o.PongWait * 9) / 10; p > 0 {
+		return p
+	}
+
+	return time.Nanosecond
+}
+
+// checkOrigin reports whether the requests origin matches one of the allowed origins.
+// Requests without an Origin header are not from a browser and are always allowed.
+func (o *Options) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if origin == "" {
+		return true
+	}
+
+	if len(o.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+
+		if err != nil {
+			return false
+		}
+
+		return strings.EqualFold(u.Host, r.Host)
+	}
+
+	origin = strings.ToLower(origin)
+	for _, pattern := range o.AllowedOrigins {
+		if pattern == "*" {
+			return true
+		}
+
+		if ok, _ := path.Match(strings.ToLower(pattern), origin); ok {
+			return true
+		}
+	}
+
+	return false
+}
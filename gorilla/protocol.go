@@ -0,0 +1,323 @@
+package gorilla
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+)
+
+// SubprotocolV1 is the websocket subprotocol a client requests to speak the racer.v1 protocol with json frames,
+// see SubprotocolV1MsgPack and SubprotocolV1CBOR for binary frames.
+// Clients that do not request a subprotocol fall back to the legacy protocol,
+// where every frame in either direction is a bare racer.Message encoded as json.
+//
+// Every racer.v1 frame is an Envelope. The id of a frame sent by the client is echoed back
+// in any ack or error frame it causes, so clients can match replies to the frames they sent.
+// Frames that belong to a room are tagged with the rooms chatID, a client connected to a single room
+// may leave the room off of the frames it sends.
+//
+//	client -> server
+//	  subscribe   room: the room to join, replied to with an ack
+//	              data: optional racer.Message, a seq resumes the subscription after that message,
+//	              a parentID follows only the thread of that message
+//	  unsubscribe room: the room to leave, replied to with an ack
+//	              data: optional racer.Message, a parentID stops following only the thread of that message
+//	  chat        data: racer.Message, a parentID replies in the thread of that message, replied to with an ack
+//	  file        data: racer.Message, the file is described by its meta, replied to with an ack
+//	  edit        data: racer.Message, parentID: the message to edit, body: its new body, replied to with an ack
+//	  delete      data: racer.Message, parentID: the message to delete, replied to with an ack
+//	  reaction    data: racer.Message, parentID: the message reacted to, body: the reaction, replied to with an ack
+//	  unreaction  data: racer.Message, parentID: the message reacted to, body: the reaction to take back, replied to with an ack
+//	  typing      data: racer.Message, body: "start" or "stop", a parentID types in the thread of that message
+//	  read        data: racer.Message, parentID: the last message read, replied to with an ack
+//
+//	server -> client
+//	  chat       data: racer.Message, id: the message id
+//	  file       data: racer.Message, id: the message id
+//	  edit       data: racer.Message, id: the message id, parentID: the message edited
+//	  delete     data: racer.Message, id: the message id, parentID: the message deleted
+//	  reaction   data: racer.Message, parentID: the message reacted to, senderID: who reacted
+//	  unreaction data: racer.Message, parentID: the message reacted to, senderID: who took their reaction back
+//	  system     data: racer.Message, id: the message id, parentID: the message a notice is about
+//	  typing     data: racer.Message, body: "start" or "stop", senderID: who is typing
+//	  read       data: racer.Message, parentID: the last message read, senderID: who read it
+//	  presence   data: racer.Message, body is "join" or "leave"
+//	  history    data: []racer.Message, oldest first, the messages missed when resuming a subscription
+//	  ack        data: AckData
+//	  error      data: ErrorData
+//
+// The senderID of every message is assigned by the server from the identity the client connected with,
+// whatever the client claims. Clients that connect without an identity are anonymous and cannot edit, delete, react or read.
+// Clients that connect with an api key can only subscribe to, post in and read the rooms the key was granted,
+// a subscribe or any other frame the key does not allow is answered with a forbidden error frame.
+// A key that can post to a room but not read it is sent none of the rooms messages.
+//
+// Every message sent by the client is validated before it is accepted, see racer.Message.Validate, and any html in it is escaped or stripped.
+// A frame that cannot be decoded or whose message is invalid is answered with an error frame, code malformed_frame or invalid_message,
+// and the connection stays open. Legacy clients have no error frame, their invalid messages are dropped.
+//
+// Error frames are sent for anything the client can recover from. A frame the server could not accept is answered
+// with an error frame carrying the frames id instead of an ack, and its data names the message by the id the client sent it with, if any.
+// A message that was acked but then rejected is answered with an error frame whose data names it by the id it was acked with.
+// The error codes are:
+//
+//	unsupported_frame  the client sent a frame type only the server sends
+//	malformed_frame    the frame could not be decoded
+//	invalid_message    the message failed validation, or asks for something that cannot be done, like editing a deleted message
+//	forbidden          the client is not allowed to do what the message asks
+//	not_found          the message names a message that does not exist
+//	unavailable        the server could not act on the message right now, it can be sent again
+//
+// Anything the client cannot recover from closes the connection with a close frame, whose reason is meant for people:
+//
+//	1000 normal         the server is done with the client
+//	1001 going away     the server is shutting down, or the client stopped answering pings
+//	1002 protocol error the client broke the websocket protocol
+//	1008 policy         the client broke a rule of the server, such as connecting to a route that requires racer.v1 without it,
+//	                    or sending frames faster than it reads the acks and errors they are answered with
+//	1009 too big        the client sent a frame larger than the server accepts
+//	1011 internal       the server failed, the client can reconnect
+//	1013 try again      the client fell too far behind a room, it should reconnect and resume its subscriptions
+//
+// Legacy clients are sent the same close frames.
+//
+// Every message broadcast to a room carries a seq, higher than that of any message before it in the room.
+// A client that reconnects resumes its subscriptions by sending the seq of the last message it recieved from each room.
+//
+// Only the sender of a message or a moderator can edit or delete it, any other edit or delete, or a reaction to a message
+// that cannot be reacted to, is answered with an error frame.
+// History holds deleted messages as tombstones with deleted set, and tallies the reactions to every message.
+// Live reactions are sent as they happen for the client to tally itself.
+//
+// Clients should keep sending start typing frames while the user types. The room is told a client is typing
+// at most every couple of seconds however often it sends them, and that it stopped once it sends stop or goes quiet for a few seconds.
+// Typing frames are never stored.
+const SubprotocolV1 = "racer.v1"
+
+// Frame types of the racer.v1 protocol.
+const (
+	FrameChat       = "chat"
+	FrameFile       = "file"
+	FrameEdit       = "edit"
+	FrameDelete     = "delete"
+	FrameReaction   = "reaction"
+	FrameUnreaction = "unreaction"
+	FrameRead       = "read"
+	FrameSystem     = "system"
+	FrameError      = "error"
+	FrameAck        = "ack"
+	FrameTyping     = "typing"
+	FramePresence   = "presence"
+	FrameHistory    = "history"
+
+	FrameSubscribe   = "subscribe"
+	FrameUnsubscribe = "unsubscribe"
+)
+
+// Error codes sent in the data of an error frame.
+const (
+	ErrUnsupportedFrame = "unsupported_frame"
+	ErrMalformedFrame   = "malformed_frame"     // the frame could not be decoded
+	ErrInvalidMessage   = racer.CodeInvalid     // the message failed validation, see racer.Message.Validate, or asks for something that cannot be done
+	ErrForbidden        = racer.CodeForbidden   // the client is not allowed to do what the message asks
+	ErrNotFound         = racer.CodeNotFound    // the message names a message that does not exist
+	ErrUnavailable      = racer.CodeUnavailable // the server could not act on the message right now, it can be sent again
+)
+
+// Close codes the server closes a connection with. The reason sent along with the code is meant for people, not clients.
+const (
+	CloseNormal      = websocket.CloseNormalClosure     // the server is done with the client
+	CloseGoingAway   = websocket.CloseGoingAway         // the server is shutting down, or the client stopped answering pings
+	ClosePolicy      = websocket.ClosePolicyViolation   // the client broke a rule of the server, such as connecting without a subprotocol it requires
+	CloseFrameTooBig = websocket.CloseMessageTooBig     // the client sent a frame larger than the server accepts, see WithMaxMessageSize
+	CloseInternal    = websocket.CloseInternalServerErr // the server failed, the client can reconnect
+	CloseTryAgain    = websocket.CloseTryAgainLater     // the client fell too far behind a room or a room could not be started, it should reconnect and resume its subscriptions
+)
+
+// Envelope wraps every frame sent using the racer.v1 protocol.
+type Envelope struct {
+	Type string      `json:"type"`
+	ID   string      `json:"id,omitempty"`
+	Room string      `json:"room,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// AckData tells the client the id and timestamp the server assigned to one of its chat messages.
+type AckData struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// ErrorData describes why a frame sent by the client was rejected.
+type ErrorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// MessageID identifies the rejected message. It is the id the server assigned the message once it was acked,
+	// before then it is whatever id the client sent the message with, if any.
+	MessageID string `json:"messageID,omitempty"`
+}
+
+// frameError is returned by a protocol when a frame could be read but not accepted,
+// the peer is told what went wrong and the connection stays open.
+type frameError struct {
+	ErrorData
+}
+
+func (e *frameError) Error() string { return e.Code + ": " + e.Message }
+
+// protocol translates between websocket frames and racer messages.
+// The values returned by its methods are written to the peer as is, a nil value means there is nothing to write.
+type protocol interface {
+	// decode reads a frame sent by the peer and returns its message along with the frames reference id.
+	decode(frame []byte) (msg *racer.Message, ref string, err error)
+	encode(msg *racer.Message) interface{}
+	ack(ref string, msg *racer.Message) interface{}
+	fail(ref string, err *frameError) interface{}
+	history(chatID string, msgs []*racer.Message) interface{}
+
+	// codec is used to encode and decode every frame
+	codec() Codec
+}
+
+// negotiate returns the protocol for the subprotocol agreed upon during the upgrade.
+func negotiate(subprotocol string, codecs map[string]Codec) protocol {
+	if codec, ok := codecs[subprotocol]; ok {
+		return v1{c: codec}
+	}
+
+	return legacy{}
+}
+
+// legacy is the original protocol, bare messages in both directions.
+// It has no way to represent anything other than a chat message.
+type legacy struct{}
+
+func (legacy) decode(frame []byte) (*racer.Message, string, error) {
+	msg := &racer.Message{}
+
+	if err := JSON.Unmarshal(frame, msg); err != nil {
+		return nil, "", &frameError{ErrorData{Code: ErrMalformedFrame, Message: errors.Wrap(err, "could not decode message").Error()}}
+	}
+
+	msg.Type = racer.TypeText
+
+	return msg, "", nil
+}
+
+func (legacy) encode(msg *racer.Message) interface{} {
+	if msg.Type != racer.TypeText && msg.Type != "" {
+		return nil
+	}
+
+	return msg
+}
+
+func (legacy) ack(string, *racer.Message) interface{}       { return nil }
+func (legacy) fail(string, *frameError) interface{}         { return nil }
+func (legacy) history(string, []*racer.Message) interface{} { return nil }
+func (legacy) codec() Codec                                 { return JSON }
+
+// v1 is the racer.v1 protocol, see SubprotocolV1.
+type v1 struct {
+	c Codec
+}
+
+// inbound is an Envelope sent by the client, clients only ever send messages as data.
+type inbound struct {
+	Type string         `json:"type"`
+	ID   string         `json:"id"`
+	Room string         `json:"room"`
+	Data *racer.Message `json:"data"`
+}
+
+// frameTypes maps message types to the frame type they are sent as
+var frameTypes = map[string]string{
+	"":                   FrameChat,
+	racer.TypeText:       FrameChat,
+	racer.TypeFile:       FrameFile,
+	racer.TypeEdit:       FrameEdit,
+	racer.TypeDelete:     FrameDelete,
+	racer.TypeReaction:   FrameReaction,
+	racer.TypeUnreaction: FrameUnreaction,
+	racer.TypeRead:       FrameRead,
+	racer.TypeSystem:     FrameSystem,
+	racer.TypeTyping:     FrameTyping,
+	racer.TypePresence:   FramePresence,
+}
+
+// messageTypes maps the frame types a client may send to the type of message they carry
+var messageTypes = map[string]string{
+	FrameChat:        racer.TypeText,
+	FrameFile:        racer.TypeFile,
+	FrameEdit:        racer.TypeEdit,
+	FrameDelete:      racer.TypeDelete,
+	FrameReaction:    racer.TypeReaction,
+	FrameUnreaction:  racer.TypeUnreaction,
+	FrameRead:        racer.TypeRead,
+	FrameTyping:      racer.TypeTyping,
+	FrameSubscribe:   racer.TypeSubscribe,
+	FrameUnsubscribe: racer.TypeUnsubscribe,
+}
+
+func (p v1) decode(frame []byte) (*racer.Message, string, error) {
+	env := inbound{}
+
+	if err := p.c.Unmarshal(frame, &env); err != nil {
+		return nil, env.ID, &frameError{ErrorData{Code: ErrMalformedFrame, Message: errors.Wrap(err, "could not decode envelope").Error()}}
+	}
+
+	typ, ok := messageTypes[env.Type]
+	if !ok {
+		ferr := &frameError{ErrorData{Code: ErrUnsupportedFrame, Message: fmt.Sprintf("clients cannot send %q frames", env.Type)}}
+
+		if env.Data != nil {
+			ferr.MessageID = env.Data.ID
+		}
+
+		return nil, env.ID, ferr
+	}
+
+	if env.Data == nil {
+		env.Data = &racer.Message{}
+	}
+
+	env.Data.Type = typ
+	env.Data.ChatID = env.Room
+
+	return env.Data, env.ID, nil
+}
+
+func (v1) encode(msg *racer.Message) interface{} {
+	if msg.Type == racer.TypeError {
+		return &Envelope{Type: FrameError, Room: msg.ChatID, Data: &ErrorData{Code: msg.Meta[racer.MetaErrorCode], Message: msg.Body, MessageID: msg.ParentID}}
+	}
+
+	typ, ok := frameTypes[msg.Type]
+	if !ok {
+		return nil
+	}
+
+	return &Envelope{Type: typ, ID: msg.ID, Room: msg.ChatID, Data: msg}
+}
+
+func (v1) ack(ref string, msg *racer.Message) interface{} {
+	switch msg.Type {
+	case racer.TypeText, racer.TypeFile, racer.TypeEdit, racer.TypeDelete, racer.TypeReaction, racer.TypeUnreaction, racer.TypeRead, racer.TypeSubscribe, racer.TypeUnsubscribe:
+		return &Envelope{Type: FrameAck, ID: ref, Room: msg.ChatID, Data: &AckData{ID: msg.ID, Timestamp: msg.Timestamp}}
+	}
+
+	return nil
+}
+
+func (v1) fail(ref string, err *frameError) interface{} {
+	return &Envelope{Type: FrameError, ID: ref, Data: &err.ErrorData}
+}
+
+func (v1) history(chatID string, msgs []*racer.Message) interface{} {
+	return &Envelope{Type: FrameHistory, Room: chatID, Data: msgs}
+}
+
+func (p v1) codec() Codec { return p.c }
@@ -0,0 +1,199 @@
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+)
+
+// APIKeyHeader is the header bots can pass their api key in, it can also be passed as a bearer token
+const APIKeyHeader = "X-API-Key"
+
+// authenticateKey returns the identity of the api key r carries. It returns ErrNoToken if r does not carry one.
+func (h *Handler) authenticateKey(r *http.Request) (racer.Identity, error) {
+	key := r.Header.Get(APIKeyHeader)
+
+	if a := r.Header.Get("Authorization"); key == "" && len(a) > 7 && strings.EqualFold(a[:7], "bearer ") {
+		if bearer := strings.TrimSpace(a[7:]); strings.HasPrefix(bearer, racer.APIKeyPrefix) {
+			key = bearer
+		}
+	}
+
+	if key == "" {
+		return racer.Identity{}, ErrNoToken
+	}
+
+	id, secret, err := racer.ParseAPIKey(key)
+
+	if err != nil {
+		return racer.Identity{}, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+
+	k, err := h.keys.FetchKey(id)
+
+	if err != nil {
+		return racer.Identity{}, errors.Wrap(err, "could not fetch api key")
+	}
+
+	if k == nil || !k.Verify(secret) {
+		return racer.Identity{}, errors.Wrap(ErrInvalidToken, "unknown or revoked api key")
+	}
+
+	// keys created before sender IDs were reserved for them could send as a user
+	if !racer.BotSender(k.SenderID) {
+		return racer.Identity{}, errors.Wrapf(ErrInvalidToken, "api key %s sends as a sender ID not reserved for api keys, it must be created again", k.ID)
+	}
+
+	return k.Identity(), nil
+}
+
+// admin responds with an error unless the client making r can manage api keys, reporting whether it can.
+// Moderators and identities granted admin in every room can.
+func (h *Handler) admin(w http.ResponseWriter, r *http.Request) bool {
+	identity, err := h.identify(r)
+
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+
+	if !identity.Can(racer.AllRooms, racer.ScopeAdmin) && (h.moderator == nil || !h.moderator(r)) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// newKey is the request to create an api key
+type newKey struct {
+	Name     string       `json:"name"`
+	SenderID int          `json:"senderID,omitempty"` // derived from the keys ID if left out, see racer.BotSender
+	Grants   racer.Grants `json:"grants"`
+}
+
+// createdKey is the response to creating an api key, the only time the key itself is ever shown
+type createdKey struct {
+	*racer.APIKey
+	Key string `json:"key"`
+}
+
+// handleGetKeys handles all GET requests to /admin/keys
+// It responds with every api key as json, without their hashes.
+func (h *Handler) handleGetKeys() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.admin(w, r) {
+			return
+		}
+
+		keys, err := h.keys.Keys()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, k := range keys {
+			k.Hash = nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(keys); err != nil {
+			log.Printf("error: could not write api keys: %v", err)
+		}
+	})
+}
+
+// handlePostKey handles all POST requests to /admin/keys
+// It creates an api key from the json body of the request, responding with the key.
+func (h *Handler) handlePostKey() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.admin(w, r) {
+			return
+		}
+
+		var req newKey
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "could not decode key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := validGrants(req.Grants); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		k, key, err := racer.NewAPIKey(req.Name, req.SenderID, req.Grants)
+
+		if _, invalid := err.(*racer.InvalidError); invalid {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := h.keys.PutKey(k); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		k.Hash = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+
+		if err := json.NewEncoder(w).Encode(&createdKey{APIKey: k, Key: key}); err != nil {
+			log.Printf("error: could not write api key %s: %v", k.ID, err)
+		}
+	})
+}
+
+// handleDeleteKey handles all DELETE requests to /admin/keys/:keyID
+// It revokes the key, clients already connected with it stay connected.
+func (h *Handler) handleDeleteKey() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.admin(w, r) {
+			return
+		}
+
+		if err := h.keys.DeleteKey(chi.URLParam(r, "keyID")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// validGrants returns an error if grants is empty or grants a scope racer does not know
+func validGrants(grants racer.Grants) error {
+	if len(grants) == 0 {
+		return errors.New("a key must be granted at least one room")
+	}
+
+	for chatID, scopes := range grants {
+		if chatID == "" || len(scopes) == 0 {
+			return errors.New("every grant must name a room and at least one scope")
+		}
+
+		for _, scope := range scopes {
+			switch scope {
+			case racer.ScopeRead, racer.ScopePost, racer.ScopeAdmin:
+			default:
+				return errors.Errorf("unknown scope %q", scope)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,230 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tinylttl/racer"
+)
+
+// testkeys is an in memory racer.APIKeyRepo
+type testkeys struct {
+	mu   sync.Mutex
+	keys map[string]*racer.APIKey
+}
+
+func (tk *testkeys) PutKey(k *racer.APIKey) error {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	cp := *k
+	tk.keys[k.ID] = &cp
+
+	return nil
+}
+
+func (tk *testkeys) FetchKey(ID string) (*racer.APIKey, error) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if k, ok := tk.keys[ID]; ok {
+		cp := *k
+		return &cp, nil
+	}
+
+	return nil, nil
+}
+
+func (tk *testkeys) Keys() ([]*racer.APIKey, error) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	keys := make([]*racer.APIKey, 0, len(tk.keys))
+	for _, k := range tk.keys {
+		cp := *k
+		keys = append(keys, &cp)
+	}
+
+	return keys, nil
+}
+
+func (tk *testkeys) DeleteKey(ID string) error {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	delete(tk.keys, ID)
+
+	return nil
+}
+
+func TestAPIKeys(t *testing.T) {
+	repo := newTestRepo()
+	repo.msgs["23"] = []*racer.Message{{ID: "root", ChatID: "23", Body: "root"}}
+
+	isAdmin := func(r *http.Request) bool { return r.Header.Get("X-Admin") == "yes" }
+
+	srv := httptest.NewServer(NewHandler(repo, WithAPIKeys(&testkeys{keys: make(map[string]*racer.APIKey)}), WithModerators(isAdmin)))
+	defer srv.Close()
+
+	admin := func(method, path string, body interface{}, headers http.Header) *http.Response {
+		b, _ := json.Marshal(body)
+
+		req, err := http.NewRequest(method, srv.URL+"/v"+apiVersion+path, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = headers
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	asAdmin := http.Header{"X-Admin": {"yes"}}
+
+	create := func(grants racer.Grants) *createdKey {
+		resp := admin("POST", "/admin/keys", &newKey{Name: "bot", Grants: grants}, asAdmin)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusCreated)
+		}
+
+		created := &createdKey{}
+		if err := json.NewDecoder(resp.Body).Decode(created); err != nil {
+			t.Fatal(err)
+		}
+
+		return created
+	}
+
+	poster := create(racer.Grants{"23": {racer.ScopePost}})
+	reader := create(racer.Grants{racer.AllRooms: {racer.ScopeRead}})
+
+	withKey := func(k *createdKey) http.Header { return http.Header{APIKeyHeader: {k.Key}} }
+
+	t.Run("It only lets admins manage keys", func(t *testing.T) {
+		if resp := admin("GET", "/admin/keys", nil, nil); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusForbidden)
+		}
+
+		if resp := admin("POST", "/admin/keys", &newKey{Name: "bot", Grants: racer.Grants{"23": {"fly"}}}, asAdmin); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusBadRequest)
+		}
+
+		resp := admin("GET", "/admin/keys", nil, asAdmin)
+		defer resp.Body.Close()
+
+		var keys []*racer.APIKey
+		if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 2 || keys[0].Hash != nil || keys[1].Hash != nil {
+			t.Fatalf("got: %+v, want both keys without their hashes", keys)
+		}
+	})
+
+	t.Run("It lets keys post in the rooms they were granted", func(t *testing.T) {
+		if _, resp, err := websocket.DefaultDialer.Dial(chatURL(srv, "24"), withKey(poster)); err == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("got: %v, want the upgrade to be forbidden", err)
+		}
+
+		listener, _, err := websocket.DefaultDialer.Dial(chatURL(srv, "23"), withKey(reader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		bot, _, err := websocket.DefaultDialer.Dial(chatURL(srv, "23"), withKey(poster))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bot.Close()
+
+		bot.WriteJSON(&racer.Message{Body: "beep"})
+
+		for {
+			got := &racer.Message{}
+
+			listener.SetReadDeadline(time.Now().Add(time.Second))
+			if err := listener.ReadJSON(got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Body != "beep" {
+				continue
+			}
+
+			if got.SenderID != poster.SenderID {
+				t.Fatalf("got: %d, want: %d", got.SenderID, poster.SenderID)
+			}
+			return
+		}
+	})
+
+	t.Run("It applies keys to the http endpoints", func(t *testing.T) {
+		if resp := admin("GET", "/chat/23/threads/root", nil, withKey(poster)); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusForbidden)
+		}
+
+		if resp := admin("GET", "/chat/23/threads/root", nil, withKey(reader)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusOK)
+		}
+	})
+
+	t.Run("It lets keys post over http in the rooms they were granted", func(t *testing.T) {
+		if resp := admin("POST", "/chat/23/messages", &racer.Message{Body: "beep"}, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusUnauthorized)
+		}
+
+		if resp := admin("POST", "/chat/24/messages", &racer.Message{Body: "beep"}, withKey(poster)); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusForbidden)
+		}
+
+		resp := admin("POST", "/chat/23/messages", &racer.Message{Body: "beep"}, withKey(poster))
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusCreated)
+		}
+
+		got := &racer.Message{}
+		if err := json.NewDecoder(resp.Body).Decode(got); err != nil {
+			t.Fatal(err)
+		}
+
+		if got.SenderID != poster.SenderID || got.ChatID != "23" || got.ID == "" {
+			t.Fatalf("got: %+v, want: a message sent by %d in 23", got, poster.SenderID)
+		}
+	})
+
+	t.Run("It only lets keys send as the sender IDs reserved for them", func(t *testing.T) {
+		if resp := admin("POST", "/admin/keys", &newKey{Name: "bot", SenderID: 5, Grants: racer.Grants{"23": {racer.ScopePost}}}, asAdmin); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusBadRequest)
+		}
+
+		if !racer.BotSender(poster.SenderID) {
+			t.Fatalf("got: %d, want: a sender ID reserved for api keys", poster.SenderID)
+		}
+	})
+
+	t.Run("It rejects revoked keys", func(t *testing.T) {
+		if resp := admin("DELETE", "/admin/keys/"+poster.ID, nil, asAdmin); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusNoContent)
+		}
+
+		if _, resp, err := websocket.DefaultDialer.Dial(chatURL(srv, "23"), withKey(poster)); err == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got: %v, want the upgrade to be unauthorized", err)
+		}
+	})
+}
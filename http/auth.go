@@ -0,0 +1,315 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+)
+
+const (
+	// DefaultTokenCookie is the cookie browsers pass their token in, since they cannot set headers on a websocket upgrade
+	DefaultTokenCookie = "racer_token"
+
+	// DefaultTokenParam is the query parameter browsers can pass their token in instead of a cookie
+	DefaultTokenParam = "access_token"
+)
+
+var (
+	// ErrNoToken is returned by TokenAuth when a request does not carry a token
+	ErrNoToken = errors.New("no token")
+
+	// ErrInvalidToken is returned by TokenAuth when a token is malformed, unsigned or its signature does not verify
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrExpiredToken is returned by TokenAuth when a token has expired or is not valid yet
+	ErrExpiredToken = errors.New("token expired or not valid yet")
+)
+
+// algorithms are the hashes of the HMAC signing algorithms a token can be signed with, none or asymmetric algorithms are never accepted
+var algorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// signingKey is a key tokens are signed with, identified by the kid header of the tokens it signs
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// TokenAuth authenticates requests by the HMAC signed JWT bearer token they carry.
+// The token is read from the Authorization header, or for browsers from a cookie or query parameter.
+// The subject of a token is the sender ID of the client, every other claim is passed on in its identity.
+type TokenAuth struct {
+	keys   []signingKey // tokens are verified with any of them and signed with the last
+	cookie string       // empty to not read tokens from a cookie
+	param  string       // empty to not read tokens from the query
+	now    func() time.Time
+}
+
+// NewTokenAuth returns a TokenAuth with the default cookie and query parameter.
+// It can take a variadic number of functional options, at least one signing key must be set for any token to verify.
+func NewTokenAuth(opts ...func(*TokenAuth)) *TokenAuth {
+	a := &TokenAuth{
+		cookie: DefaultTokenCookie,
+		param:  DefaultTokenParam,
+		now:    time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+// WithSigningKey adds a key tokens can be signed with, identified by the kid header of the tokens it signs.
+// Keys are rotated by adding the new key last, tokens are signed with it while tokens signed with earlier keys keep verifying
+// until those keys are removed. Use with NewTokenAuth()
+func WithSigningKey(id string, secret []byte) func(*TokenAuth) {
+	return func(a *TokenAuth) {
+		a.keys = append(a.keys, signingKey{id: id, secret: secret})
+	}
+}
+
+// WithTokenCookie sets the cookie a token is read from, empty to not read tokens from cookies. Use with NewTokenAuth()
+func WithTokenCookie(name string) func(*TokenAuth) {
+	return func(a *TokenAuth) {
+		a.cookie = name
+	}
+}
+
+// WithTokenParam sets the query parameter a token is read from, empty to not read tokens from the query. Use with NewTokenAuth()
+func WithTokenParam(name string) func(*TokenAuth) {
+	return func(a *TokenAuth) {
+		a.param = name
+	}
+}
+
+// Authenticate returns the identity established by the token r carries, it satisfies Authenticator.
+func (a *TokenAuth) Authenticate(r *http.Request) (racer.Identity, error) {
+	token := a.token(r)
+
+	if token == "" {
+		return racer.Identity{}, ErrNoToken
+	}
+
+	claims, err := a.Verify(token)
+
+	if err != nil {
+		return racer.Identity{}, err
+	}
+
+	sub, _ := claims["sub"].(string)
+	senderID, err := strconv.Atoi(sub)
+
+	if err != nil || senderID < 1 {
+		return racer.Identity{}, errors.Wrap(ErrInvalidToken, "subject is not a sender id")
+	}
+
+	return racer.Identity{SenderID: senderID, Claims: claims}, nil
+}
+
+// Middleware rejects every request that does not carry a valid token with 401,
+// and passes the identity of those that do to next in their context, see IdentityFromContext.
+func (a *TokenAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := a.Authenticate(r)
+
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// identityKey is the key of the identity Middleware adds to a requests context
+type identityKey struct{}
+
+// IdentityFromContext returns the identity Middleware established for a request, ok is false if it did not establish one.
+func IdentityFromContext(ctx context.Context) (identity racer.Identity, ok bool) {
+	identity, ok = ctx.Value(identityKey{}).(racer.Identity)
+	return identity, ok
+}
+
+// token returns the token r carries, the Authorization header takes precedence over the cookie which takes precedence over the query.
+func (a *TokenAuth) token(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+
+	if a.cookie != "" {
+		if c, err := r.Cookie(a.cookie); err == nil {
+			return c.Value
+		}
+	}
+
+	if a.param != "" {
+		return r.URL.Query().Get(a.param)
+	}
+
+	return ""
+}
+
+// header is the header of a token
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Verify checks the signature of token and that it is within its exp and nbf claims, returning its claims.
+// A token naming a key with its kid header is only verified with that key, one that does not is tried against every key.
+func (a *TokenAuth) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrInvalidToken, "token must have three parts")
+	}
+
+	var h header
+
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "could not decode header")
+	}
+
+	alg, ok := algorithms[h.Alg]
+
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidToken, "unsupported algorithm %q", h.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "could not decode signature")
+	}
+
+	verified := false
+
+	for _, k := range a.keys {
+		if h.Kid != "" && h.Kid != k.id {
+			continue
+		}
+
+		if hmac.Equal(sig, sign(alg, k.secret, parts[0]+"."+parts[1])) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, errors.Wrap(ErrInvalidToken, "signature does not verify")
+	}
+
+	var claims map[string]interface{}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "could not decode claims")
+	}
+
+	now := a.now().Unix()
+
+	exp, hasExp, err := numericClaim(claims, "exp")
+
+	if err != nil {
+		return nil, err
+	}
+
+	nbf, hasNbf, err := numericClaim(claims, "nbf")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if (hasExp && now >= exp) || (hasNbf && now < nbf) {
+		return nil, ErrExpiredToken
+	}
+
+	return claims, nil
+}
+
+// Sign returns a HS256 token holding claims, signed with the last signing key.
+func (a *TokenAuth) Sign(claims map[string]interface{}) (string, error) {
+	if len(a.keys) == 0 {
+		return "", errors.New("no signing key")
+	}
+
+	k := a.keys[len(a.keys)-1]
+
+	h, err := json.Marshal(&header{Alg: "HS256", Kid: k.id, Typ: "JWT"})
+
+	if err != nil {
+		return "", errors.Wrap(err, "could not encode header")
+	}
+
+	c, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", errors.Wrap(err, "could not encode claims")
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sign(sha256.New, k.secret, unsigned)), nil
+}
+
+// sign returns the HMAC of unsigned with secret
+func sign(alg func() hash.Hash, secret []byte, unsigned string) []byte {
+	mac := hmac.New(alg, secret)
+	mac.Write([]byte(unsigned))
+
+	return mac.Sum(nil)
+}
+
+// decodeSegment decodes a base64url encoded json segment of a token into v
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	return dec.Decode(v)
+}
+
+// numericClaim returns the claim name as unix seconds, ok is false if the token does not have it
+func numericClaim(claims map[string]interface{}, name string) (secs int64, ok bool, err error) {
+	v, ok := claims[name]
+
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, isNumber := v.(json.Number)
+
+	if !isNumber {
+		return 0, false, errors.Wrapf(ErrInvalidToken, "%s is not a number", name)
+	}
+
+	f, err := n.Float64()
+
+	if err != nil {
+		return 0, false, errors.Wrapf(ErrInvalidToken, "%s is not a number", name)
+	}
+
+	return int64(f), true, nil
+}
@@ -0,0 +1,128 @@
+package http
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+)
+
+func TestTokenAuth_Authenticate(t *testing.T) {
+	old := NewTokenAuth(WithSigningKey("old", []byte("old secret")))
+	current := NewTokenAuth(WithSigningKey("current", []byte("current secret")))
+	rotated := NewTokenAuth(WithSigningKey("old", []byte("old secret")), WithSigningKey("current", []byte("current secret")))
+
+	sign := func(a *TokenAuth, claims map[string]interface{}) string {
+		token, err := a.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := map[string]interface{}{"sub": "7", "exp": time.Now().Add(time.Hour).Unix(), "role": "admin"}
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"7"}`)) + "."
+
+	header := func(token string) *http.Request {
+		r := httptest.NewRequest("GET", "/v1/chat", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	cookie := httptest.NewRequest("GET", "/v1/chat", nil)
+	cookie.AddCookie(&http.Cookie{Name: DefaultTokenCookie, Value: sign(current, valid)})
+
+	tcs := []struct {
+		name string
+		auth *TokenAuth
+		r    *http.Request
+		want int
+		err  error
+	}{
+		{"It reads the token from the authorization header", current, header(sign(current, valid)), 7, nil},
+		{"It reads the token from a cookie", current, cookie, 7, nil},
+		{"It reads the token from the query", current, httptest.NewRequest("GET", "/v1/chat?access_token="+sign(current, valid), nil), 7, nil},
+		{"It verifies tokens signed with a rotated out key", rotated, header(sign(old, valid)), 7, nil},
+		{"It signs tokens with the newest key", current, header(sign(rotated, valid)), 7, nil},
+		{"It rejects requests without a token", current, httptest.NewRequest("GET", "/v1/chat", nil), 0, ErrNoToken},
+		{"It rejects tokens signed with an unknown key", current, header(sign(old, valid)), 0, ErrInvalidToken},
+		{"It rejects unsigned tokens", current, header(unsigned), 0, ErrInvalidToken},
+		{"It rejects malformed tokens", current, header("not.a-token"), 0, ErrInvalidToken},
+		{"It rejects expired tokens", current, header(sign(current, map[string]interface{}{"sub": "7", "exp": time.Now().Add(-time.Minute).Unix()})), 0, ErrExpiredToken},
+		{"It rejects tokens that are not valid yet", current, header(sign(current, map[string]interface{}{"sub": "7", "nbf": time.Now().Add(time.Hour).Unix()})), 0, ErrExpiredToken},
+		{"It rejects tokens whose subject is not a sender id", current, header(sign(current, map[string]interface{}{"sub": "alice"})), 0, ErrInvalidToken},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			identity, err := tc.auth.Authenticate(tc.r)
+
+			if errors.Cause(err) != tc.err {
+				t.Fatalf("got: %v, want: %v", err, tc.err)
+			}
+
+			if identity.SenderID != tc.want {
+				t.Fatalf("got: %d, want: %d", identity.SenderID, tc.want)
+			}
+
+			if tc.err == nil && identity.Claims["role"] != "admin" {
+				t.Fatalf("got claims: %v, want them passed on", identity.Claims)
+			}
+		})
+	}
+}
+
+func TestTokenAuth_Middleware(t *testing.T) {
+	auth := NewTokenAuth(WithSigningKey("k", []byte("secret")))
+	token, err := auth.Sign(map[string]interface{}{"sub": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(auth.Middleware(NewHandler(newTestRepo())))
+	defer srv.Close()
+
+	t.Run("It rejects the upgrade without a valid token", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(chatURL(srv, "23"), nil)
+		if err == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got: %v, want the upgrade to be unauthorized", err)
+		}
+	})
+
+	t.Run("It passes the verified identity to the client", func(t *testing.T) {
+		url := chatURL(srv, "23") + "?access_token=" + token
+
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(&racer.Message{Body: "hi", SenderID: 99})
+
+		for {
+			got := &racer.Message{}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if err := conn.ReadJSON(got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Body != "hi" {
+				continue
+			}
+
+			if got.SenderID != 7 {
+				t.Fatalf("got: %d, want: %d", got.SenderID, 7)
+			}
+			return
+		}
+	})
+}
@@ -1,9 +1,13 @@
 package http
 
 import (
+	"encoding/json"
+	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 	"github.com/tinylttl/racer"
 	"github.com/tinylttl/racer/broker"
 	"github.com/tinylttl/racer/gorilla"
@@ -11,28 +15,152 @@ import (
 
 // Handler handles all incoming HTTP requests for the application
 type Handler struct {
-	Router chi.Router
-	Repo   racer.MessageRepo
+	Router     chi.Router
+	Repo       racer.MessageRepo
+	Journal    racer.Journal            // logs the messages of every room until they are backed up, may be nil
+	connOpts   []func(*gorilla.Options) // applied to every websocket connection the handler upgrades
+	backupOpts []func(*racer.Backupper) // applied to every backupper the handlers clients create
+	moderator  func(*http.Request) bool // reports whether the client making a request is a moderator, may be nil
+	auth       Authenticator            // establishes who the client making a request is, may be nil
+	oidc       *OIDC                    // logs users in with an OpenID Connect provider, may be nil
+	keys       racer.APIKeyRepo         // the api keys bots and integrations connect with, may be nil
 }
 
+// Authenticator establishes the identity of the client making a request before its connection is upgraded.
+// Returning an error rejects the request as unauthorized.
+type Authenticator func(r *http.Request) (racer.Identity, error)
+
 // NewHandler returns a Handler configured with a Router.
-func NewHandler(repo racer.MessageRepo) *Handler {
+// It can take a variadic number of functional options.
+func NewHandler(repo racer.MessageRepo, opts ...func(*Handler)) *Handler {
 	h := &Handler{Repo: repo}
 
+	for _, opt := range opts {
+		opt(h)
+	}
+
 	h.Router = NewRouter(h)
 
 	return h
 }
 
+// WithConnOptions sets the options used when upgrading websocket connections. Use with NewHandler()
+func WithConnOptions(opts ...func(*gorilla.Options)) func(*Handler) {
+	return func(h *Handler) {
+		h.connOpts = append(h.connOpts, opts...)
+	}
+}
+
+// WithJournal sets the journal rooms log their messages to until they are backed up. Use with NewHandler()
+func WithJournal(j racer.Journal) func(*Handler) {
+	return func(h *Handler) {
+		h.Journal = j
+	}
+}
+
+// WithBackupOptions sets the options used to create the backupper that records every room. Use with NewHandler()
+func WithBackupOptions(opts ...func(*racer.Backupper)) func(*Handler) {
+	return func(h *Handler) {
+		h.backupOpts = append(h.backupOpts, opts...)
+	}
+}
+
+// WithModerators sets the func that decides whether the client connecting with a request is a moderator,
+// moderators can edit and delete the messages of any sender. Without it no client is a moderator. Use with NewHandler()
+func WithModerators(isModerator func(r *http.Request) bool) func(*Handler) {
+	return func(h *Handler) {
+		h.moderator = isModerator
+	}
+}
+
+// WithAuthenticator sets the authenticator that establishes who every client is when it connects.
+// Without it every client is anonymous. Use with NewHandler()
+func WithAuthenticator(auth Authenticator) func(*Handler) {
+	return func(h *Handler) {
+		h.auth = auth
+	}
+}
+
+// WithOIDC serves the login flow of o at /login, with the provider sending users back to /login/callback. Use with NewHandler()
+func WithOIDC(o *OIDC) func(*Handler) {
+	return func(h *Handler) {
+		h.oidc = o
+	}
+}
+
+// WithAPIKeys lets bots and integrations connect with the api keys in repo, and serves the admin api
+// that manages them at /admin/keys. Use with NewHandler()
+func WithAPIKeys(repo racer.APIKeyRepo) func(*Handler) {
+	return func(h *Handler) {
+		h.keys = repo
+	}
+}
+
+// identify returns the identity of the client making r, the error is returned if its credentials are rejected.
+// An api key takes precedence over the handlers authenticator. Without either the client takes the identity
+// TokenAuth.Middleware established for r, if any, or is anonymous.
+// Only api keys can send as the sender IDs reserved for them, see racer.BotSender.
+func (h *Handler) identify(r *http.Request) (racer.Identity, error) {
+	if h.keys != nil {
+		identity, err := h.authenticateKey(r)
+
+		if errors.Cause(err) != ErrNoToken {
+			return identity, err
+		}
+	}
+
+	identity, _ := IdentityFromContext(r.Context())
+
+	if h.auth != nil {
+		var err error
+
+		if identity, err = h.auth(r); err != nil {
+			return identity, err
+		}
+	}
+
+	if racer.BotSender(identity.SenderID) {
+		return racer.Identity{}, errors.Wrapf(ErrInvalidToken, "sender ID %d is reserved for api keys", identity.SenderID)
+	}
+
+	return identity, nil
+}
+
+// clientOptions returns the options for the client with identity connecting with r
+func (h *Handler) clientOptions(r *http.Request, identity racer.Identity) []func(*racer.Client) {
+	opts := []func(*racer.Client){racer.WithIdentity(identity)}
+
+	if h.moderator != nil && h.moderator(r) {
+		opts = append(opts, racer.AsModerator())
+	}
+
+	return opts
+}
+
 // NewRouter returns a new router preloaded with all the routes necessary to serve
 // the application.
 func NewRouter(handler *Handler) chi.Router {
 	routeBase := "/v" + apiVersion
 
 	r := chi.NewRouter()
-	b := broker.NewBroker()
+	rs := handler.newRooms(broker.NewBroker())
+
+	r.Get(routeBase+"/chat", handler.handleGetMux(rs))
+	r.Get(routeBase+"/chat/{chatID}", handler.handleGetTopic(rs))
+	r.Post(routeBase+"/chat/{chatID}/messages", handler.handlePostMessage(rs))
+	r.Get(routeBase+"/chat/{chatID}/threads/{messageID}", handler.handleGetThread())
+	r.Get(routeBase+"/unread", handler.handleGetUnread())
+
+	if handler.keys != nil {
+		r.Get(routeBase+"/admin/keys", handler.handleGetKeys())
+		r.Post(routeBase+"/admin/keys", handler.handlePostKey())
+		r.Delete(routeBase+"/admin/keys/{keyID}", handler.handleDeleteKey())
+	}
 
-	r.Get(routeBase+"/chat/{chatID}", handler.handleGetTopic(b))
+	if handler.oidc != nil {
+		r.Get(routeBase+"/login", handler.oidc.HandleLogin())
+		r.Get(routeBase+"/login/callback", handler.oidc.HandleCallback())
+	}
 
 	return r
 }
@@ -43,11 +171,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleGetTopic handles all GET requests to /chat/:chatID
-// It takes a broker that maps IDS to running topics.
+// It takes rooms backed by a broker that maps IDS to running topics.
 // The goal is that we only have one topic running for a given chat endpoint (chatID).
 // The topics job is to manage each client connection that is active at that endpoint.
 // If a topics clients all unregister, it will terminate and remove itself from the broker.
-func (h *Handler) handleGetTopic(b *broker.Broker) http.HandlerFunc {
+// A client reconnecting to the topic passes the seq of the last message it recieved as the since query parameter
+// to have everything it missed replayed to it.
+func (h *Handler) handleGetTopic(rs *rooms) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		chatID := chi.URLParam(r, "chatID")
 
@@ -57,25 +187,316 @@ func (h *Handler) handleGetTopic(b *broker.Broker) http.HandlerFunc {
 			return
 		}
 
-		b.Lookup(chatID, func(found bool, t *broker.Topic) {
-			if !found {
-				go func() {
-					t.Start() // TODO: PASS CONTEXT TO CANCEL
-					b.Remove(chatID)
-				}()
+		if err := racer.ValidateChatID(chatID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var since uint64
+
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+
+			if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, "since must be a message seq", http.StatusBadRequest)
+				return
+			}
+		}
+
+		identity, err := h.identify(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if !identity.Can(chatID, racer.ScopeRead) && !identity.Can(chatID, racer.ScopePost) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		// the upgrader has already responded to a request it could not upgrade
+		conn, err := gorilla.NewConnection(w, r, h.connOpts...)
+		if err != nil {
+			log.Printf("error: %v", err)
+			return
+		}
+
+		c := racer.NewClient(rs, conn, h.Repo, h.clientOptions(r, identity)...)
+
+		if err := c.Subscribe(chatID, since); err != nil {
+			if _, refused := err.(*racer.Rejection); refused {
+				conn.CloseWith(gorilla.ClosePolicy, err.Error())
+				return
+			}
+
+			log.Printf("error: client %s: %v", c.ID, err)
+			conn.CloseWith(gorilla.CloseTryAgain, "the room is unavailable, try again later")
+			return
+		}
+
+		if err := c.Run(r.Context()); err != nil {
+			log.Printf("error: client %s: %v", c.ID, err)
+		}
+	})
+}
+
+// handlePostMessage handles all POST requests to /chat/:chatID/messages
+// It broadcasts the message in the json body of the request to the room without a connection, so bots can post with their api key alone.
+// The message is validated, sanitized and stamped like one read from a connection, then checked like one sent by a client, see racer.Client.Post.
+// It responds with the message as it was broadcast, anonymous clients are unauthorized.
+func (h *Handler) handlePostMessage(rs *rooms) http.HandlerFunc {
+	opts := gorilla.NewOptions(h.connOpts...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chatID := chi.URLParam(r, "chatID")
+
+		if err := racer.ValidateChatID(chatID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		identity, err := h.identify(r)
+
+		if err != nil || identity.Anonymous() {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		msg := &racer.Message{}
+
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, opts.MaxMessageSize)).Decode(msg); err != nil {
+			http.Error(w, "could not decode message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := msg.Validate(opts.MaxBodySize); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		msg.Sanitize(opts.Sanitizer)
+		gorilla.Stamp(msg)
+
+		c := racer.NewClient(rs, nil, h.Repo, h.clientOptions(r, identity)...)
+
+		if err := c.Post(chatID, msg); err != nil {
+			rejection, refused := err.(*racer.Rejection)
+
+			if !refused {
+				log.Printf("error: client %s: %v", c.ID, err)
+				http.Error(w, "the room is unavailable, try again later", http.StatusServiceUnavailable)
+				return
 			}
 
-			conn, err := gorilla.NewConnection(w, r)
+			http.Error(w, rejection.Reason, rejectionStatus[rejection.Code])
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			log.Printf("error: could not write message %s: %v", msg.ID, err)
+		}
+	})
+}
+
+// rejectionStatus maps the code of every racer.Rejection to the status of the response to a message posted over http
+var rejectionStatus = map[string]int{
+	racer.CodeForbidden:   http.StatusForbidden,
+	racer.CodeNotFound:    http.StatusNotFound,
+	racer.CodeInvalid:     http.StatusBadRequest,
+	racer.CodeUnavailable: http.StatusServiceUnavailable,
+}
+
+// handleGetMux handles all GET requests to /chat
+// The connection is not tied to any one room, instead the client sends subscribe and unsubscribe frames
+// to choose the rooms it is a part of. Only clients speaking the racer.v1 protocol can tag their frames with a room,
+// so legacy clients are disconnected straight away with gorilla.ClosePolicy.
+func (h *Handler) handleGetMux(rs *rooms) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := h.identify(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		// the upgrader has already responded to a request it could not upgrade
+		conn, err := gorilla.NewConnection(w, r, h.connOpts...)
+		if err != nil {
+			log.Printf("error: %v", err)
+			return
+		}
+
+		if conn.Subprotocol() == "" {
+			conn.CloseWith(gorilla.ClosePolicy, "the "+gorilla.SubprotocolV1+" subprotocol is required")
+			return
+		}
+
+		c := racer.NewClient(rs, conn, h.Repo, h.clientOptions(r, identity)...)
+
+		if err := c.Run(r.Context()); err != nil {
+			log.Printf("error: client %s: %v", c.ID, err)
+		}
+	})
+}
+
+const (
+	// threadPageSize is the number of replies in a page of a thread when the request does not set a limit
+	threadPageSize = 50
+
+	// maxThreadPageSize is the most replies in a single page of a thread
+	maxThreadPageSize = 200
+)
+
+// thread is the response to a request for a page of a thread
+type thread struct {
+	Root    *racer.Message   `json:"root"`
+	Replies []*racer.Message `json:"replies"`
+	Next    int64            `json:"next,omitempty"` // pass as after to fetch the next page, missing on the last page
+}
+
+// handleGetThread handles all GET requests to /chat/:chatID/threads/:messageID
+// It responds with the message identified by messageID and a page of its replies as json, oldest first.
+// The page starts after the reply with the timestamp in the after query parameter and holds at most limit replies.
+// Only messages that have been backed up are included.
+func (h *Handler) handleGetThread() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chatID, msgID := chi.URLParam(r, "chatID"), chi.URLParam(r, "messageID")
+
+		if err := racer.ValidateChatID(chatID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		identity, err := h.identify(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if !identity.Can(chatID, racer.ScopeRead) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		tr, ok := h.Repo.(racer.ThreadRepo)
+
+		if !ok {
+			http.Error(w, "threads are not supported", http.StatusNotImplemented)
+			return
+		}
+
+		var after int64
+		limit := threadPageSize
+
+		if a := r.URL.Query().Get("after"); a != "" {
+			var err error
+
+			if after, err = strconv.ParseInt(a, 10, 64); err != nil {
+				http.Error(w, "after must be a message timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+
+			if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxThreadPageSize {
+				http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxThreadPageSize), http.StatusBadRequest)
+				return
+			}
+		}
+
+		root, err := h.Repo.Fetch(chatID, msgID)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if root == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		// fetching one more reply than asked for tells whether there is another page
+		replies, err := tr.FetchThread(chatID, msgID, after, limit+1)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res := &thread{Root: root, Replies: replies}
+
+		if len(replies) > limit {
+			res.Replies = replies[:limit]
+			res.Next = replies[limit-1].Timestamp
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Printf("error: could not write thread %s: %v", msgID, err)
+		}
+	})
+}
+
+// handleGetUnread handles all GET requests to /unread
+// It responds with the number of messages the authenticated user has not read in every room they have read and can still read, as json keyed by chatID.
+// Anonymous clients have no unread counts and are unauthorized. The user query parameter can be left out,
+// if it is passed it must name the authenticated user.
+func (h *Handler) handleGetUnread() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr, ok := h.Repo.(racer.ReceiptRepo)
+
+		if !ok {
+			http.Error(w, "read receipts are not supported", http.StatusNotImplemented)
+			return
+		}
+
+		identity, err := h.identify(r)
+
+		if err != nil || identity.Anonymous() {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		user := identity.SenderID
+
+		if u := r.URL.Query().Get("user"); u != "" {
+			requested, err := strconv.Atoi(u)
+
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError) 
+				http.Error(w, "user must be a sender id", http.StatusBadRequest)
+				return
+			}
+
+			if requested != user {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 				return
 			}
+		}
+
+		counts, err := rr.Unread(user)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			backupper := racer.NewBackupper(chatID, h.Repo)
-			
-			c := racer.NewClient(t, conn, backupper)
-			c.Run()
-		})
+		for chatID := range counts {
+			if !identity.Can(chatID, racer.ScopeRead) {
+				delete(counts, chatID)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(counts); err != nil {
+			log.Printf("error: could not write unread counts for %d: %v", user, err)
+		}
 	})
 }
 
@@ -3,9 +3,15 @@ package http
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,24 +19,123 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/tinylttl/racer"
 	"github.com/tinylttl/racer/broker"
+	"github.com/tinylttl/racer/gorilla"
 )
 
-// type testrepo struct {}
+// testrepo is an in memory racer.MessageRepo
+type testrepo struct {
+	mu     sync.Mutex
+	msgs   map[string][]*racer.Message
+	unread map[int]map[string]int // returned by Unread for each sender
+}
+
+func newTestRepo() *testrepo {
+	return &testrepo{msgs: make(map[string][]*racer.Message)}
+}
 
-// func (tr *testrepo) FetchX() {}
+func (tr *testrepo) Fetch(ID string, msgID string) (*racer.Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
 
+	for _, msg := range tr.msgs[ID] {
+		if msg.ID == msgID {
+			return msg, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (tr *testrepo) FetchX(ID string, x int) ([]*racer.Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	msgs := tr.msgs[ID]
+	if len(msgs) > x {
+		msgs = msgs[len(msgs)-x:]
+	}
+
+	res := make([]*racer.Message, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		res = append(res, msgs[i])
+	}
+
+	return res, nil
+}
+
+func (tr *testrepo) FetchSince(ID string, seq uint64, x int) ([]*racer.Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	res := make([]*racer.Message, 0)
+	for _, msg := range tr.msgs[ID] {
+		if msg.Seq > seq {
+			res = append(res, msg)
+		}
+	}
+
+	if len(res) > x {
+		res = res[len(res)-x:]
+	}
+
+	return res, nil
+}
+
+func (tr *testrepo) Put(ID string, msgs ...*racer.Message) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.msgs[ID] = append(tr.msgs[ID], msgs...)
+
+	return nil
+}
+
+func (tr *testrepo) FetchThread(ID string, rootID string, after int64, x int) ([]*racer.Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	res := make([]*racer.Message, 0)
+	for _, msg := range tr.msgs[ID] {
+		if msg.ParentID == rootID && msg.Replies() && msg.Timestamp > after && len(res) < x {
+			res = append(res, msg)
+		}
+	}
+
+	return res, nil
+}
+
+func (tr *testrepo) Unread(senderID int) (map[string]int, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return tr.unread[senderID], nil
+}
+
+// size returns the number of messages stored under ID
+func (tr *testrepo) size(ID string) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return len(tr.msgs[ID])
+}
 
 func TestHandleGetTopic(t *testing.T) {
 	t.Run("It creates a new broker for each new chatID", func(t *testing.T) {
 		manager := broker.NewBroker()
-		handler := NewHandler()
+		handler := NewHandler(newTestRepo())
 
-		d := NewDialer(handler.handleGetTopic(manager), [][]string{{"chatID", "23"}})
-		d2 := NewDialer(handler.handleGetTopic(manager), [][]string{{"chatID", "24"}})
+		d := NewDialer(handler.handleGetTopic(handler.newRooms(manager)), [][]string{{"chatID", "23"}})
+		d2 := NewDialer(handler.handleGetTopic(handler.newRooms(manager)), [][]string{{"chatID", "24"}})
 		_, _, _ = d.Dial("ws://racer/chat/23", nil)
 		_, _, _ = d2.Dial("ws://racer/chat/24", nil)
 
+		// clients subscribe once the handshake is complete, give them a moment to do so
 		want := 2
+		deadline := time.Now().Add(time.Second)
+		for manager.Size() < want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
 		if got := manager.Size(); got != want {
 			t.Fatalf("got %d want %d", got, want)
 		}
@@ -38,9 +143,9 @@ func TestHandleGetTopic(t *testing.T) {
 
 	t.Run("It removes brokers when they have no clients", func(t *testing.T) {
 		manager := broker.NewBroker()
-		handler := NewHandler()
-		d := NewDialer(handler.handleGetTopic(manager), [][]string{{"chatID", "23"}})
-		d2 := NewDialer(handler.handleGetTopic(manager), [][]string{{"chatID", "24"}})
+		handler := NewHandler(newTestRepo())
+		d := NewDialer(handler.handleGetTopic(handler.newRooms(manager)), [][]string{{"chatID", "23"}})
+		d2 := NewDialer(handler.handleGetTopic(handler.newRooms(manager)), [][]string{{"chatID", "24"}})
 
 		done := make(chan struct{})
 
@@ -84,8 +189,8 @@ func TestHandleGetTopic_SocketConn(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			manager := broker.NewBroker()
-			handler := NewHandler()
-			d := NewDialer(handler.handleGetTopic(manager), [][]string{{"chatID", "23"}})
+			handler := NewHandler(newTestRepo())
+			d := NewDialer(handler.handleGetTopic(handler.newRooms(manager)), [][]string{{"chatID", "23"}})
 
 			conn, _, err := d.Dial("ws://racer/chat/23", nil)
 
@@ -104,6 +209,804 @@ func TestHandleGetTopic_SocketConn(t *testing.T) {
 	}
 }
 
+func TestNewHandler_ConnOptions(t *testing.T) {
+	t.Run("It applies connection options to every upgrade", func(t *testing.T) {
+		handler := NewHandler(newTestRepo(), WithConnOptions(gorilla.WithAllowedOrigins("https://racer.chat")))
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+
+		url := chatURL(srv, "23")
+
+		_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.com"}})
+		if err == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("got: %v, want the upgrade to be forbidden", err)
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://racer.chat"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+}
+
+func TestNewHandler_Authenticator(t *testing.T) {
+	auth := func(r *http.Request) (racer.Identity, error) {
+		id, err := strconv.Atoi(r.Header.Get("X-User"))
+		if err != nil {
+			return racer.Identity{}, err
+		}
+
+		return racer.Identity{SenderID: id}, nil
+	}
+
+	srv := httptest.NewServer(NewHandler(newTestRepo(), WithAuthenticator(auth)))
+	defer srv.Close()
+
+	t.Run("It rejects requests the authenticator does not accept", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(chatURL(srv, "23"), nil)
+		if err == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got: %v, want the upgrade to be unauthorized", err)
+		}
+	})
+
+	t.Run("It stamps the authenticated identity onto every message", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(chatURL(srv, "23"), http.Header{"X-User": {"7"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(&racer.Message{Body: "hi", SenderID: 99})
+
+		for {
+			msg := &racer.Message{}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if err := conn.ReadJSON(msg); err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.Body != "hi" {
+				continue
+			}
+
+			if msg.SenderID != 7 {
+				t.Fatalf("got: %d, want: %d", msg.SenderID, 7)
+			}
+			return
+		}
+	})
+}
+
+func TestHandleGetTopic_Compression(t *testing.T) {
+	t.Run("It lets compressed and uncompressed clients share a room", func(t *testing.T) {
+		srv := httptest.NewServer(NewHandler(newTestRepo()))
+		defer srv.Close()
+
+		compressed := &websocket.Dialer{EnableCompression: true}
+		conn1, resp, err := compressed.Dial(chatURL(srv, "23"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn1.Close()
+
+		if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+			t.Fatalf("got extensions: %q, want permessage-deflate to be negotiated", ext)
+		}
+
+		conn2, resp, err := websocket.DefaultDialer.Dial(chatURL(srv, "23"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn2.Close()
+
+		if ext := resp.Header.Get("Sec-Websocket-Extensions"); ext != "" {
+			t.Fatalf("got extensions: %q, want none", ext)
+		}
+
+		// one body is above the compression threshold and one below it
+		bodies := []string{strings.Repeat("racer ", 60), "small"}
+		for i, body := range bodies {
+			sender := []*websocket.Conn{conn1, conn2}[i%2]
+
+			if err := sender.WriteJSON(&racer.Message{Body: body}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, conn := range []*websocket.Conn{conn1, conn2} {
+				var got racer.Message
+
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if err := conn.ReadJSON(&got); err != nil {
+					t.Fatal(err)
+				}
+
+				if got.Body != body {
+					t.Fatalf("got: %q, want: %q", got.Body, body)
+				}
+			}
+		}
+	})
+}
+
+func TestHandleGetTopic_Protocols(t *testing.T) {
+	t.Run("It lets racer.v1 and legacy clients share a room", func(t *testing.T) {
+		repo := newTestRepo()
+		repo.Put("23", &racer.Message{ID: "old", Body: "before"})
+
+		srv := httptest.NewServer(NewHandler(repo))
+		defer srv.Close()
+
+		d := &websocket.Dialer{Subprotocols: []string{gorilla.SubprotocolV1}}
+		v1, _, err := d.Dial(chatURL(srv, "23"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v1.Close()
+
+		var env struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		readEnv := func(want string) {
+			v1.SetReadDeadline(time.Now().Add(time.Second))
+			if err := v1.ReadJSON(&env); err != nil {
+				t.Fatal(err)
+			}
+
+			if env.Type != want {
+				t.Fatalf("got frame: %q, want: %q", env.Type, want)
+			}
+		}
+
+		readEnv(gorilla.FrameHistory)
+
+		var history []racer.Message
+		json.Unmarshal(env.Data, &history)
+
+		if len(history) != 1 || history[0].ID != "old" {
+			t.Fatalf("got history: %+v, want the stored message", history)
+		}
+
+		readEnv(gorilla.FramePresence) // v1 joining
+
+		legacy, _, err := websocket.DefaultDialer.Dial(chatURL(srv, "23"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer legacy.Close()
+
+		readEnv(gorilla.FramePresence) // legacy joining
+
+		legacy.WriteJSON(&racer.Message{Body: "from legacy"})
+		readEnv(gorilla.FrameChat)
+
+		var got racer.Message
+		json.Unmarshal(env.Data, &got)
+
+		if got.Body != "from legacy" {
+			t.Fatalf("got: %q, want: %q", got.Body, "from legacy")
+		}
+
+		v1.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "from v1"}})
+
+		// the legacy client skips the presence messages and only sees bare chat messages
+		for _, want := range []string{"from legacy", "from v1"} {
+			legacy.SetReadDeadline(time.Now().Add(time.Second))
+			if err := legacy.ReadJSON(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Body != want {
+				t.Fatalf("got: %q, want: %q", got.Body, want)
+			}
+		}
+	})
+}
+
+func TestHandleGetTopic_Codecs(t *testing.T) {
+	t.Run("It lets json and binary clients chat in the same room", func(t *testing.T) {
+		srv := httptest.NewServer(NewHandler(newTestRepo()))
+		defer srv.Close()
+
+		clients := []*codecClient{
+			dialCodec(t, srv, gorilla.SubprotocolV1, gorilla.JSON),
+			dialCodec(t, srv, gorilla.SubprotocolV1MsgPack, gorilla.MsgPack),
+			dialCodec(t, srv, gorilla.SubprotocolV1CBOR, gorilla.CBOR),
+		}
+
+		for _, c := range clients {
+			defer c.conn.Close()
+		}
+
+		for i, sender := range clients {
+			body := fmt.Sprintf("from client %d", i)
+			sender.send(t, &racer.Message{Body: body})
+
+			for _, c := range clients {
+				if got := c.nextChat(t); got.Body != body {
+					t.Fatalf("got: %q, want: %q", got.Body, body)
+				}
+			}
+		}
+	})
+}
+
+// codecClient is a racer.v1 client whose frames are encoded with codec
+type codecClient struct {
+	conn  *websocket.Conn
+	codec gorilla.Codec
+}
+
+func dialCodec(t *testing.T, srv *httptest.Server, subprotocol string, codec gorilla.Codec) *codecClient {
+	d := &websocket.Dialer{Subprotocols: []string{subprotocol}}
+	conn, resp, err := d.Dial(chatURL(srv, "23"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := resp.Header.Get("Sec-Websocket-Protocol"); got != subprotocol {
+		t.Fatalf("got subprotocol: %q, want: %q", got, subprotocol)
+	}
+
+	return &codecClient{conn: conn, codec: codec}
+}
+
+func (c *codecClient) send(t *testing.T, msg *racer.Message) {
+	data, err := c.codec.Marshal(&gorilla.Envelope{Type: gorilla.FrameChat, Data: msg})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.conn.WriteMessage(c.codec.MessageType(), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextChat skips frames until it reads a chat frame and returns its message
+func (c *codecClient) nextChat(t *testing.T) *racer.Message {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		typ, data, err := c.conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if typ != c.codec.MessageType() {
+			t.Fatalf("got message type: %d, want: %d", typ, c.codec.MessageType())
+		}
+
+		var frame struct {
+			Type string `json:"type"`
+		}
+
+		if err := c.codec.Unmarshal(data, &frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Type != gorilla.FrameChat {
+			continue
+		}
+
+		var chat struct {
+			Data *racer.Message `json:"data"`
+		}
+
+		if err := c.codec.Unmarshal(data, &chat); err != nil {
+			t.Fatal(err)
+		}
+
+		return chat.Data
+	}
+}
+
+func TestHandleGetMux(t *testing.T) {
+	t.Run("It multiplexes many rooms over one connection", func(t *testing.T) {
+		srv := httptest.NewServer(NewHandler(newTestRepo()))
+		defer srv.Close()
+
+		d := &websocket.Dialer{Subprotocols: []string{gorilla.SubprotocolV1}}
+		mux, _, err := d.Dial(muxURL(srv), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mux.Close()
+
+		for _, room := range []string{"a", "b"} {
+			mux.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameSubscribe, ID: "sub-" + room, Room: room})
+
+			if ack := nextFrame(t, mux, gorilla.FrameAck); ack.ID != "sub-"+room || ack.Room != room {
+				t.Fatalf("got ack: %+v, want one for room %s", ack, room)
+			}
+
+			if history := nextFrame(t, mux, gorilla.FrameHistory); history.Room != room {
+				t.Fatalf("got history for: %q, want: %q", history.Room, room)
+			}
+		}
+
+		a, _, err := d.Dial(chatURL(srv, "a"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+
+		b, _, err := d.Dial(chatURL(srv, "b"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		// messages from either room are tagged with the room they were sent to
+		a.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "in a"}})
+		if got := nextFrame(t, mux, gorilla.FrameChat); got.Room != "a" || got.message(t).Body != "in a" {
+			t.Fatalf("got: %+v, want the message sent to a", got)
+		}
+
+		b.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "in b"}})
+		if got := nextFrame(t, mux, gorilla.FrameChat); got.Room != "b" || got.message(t).Body != "in b" {
+			t.Fatalf("got: %+v, want the message sent to b", got)
+		}
+
+		// the mux client chooses the room each message is sent to
+		mux.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Room: "b", Data: &racer.Message{Body: "mux to b"}})
+		if got := nextFrame(t, b, gorilla.FrameChat); got.message(t).Body != "in b" {
+			t.Fatalf("got: %q, want: %q", got.message(t).Body, "in b")
+		}
+		if got := nextFrame(t, b, gorilla.FrameChat); got.message(t).Body != "mux to b" {
+			t.Fatalf("got: %q, want: %q", got.message(t).Body, "mux to b")
+		}
+		if got := nextFrame(t, mux, gorilla.FrameChat); got.message(t).Body != "mux to b" {
+			t.Fatalf("got: %q, want: %q", got.message(t).Body, "mux to b")
+		}
+
+		// once unsubscribed nothing more is recieved from a room
+		mux.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameUnsubscribe, Room: "a"})
+		nextFrame(t, mux, gorilla.FrameAck)
+
+		// the ack only means the frame was recieved, wait for the room to hear that the mux client left
+		for nextFrame(t, a, gorilla.FramePresence).message(t).Body != racer.PresenceLeave {
+		}
+
+		a.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "a again"}})
+		b.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "b again"}})
+
+		if got := nextFrame(t, mux, gorilla.FrameChat); got.Room != "b" || got.message(t).Body != "b again" {
+			t.Fatalf("got: %+v, want only the message sent to b", got)
+		}
+	})
+
+	t.Run("It disconnects legacy clients with a policy violation", func(t *testing.T) {
+		srv := httptest.NewServer(NewHandler(newTestRepo()))
+		defer srv.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial(muxURL(srv), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, gorilla.ClosePolicy) {
+			t.Fatalf("got: %v, want the connection to be closed with %d", err, gorilla.ClosePolicy)
+		}
+	})
+}
+
+// frame is an Envelope as decoded by a json client
+type frame struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id"`
+	Room string          `json:"room"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (f frame) message(t *testing.T) *racer.Message {
+	msg := &racer.Message{}
+
+	if err := json.Unmarshal(f.Data, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+// nextFrame skips frames until it reads one of the wanted type
+func nextFrame(t *testing.T, conn *websocket.Conn, want string) frame {
+	for {
+		var f frame
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatalf("waiting for %s frame: %v", want, err)
+		}
+
+		if f.Type == want {
+			return f
+		}
+	}
+}
+
+// muxURL returns the websocket url of the multiplexed chat endpoint on srv
+func muxURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/v" + apiVersion + "/chat"
+}
+
+func TestHandleGetTopic_Persistence(t *testing.T) {
+	t.Run("It stores every message sent over a connection as a distinct message", func(t *testing.T) {
+		repo := newTestRepo()
+		manager := broker.NewBroker()
+		handler := NewHandler(repo)
+		d := NewDialer(handler.handleGetTopic(handler.newRooms(manager)), [][]string{{"chatID", "23"}})
+
+		conn, _, err := d.Dial("ws://racer/chat/23", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bodies := []string{"1", "2", "3"}
+		for _, body := range bodies {
+			// the client supplied timestamp should be ignored by the server
+			if err := conn.WriteJSON(&racer.Message{Body: body, Timestamp: 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			// wait for the echo so we know the message made it through the topic
+			var echo racer.Message
+			if err := conn.ReadJSON(&echo); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		conn.Close()
+
+		// closing the connection causes the clients backupper to flush
+		deadline := time.Now().Add(time.Second)
+		for repo.size("23") < len(bodies) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		got, _ := repo.FetchX("23", len(bodies))
+
+		if len(got) != len(bodies) {
+			t.Fatalf("got: %d messages, want: %d", len(got), len(bodies))
+		}
+
+		ids := make(map[string]bool)
+		stamps := make(map[int64]bool)
+		for i, msg := range got {
+			if want := bodies[len(bodies)-1-i]; msg.Body != want {
+				t.Fatalf("got: %s, want: %s", msg.Body, want)
+			}
+
+			if msg.Timestamp == 1 {
+				t.Fatalf("client supplied timestamp was not overwritten")
+			}
+
+			ids[msg.ID] = true
+			stamps[msg.Timestamp] = true
+		}
+
+		if len(ids) != len(bodies) || len(stamps) != len(bodies) {
+			t.Fatalf("got: %d ids and %d timestamps, want: %d of each", len(ids), len(stamps), len(bodies))
+		}
+	})
+}
+
+func TestHandleGetTopic_RoomRecorder(t *testing.T) {
+	t.Run("It stores the messages of every client once, in the order the room broadcast them", func(t *testing.T) {
+		repo := newTestRepo()
+		srv := httptest.NewServer(NewHandler(repo))
+		defer srv.Close()
+
+		d := &websocket.Dialer{Subprotocols: []string{gorilla.SubprotocolV1}}
+
+		a, _, err := d.Dial(chatURL(srv, "23"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _, err := d.Dial(chatURL(srv, "23"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 5; i++ {
+			a.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "a"}})
+			b.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: "b"}})
+		}
+
+		// wait for a to see all ten messages so every one of them has been broadcast
+		for i := 0; i < 10; i++ {
+			nextFrame(t, a, gorilla.FrameChat)
+		}
+
+		a.Close()
+		b.Close()
+
+		// the room is only backed up once it stops
+		deadline := time.Now().Add(time.Second)
+		for repo.size("23") < 10 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		got, _ := repo.FetchX("23", 20)
+
+		if len(got) != 10 {
+			t.Fatalf("got: %d messages, want: %d", len(got), 10)
+		}
+
+		// FetchX is newest first
+		for i := 1; i < len(got); i++ {
+			if got[i].Seq >= got[i-1].Seq {
+				t.Fatalf("got: seq %d stored after %d, want the order they were broadcast", got[i-1].Seq, got[i].Seq)
+			}
+		}
+	})
+}
+
+func TestHandleGetTopic_Resume(t *testing.T) {
+	d := &websocket.Dialer{Subprotocols: []string{gorilla.SubprotocolV1}}
+
+	dial := func(t *testing.T, url string) *websocket.Conn {
+		conn, _, err := d.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn
+	}
+
+	send := func(t *testing.T, conn *websocket.Conn, body string) *racer.Message {
+		conn.WriteJSON(&gorilla.Envelope{Type: gorilla.FrameChat, Data: &racer.Message{Body: body}})
+
+		return nextFrame(t, conn, gorilla.FrameChat).message(t)
+	}
+
+	// replayed checks that the history frame sent on resuming holds exactly the wanted bodies, in order
+	replayed := func(t *testing.T, conn *websocket.Conn, want ...string) {
+		var got []*racer.Message
+
+		if err := json.Unmarshal(nextFrame(t, conn, gorilla.FrameHistory).Data, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("got: %d messages, want: %d", len(got), len(want))
+		}
+
+		for i, msg := range got {
+			if msg.Body != want[i] {
+				t.Fatalf("got: %s, want: %s", msg.Body, want[i])
+			}
+		}
+	}
+
+	t.Run("It replays messages missed while the room was running", func(t *testing.T) {
+		srv := httptest.NewServer(NewHandler(newTestRepo()))
+		defer srv.Close()
+
+		other := dial(t, chatURL(srv, "23"))
+		defer other.Close()
+
+		conn := dial(t, chatURL(srv, "23"))
+		last := send(t, conn, "1")
+		conn.Close()
+
+		for nextFrame(t, other, gorilla.FramePresence).message(t).Body != racer.PresenceLeave {
+		}
+
+		send(t, other, "2")
+		send(t, other, "3")
+
+		conn = dial(t, chatURL(srv, "23")+"?since="+strconv.FormatUint(last.Seq, 10))
+		defer conn.Close()
+
+		replayed(t, conn, "2", "3")
+	})
+
+	t.Run("It replays messages from the repo once the room has stopped", func(t *testing.T) {
+		repo := newTestRepo()
+		srv := httptest.NewServer(NewHandler(repo))
+		defer srv.Close()
+
+		conn := dial(t, chatURL(srv, "23"))
+		last := send(t, conn, "1")
+		send(t, conn, "2")
+		send(t, conn, "3")
+		conn.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for repo.size("23") < 3 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		conn = dial(t, chatURL(srv, "23")+"?since="+strconv.FormatUint(last.Seq, 10))
+		defer conn.Close()
+
+		replayed(t, conn, "2", "3")
+
+		// the restarted room carries on counting from the last stored message
+		if got := send(t, conn, "4"); got.Seq <= last.Seq+2 {
+			t.Fatalf("got: %d, want a seq after %d", got.Seq, last.Seq+2)
+		}
+	})
+
+	t.Run("It rejects a malformed seq", func(t *testing.T) {
+		srv := httptest.NewServer(NewHandler(newTestRepo()))
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL + "/v" + apiVersion + "/chat/23?since=abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("got: %d, want: %d", res.StatusCode, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestHandler_ChatID(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(newTestRepo()))
+	defer srv.Close()
+
+	cases := []struct {
+		name string
+		url  string
+	}{
+		{name: "It rejects connections to a room no message could name", url: chatURL(srv, "%00keys")},
+		{name: "It rejects chatIDs that are too long", url: chatURL(srv, strings.Repeat("a", 129))},
+		{name: "It rejects threads of a room no message could name", url: chatURL(srv, "%00keys/threads/a")},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, res, err := websocket.DefaultDialer.Dial(tc.url, nil)
+			if err == nil {
+				conn.Close()
+			}
+
+			if res == nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("got: %d, want: %d", res.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestHandleGetThread(t *testing.T) {
+	repo := newTestRepo()
+	repo.Put("23", &racer.Message{ID: "a", Type: racer.TypeText, Timestamp: 1})
+
+	for i := int64(2); i <= 6; i++ {
+		repo.Put("23", &racer.Message{ID: strconv.FormatInt(i, 10), Type: racer.TypeText, ParentID: "a", Timestamp: i})
+	}
+
+	srv := httptest.NewServer(NewHandler(repo))
+	defer srv.Close()
+
+	cases := []struct {
+		name        string
+		query       string
+		wantStatus  int
+		wantReplies []string
+		wantNext    int64
+	}{
+		{name: "It responds with the first page of a thread", query: "a?limit=2", wantStatus: http.StatusOK, wantReplies: []string{"2", "3"}, wantNext: 3},
+		{name: "It responds with the page after a reply", query: "a?limit=2&after=3", wantStatus: http.StatusOK, wantReplies: []string{"4", "5"}, wantNext: 5},
+		{name: "It leaves next off of the last page", query: "a?limit=2&after=5", wantStatus: http.StatusOK, wantReplies: []string{"6"}},
+		{name: "It responds with not found for an unknown message", query: "b", wantStatus: http.StatusNotFound},
+		{name: "It rejects a limit that is too large", query: "a?limit=10000", wantStatus: http.StatusBadRequest},
+		{name: "It rejects a malformed timestamp", query: "a?after=abc", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/v" + apiVersion + "/chat/23/threads/" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.wantStatus {
+				t.Fatalf("got: %d, want: %d", res.StatusCode, tc.wantStatus)
+			}
+
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			got := &thread{}
+			if err := json.NewDecoder(res.Body).Decode(got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Root.ID != "a" || got.Next != tc.wantNext || len(got.Replies) != len(tc.wantReplies) {
+				t.Fatalf("got: %+v, want: replies %v, next %d", got, tc.wantReplies, tc.wantNext)
+			}
+
+			for i, msg := range got.Replies {
+				if msg.ID != tc.wantReplies[i] {
+					t.Fatalf("got: %s, want: %s", msg.ID, tc.wantReplies[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHandleGetUnread(t *testing.T) {
+	repo := newTestRepo()
+	repo.unread = map[int]map[string]int{7: {"23": 2, "24": 0}}
+
+	// a request without a user is anonymous
+	auth := func(r *http.Request) (racer.Identity, error) {
+		id, _ := strconv.Atoi(r.Header.Get("X-User"))
+		return racer.Identity{SenderID: id}, nil
+	}
+
+	srv := httptest.NewServer(NewHandler(repo, WithAuthenticator(auth)))
+	defer srv.Close()
+
+	cases := []struct {
+		name       string
+		user       string
+		query      string
+		wantStatus int
+		want       map[string]int
+	}{
+		{name: "It responds with the unread counts of the authenticated user", user: "7", wantStatus: http.StatusOK, want: map[string]int{"23": 2, "24": 0}},
+		{name: "It accepts a user naming the authenticated user", user: "7", query: "?user=7", wantStatus: http.StatusOK, want: map[string]int{"23": 2, "24": 0}},
+		{name: "It forbids asking for the counts of another user", user: "8", query: "?user=7", wantStatus: http.StatusForbidden},
+		{name: "It rejects anonymous requests whatever user they name", query: "?user=7", wantStatus: http.StatusUnauthorized},
+		{name: "It rejects a malformed user", user: "7", query: "?user=abc", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v"+apiVersion+"/unread"+tc.query, nil)
+			req.Header.Set("X-User", tc.user)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.wantStatus {
+				t.Fatalf("got: %d, want: %d", res.StatusCode, tc.wantStatus)
+			}
+
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			got := map[string]int{}
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// chatURL returns the websocket url of the chat identified by chatID on srv
+func chatURL(srv *httptest.Server, chatID string) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/v" + apiVersion + "/chat/" + chatID
+}
+
 // borrowed and modified from https://github.com/posener/wstest
 func newRecorder(r httptest.ResponseRecorder) *recorder {
 	_, server := net.Pipe()
@@ -0,0 +1,598 @@
+package http
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSessionTTL is how long the session token minted for a user who logs in is valid for
+	DefaultSessionTTL = 24 * time.Hour
+
+	// loginTimeout is how long a user has to finish logging in with the provider
+	loginTimeout = 10 * time.Minute
+
+	// maxLogins is the most logins that can be waiting on the provider at once
+	maxLogins = 10000
+
+	// loginCookie holds the state of the login the browser started, so a callback can only finish a login started by the same browser
+	loginCookie = "racer_login"
+)
+
+// OIDC logs users in with an OpenID Connect provider as a relying party, using the authorization code flow with PKCE.
+// Once the provider has vouched for a user OIDC mints them a racer session token signed by its TokenAuth,
+// which it sets as the TokenAuths cookie so browsers pass it along when they connect.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string // empty for public clients
+	redirectURL  string // the callback the provider sends users back to, must be registered with the provider
+	scopes       []string
+	auth         *TokenAuth
+	client       *http.Client
+	sessionTTL   time.Duration
+	landing      string // where users are sent once logged in, empty to respond with the token as json
+	senderID     func(claims map[string]interface{}) (int, error)
+	now          func() time.Time
+
+	mu        sync.Mutex
+	provider  *provider                 // discovered the first time a user logs in
+	keys      map[string]*rsa.PublicKey // the providers signing keys by kid
+	logins    map[string]*login         // logins waiting on the provider by state
+	maxLogins int
+}
+
+// provider is the configuration an OpenID Connect provider publishes at its discovery endpoint
+type provider struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// login is a login waiting for the provider to send the user back
+type login struct {
+	nonce    string
+	verifier string // the PKCE code verifier
+	expires  time.Time
+}
+
+// NewOIDC returns an OIDC that logs users in with the provider at issuer as the client clientID,
+// and mints session tokens with auth. It can take a variadic number of functional options.
+func NewOIDC(issuer, clientID, redirectURL string, auth *TokenAuth, opts ...func(*OIDC)) *OIDC {
+	o := &OIDC{
+		issuer:      strings.TrimSuffix(issuer, "/"),
+		clientID:    clientID,
+		redirectURL: redirectURL,
+		scopes:      []string{"openid", "profile", "email"},
+		auth:        auth,
+		client:      http.DefaultClient,
+		sessionTTL:  DefaultSessionTTL,
+		senderID:    hashSubject,
+		now:         time.Now,
+		keys:        make(map[string]*rsa.PublicKey),
+		logins:      make(map[string]*login),
+		maxLogins:   maxLogins,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithClientSecret sets the secret of a confidential client, it is sent when exchanging codes for tokens. Use with NewOIDC()
+func WithClientSecret(secret string) func(*OIDC) {
+	return func(o *OIDC) {
+		o.clientSecret = secret
+	}
+}
+
+// WithScopes sets the scopes requested from the provider, openid is always requested. Use with NewOIDC()
+func WithScopes(scopes ...string) func(*OIDC) {
+	return func(o *OIDC) {
+		o.scopes = append([]string{"openid"}, scopes...)
+	}
+}
+
+// WithHTTPClient sets the client used to talk to the provider. Use with NewOIDC()
+func WithHTTPClient(c *http.Client) func(*OIDC) {
+	return func(o *OIDC) {
+		o.client = c
+	}
+}
+
+// WithSessionTTL sets how long the session tokens minted for users who log in are valid for. Use with NewOIDC()
+func WithSessionTTL(ttl time.Duration) func(*OIDC) {
+	return func(o *OIDC) {
+		o.sessionTTL = ttl
+	}
+}
+
+// WithLanding sets the url users are redirected to once logged in,
+// without it the callback responds with the session token as json. Use with NewOIDC()
+func WithLanding(url string) func(*OIDC) {
+	return func(o *OIDC) {
+		o.landing = url
+	}
+}
+
+// WithSenderIDs sets the func that maps the verified claims of an ID token to the sender ID of the user.
+// Without it the sender ID is a hash of the issuer and subject of the token. Use with NewOIDC()
+func WithSenderIDs(senderID func(claims map[string]interface{}) (int, error)) func(*OIDC) {
+	return func(o *OIDC) {
+		o.senderID = senderID
+	}
+}
+
+// hashSubject returns a sender ID derived from the issuer and subject of claims,
+// kept within the 53 bits javascript clients can represent exactly.
+func hashSubject(claims map[string]interface{}) (int, error) {
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+
+	if sub == "" {
+		return 0, errors.New("id token has no subject")
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(iss + "\x00" + sub))
+
+	if id := int(h.Sum64() & (1<<53 - 1)); id != 0 {
+		return id, nil
+	}
+
+	return 1, nil
+}
+
+// HandleLogin redirects the user to the provider to log in. The state of the login is set as an http only cookie
+// the callback checks, which stops anyone else finishing their own login in the users browser.
+// Only so many logins can wait on the provider at once, once they are all taken logging in is unavailable until some finish or expire.
+func (o *OIDC) HandleLogin() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := o.discover()
+
+		if err != nil {
+			log.Printf("error: oidc: %v", err)
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+
+		state, nonce, verifier := randomString(), randomString(), randomString()
+		challenge := sha256.Sum256([]byte(verifier))
+
+		if !o.start(state, &login{nonce: nonce, verifier: verifier}) {
+			http.Error(w, "too many logins in progress, try again later", http.StatusServiceUnavailable)
+			return
+		}
+
+		http.SetCookie(w, o.loginCookie(r, state, int(loginTimeout/time.Second)))
+
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {o.clientID},
+			"redirect_uri":          {o.redirectURL},
+			"scope":                 {strings.Join(o.scopes, " ")},
+			"state":                 {state},
+			"nonce":                 {nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+
+		sep := "?"
+		if strings.Contains(p.AuthEndpoint, "?") {
+			sep = "&"
+		}
+
+		http.Redirect(w, r, p.AuthEndpoint+sep+q.Encode(), http.StatusFound)
+	})
+}
+
+// HandleCallback handles the provider sending the user back. It exchanges the code it was sent for an ID token,
+// verifies it and mints the user a session token.
+func (o *OIDC) HandleCallback() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		if e := q.Get("error"); e != "" {
+			http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+			return
+		}
+
+		state := q.Get("state")
+
+		if c, err := r.Cookie(loginCookie); err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+			http.Error(w, "login was not started by this browser", http.StatusBadRequest)
+			return
+		}
+
+		http.SetCookie(w, o.loginCookie(r, "", -1))
+
+		o.mu.Lock()
+		l, ok := o.logins[state]
+		delete(o.logins, state)
+		o.mu.Unlock()
+
+		if !ok || o.now().After(l.expires) {
+			http.Error(w, "unknown or expired login", http.StatusBadRequest)
+			return
+		}
+
+		claims, err := o.exchange(q.Get("code"), l)
+
+		if err != nil {
+			log.Printf("error: oidc: %v", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		token, err := o.mint(claims)
+
+		if err != nil {
+			log.Printf("error: oidc: %v", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if o.auth.cookie != "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:     o.auth.cookie,
+				Value:    token,
+				Path:     "/",
+				MaxAge:   int(o.sessionTTL / time.Second),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		if o.landing != "" {
+			http.Redirect(w, r, o.landing, http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"token": token}); err != nil {
+			log.Printf("error: oidc: could not write token: %v", err)
+		}
+	})
+}
+
+// start records the login l waiting on the provider under state, pruning expired logins first.
+// It reports false if too many logins are already waiting.
+func (o *OIDC) start(state string, l *login) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+
+	for s, l := range o.logins {
+		if now.After(l.expires) {
+			delete(o.logins, s)
+		}
+	}
+
+	if len(o.logins) >= o.maxLogins {
+		return false
+	}
+
+	l.expires = now.Add(loginTimeout)
+	o.logins[state] = l
+
+	return true
+}
+
+// loginCookie returns the cookie holding the state of the login the browser making r started, scoped to the callback.
+// The cookie is lax so browsers send it along when the provider redirects them back.
+func (o *OIDC) loginCookie(r *http.Request, state string, maxAge int) *http.Cookie {
+	path := "/"
+
+	if u, err := url.Parse(o.redirectURL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+
+	return &http.Cookie{
+		Name:     loginCookie,
+		Value:    state,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// mint returns a session token for the user the verified claims of an ID token belong to
+func (o *OIDC) mint(claims map[string]interface{}) (string, error) {
+	senderID, err := o.senderID(claims)
+
+	if err != nil {
+		return "", errors.Wrap(err, "could not map id token to a sender id")
+	}
+
+	now := o.now()
+	session := map[string]interface{}{
+		"sub": strconv.Itoa(senderID),
+		"iat": now.Unix(),
+		"exp": now.Add(o.sessionTTL).Unix(),
+		"idp": claims["iss"],
+		"uid": claims["sub"],
+	}
+
+	for _, c := range []string{"name", "email", "preferred_username"} {
+		if v, ok := claims[c]; ok {
+			session[c] = v
+		}
+	}
+
+	return o.auth.Sign(session)
+}
+
+// exchange swaps code for an ID token at the providers token endpoint, returning its verified claims
+func (o *OIDC) exchange(code string, l *login) (map[string]interface{}, error) {
+	p, err := o.discover()
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.redirectURL},
+		"client_id":     {o.clientID},
+		"code_verifier": {l.verifier},
+	}
+
+	if o.clientSecret != "" {
+		form.Set("client_secret", o.clientSecret)
+	}
+
+	resp, err := o.client.PostForm(p.TokenEndpoint, form)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not exchange code")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("could not exchange code: provider responded %s", resp.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, errors.Wrap(err, "could not decode token response")
+	}
+
+	claims, err := o.verify(tokens.IDToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims["nonce"] != l.nonce {
+		return nil, errors.Wrap(ErrInvalidToken, "id token nonce does not match the login")
+	}
+
+	return claims, nil
+}
+
+// verify checks the RS256 signature of an ID token against the providers keys, and that it was issued by the provider
+// for this client and has not expired, returning its claims.
+func (o *OIDC) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrInvalidToken, "id token must have three parts")
+	}
+
+	var h header
+
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "could not decode id token header")
+	}
+
+	if h.Alg != "RS256" {
+		return nil, errors.Wrapf(ErrInvalidToken, "unsupported id token algorithm %q", h.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "could not decode id token signature")
+	}
+
+	key, err := o.key(h.Kid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "id token signature does not verify")
+	}
+
+	var claims map[string]interface{}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "could not decode id token claims")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != o.issuer {
+		return nil, errors.Wrapf(ErrInvalidToken, "id token issued by %q", iss)
+	}
+
+	if !audience(claims["aud"], o.clientID) {
+		return nil, errors.Wrap(ErrInvalidToken, "id token was not issued to this client")
+	}
+
+	exp, ok, err := numericClaim(claims, "exp")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok || o.now().Unix() >= exp {
+		return nil, ErrExpiredToken
+	}
+
+	return claims, nil
+}
+
+// audience reports whether the aud claim of a token, a string or array of strings, holds clientID
+func audience(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// discover returns the configuration of the provider, fetching it from its discovery endpoint the first time
+func (o *OIDC) discover() (*provider, error) {
+	o.mu.Lock()
+	p := o.provider
+	o.mu.Unlock()
+
+	if p != nil {
+		return p, nil
+	}
+
+	p = &provider{}
+
+	if err := o.get(o.issuer+"/.well-known/openid-configuration", p); err != nil {
+		return nil, errors.Wrap(err, "could not discover provider")
+	}
+
+	if strings.TrimSuffix(p.Issuer, "/") != o.issuer {
+		return nil, errors.Errorf("provider claims to be %q, not %q", p.Issuer, o.issuer)
+	}
+
+	o.mu.Lock()
+	o.provider = p
+	o.mu.Unlock()
+
+	return p, nil
+}
+
+// key returns the providers signing key kid, refetching its keys if it is not known so keys the provider rotates in are picked up
+func (o *OIDC) key(kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	k, ok := o.keys[kid]
+	o.mu.Unlock()
+
+	if ok {
+		return k, nil
+	}
+
+	p, err := o.discover()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+
+	if err := o.get(p.JWKSURI, &set); err != nil {
+		return nil, errors.Wrap(err, "could not fetch provider keys")
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+
+		if err != nil {
+			continue
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+
+		if err != nil {
+			continue
+		}
+
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+
+	if k, ok = keys[kid]; !ok {
+		return nil, errors.Wrapf(ErrInvalidToken, "id token signed with unknown key %q", kid)
+	}
+
+	return k, nil
+}
+
+// get fetches the json document at url into v
+func (o *OIDC) get(url string, v interface{}) error {
+	resp, err := o.client.Get(url)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s responded %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// randomString returns 32 random bytes base64url encoded, used for states, nonces and PKCE verifiers
+func randomString() string {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,380 @@
+package http
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockProvider is an in-process OpenID Connect provider that logs every user in as sub without asking
+type mockProvider struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+	kid string
+
+	mu     sync.Mutex
+	sub    string
+	aud    string // the audience of the id tokens issued, the client that asked when empty
+	codes  map[string]url.Values
+	nonces map[string]string // overrides the nonce of the id token issued for a code
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockProvider{t: t, key: key, kid: "k1", sub: "alice", codes: make(map[string]url.Values), nonces: make(map[string]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("/token", p.handleToken)
+
+	p.Server = httptest.NewServer(mux)
+
+	return p
+}
+
+func (p *mockProvider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": p.kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+	}}})
+}
+
+// handleAuthorize sends the user straight back to the client with a code
+func (p *mockProvider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "pkce required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	p.mu.Lock()
+	p.codes[code] = q
+	p.mu.Unlock()
+
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+}
+
+// handleToken exchanges a code for an id token once the client proves it holds the PKCE verifier
+func (p *mockProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	p.mu.Lock()
+	auth, ok := p.codes[r.Form.Get("code")]
+	delete(p.codes, r.Form.Get("code"))
+	nonce, overridden := p.nonces[r.Form.Get("code")]
+	aud := p.aud
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.Get("code_challenge") {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	if !overridden {
+		nonce = auth.Get("nonce")
+	}
+
+	if aud == "" {
+		aud = auth.Get("client_id")
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(map[string]interface{}{
+		"iss":   p.URL,
+		"sub":   p.sub,
+		"aud":   aud,
+		"nonce": nonce,
+		"name":  "Alice",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	})})
+}
+
+// sign returns an RS256 id token holding claims
+func (p *mockProvider) sign(claims map[string]interface{}) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": p.kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// rotate replaces the providers signing key
+func (p *mockProvider) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	p.key, p.kid = key, kid
+	p.mu.Unlock()
+}
+
+// startLogin walks a user through the login flow of srv without following the redirect back to it,
+// returning the callback url the provider sent the user to and the browser that holds the login cookie.
+func startLogin(t *testing.T, srv *httptest.Server) (*url.URL, *http.Client) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Jar: jar, CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		if strings.HasPrefix(r.URL.String(), srv.URL) {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}}
+
+	resp, err := client.Get(srv.URL + "/v" + apiVersion + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusFound)
+	}
+
+	callback, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return callback, &http.Client{Jar: jar}
+}
+
+func TestOIDC(t *testing.T) {
+	idp := newMockProvider(t)
+	defer idp.Close()
+
+	auth := NewTokenAuth(WithSigningKey("k", []byte("secret")))
+
+	// the redirect url is only known once the server has started
+	var handler http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	handler = NewHandler(newTestRepo(), WithOIDC(NewOIDC(idp.URL, "racer", srv.URL+"/v"+apiVersion+"/login/callback", auth)))
+
+	t.Run("It mints a session token for users the provider vouches for", func(t *testing.T) {
+		callback, browser := startLogin(t, srv)
+
+		resp, err := browser.Get(callback.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusOK)
+		}
+
+		var cookie *http.Cookie
+		for _, c := range resp.Cookies() {
+			if c.Name == DefaultTokenCookie {
+				cookie = c
+			}
+		}
+
+		if cookie == nil || !cookie.HttpOnly {
+			t.Fatalf("got cookie: %v, want an http only session cookie", cookie)
+		}
+
+		r := httptest.NewRequest("GET", "/v1/chat", nil)
+		r.AddCookie(cookie)
+
+		identity, err := auth.Authenticate(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, _ := hashSubject(map[string]interface{}{"iss": idp.URL, "sub": "alice"})
+		if identity.SenderID != want {
+			t.Fatalf("got: %d, want: %d", identity.SenderID, want)
+		}
+
+		if identity.Claims["name"] != "Alice" {
+			t.Fatalf("got: %v, want: %v", identity.Claims["name"], "Alice")
+		}
+	})
+
+	t.Run("It picks up keys the provider rotates in", func(t *testing.T) {
+		idp.rotate("k2")
+
+		callback, browser := startLogin(t, srv)
+
+		resp, err := browser.Get(callback.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got: %d, want: %d", resp.StatusCode, http.StatusOK)
+		}
+	})
+
+	tcs := []struct {
+		name    string
+		tamper  func(callback *url.URL)
+		cleanup func()
+		other   bool // the callback is made by a browser that did not start the login
+		want    int
+	}{
+		{
+			name: "It rejects callbacks for logins it did not start",
+			tamper: func(callback *url.URL) {
+				q := callback.Query()
+				q.Set("state", "forged")
+				callback.RawQuery = q.Encode()
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:   "It rejects callbacks from a browser that did not start the login",
+			tamper: func(callback *url.URL) {},
+			other:  true,
+			want:   http.StatusBadRequest,
+		},
+		{
+			name: "It rejects id tokens issued to another client",
+			tamper: func(callback *url.URL) {
+				idp.mu.Lock()
+				idp.aud = "someone-else"
+				idp.mu.Unlock()
+			},
+			cleanup: func() {
+				idp.mu.Lock()
+				idp.aud = ""
+				idp.mu.Unlock()
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "It rejects id tokens replayed from another login",
+			tamper: func(callback *url.URL) {
+				idp.mu.Lock()
+				idp.nonces[callback.Query().Get("code")] = "replayed"
+				idp.mu.Unlock()
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "It rejects logins the provider refused",
+			tamper: func(callback *url.URL) {
+				callback.RawQuery = url.Values{"error": {"access_denied"}, "state": {callback.Query().Get("state")}}.Encode()
+			},
+			want: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			callback, browser := startLogin(t, srv)
+			tc.tamper(callback)
+
+			if tc.cleanup != nil {
+				defer tc.cleanup()
+			}
+
+			if tc.other {
+				browser = http.DefaultClient
+			}
+
+			resp, err := browser.Get(callback.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.want {
+				t.Fatalf("got: %d, want: %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
+
+func TestOIDC_MaxLogins(t *testing.T) {
+	idp := newMockProvider(t)
+	defer idp.Close()
+
+	now := time.Now()
+	o := NewOIDC(idp.URL, "racer", "http://racer.test/v1/login/callback", NewTokenAuth(WithSigningKey("k", []byte("secret"))))
+	o.now = func() time.Time { return now }
+	o.maxLogins = 2
+
+	login := func() int {
+		w := httptest.NewRecorder()
+		o.HandleLogin()(w, httptest.NewRequest("GET", "/v1/login", nil))
+		return w.Code
+	}
+
+	t.Run("It turns logins away once too many are in progress", func(t *testing.T) {
+		for i, want := range []int{http.StatusFound, http.StatusFound, http.StatusServiceUnavailable} {
+			if got := login(); got != want {
+				t.Fatalf("login %d got: %d, want: %d", i, got, want)
+			}
+		}
+	})
+
+	t.Run("It makes room for new logins once the ones in progress expire", func(t *testing.T) {
+		now = now.Add(loginTimeout + time.Second)
+
+		if got := login(); got != http.StatusFound {
+			t.Fatalf("got: %d, want: %d", got, http.StatusFound)
+		}
+
+		if len(o.logins) != 1 {
+			t.Fatalf("got: %d logins, want: %d", len(o.logins), 1)
+		}
+	})
+}
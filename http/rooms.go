@@ -0,0 +1,178 @@
+package http
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/broker"
+)
+
+var _ racer.Rooms = &rooms{}
+
+// seqBlock is the number of sequence numbers a room reserves at a time when its repo keeps them, see racer.SeqRepo
+const seqBlock = 1000
+
+// rooms implements racer.Rooms using a broker, so only one topic is ever running for a given chatID.
+// Every topic is recorded by a single racer.Recorder that backs up its messages to repo.
+type rooms struct {
+	broker     *broker.Broker
+	repo       racer.MessageRepo        // used to pick up sequence numbers where a rooms last topic left off, see racer.SeqRepo
+	journal    racer.Journal            // logs recorded messages until they are backed up, may be nil
+	backupOpts []func(*racer.Backupper) // applied to the backupper of every recorder
+
+	mu        sync.Mutex
+	recording map[string]chan struct{} // closed once the recorder of a rooms last topic has finished
+}
+
+// newRooms returns rooms that start their topics with b and record them with the handlers settings.
+func (h *Handler) newRooms(b *broker.Broker) *rooms {
+	return &rooms{
+		broker:     b,
+		repo:       h.Repo,
+		journal:    h.Journal,
+		backupOpts: h.backupOpts,
+		recording:  make(map[string]chan struct{}),
+	}
+}
+
+// Room returns the running topic for chatID. If no topic is running a new one is started,
+// it will remove itself from the broker once all of its clients unregister.
+// It returns an error if the sequence number a new topic carries on from cannot be found.
+func (rs *rooms) Room(chatID string) (racer.Broadcaster, error) {
+	var topic *broker.Topic
+	var err error
+
+	rs.broker.Lookup(chatID, func(found bool, t *broker.Topic) {
+		if !found {
+			if err = rs.start(chatID, t); err != nil {
+				rs.broker.Remove(chatID)
+				return
+			}
+		}
+
+		topic = t
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return topic, nil
+}
+
+// start records and starts a newly created topic.
+func (rs *rooms) start(chatID string, t *broker.Topic) error {
+	// the last topic for the room may still be backing up its final messages,
+	// wait for it so the sequence numbers of the new topic carry on from them.
+	rs.mu.Lock()
+	last := rs.recording[chatID]
+	done := make(chan struct{})
+	rs.recording[chatID] = done
+	rs.mu.Unlock()
+
+	if last != nil {
+		<-last
+	}
+
+	finished := func() {
+		rs.mu.Lock()
+		if rs.recording[chatID] == done {
+			delete(rs.recording, chatID)
+		}
+		rs.mu.Unlock()
+
+		close(done)
+	}
+
+	seq, err := rs.lastSeq(chatID)
+
+	if err != nil {
+		finished()
+		return err
+	}
+
+	broker.WithSeq(seq)(t)
+
+	if sr, ok := rs.repo.(racer.SeqRepo); ok {
+		broker.WithSeqReservation(seqBlock, func(seq uint64) error {
+			err := sr.ReserveSeq(chatID, seq)
+
+			if err != nil {
+				log.Printf("error: could not reserve seqs of room %s: %v", chatID, err)
+			}
+
+			return err
+		})(t)
+	}
+
+	rec, err := rs.recorder(chatID)
+
+	if err != nil {
+		log.Printf("error: room %s will not be recorded: %v", chatID, err)
+		finished()
+	} else {
+		broker.WithRecorder(rec.Receive)(t)
+
+		go func() {
+			if err := rec.Run(); err != nil {
+				log.Printf("error: could not record room %s: %v", chatID, err)
+			}
+
+			finished()
+		}()
+	}
+
+	go func() {
+		t.Start() // TODO: PASS CONTEXT TO CANCEL
+		rs.broker.Remove(chatID)
+	}()
+
+	return nil
+}
+
+// recorder returns a new recorder for the room identified by chatID
+func (rs *rooms) recorder(chatID string) (*racer.Recorder, error) {
+	opts := append([]func(*racer.Backupper){}, rs.backupOpts...)
+
+	if rs.journal != nil {
+		l, err := rs.journal.Open(chatID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, racer.WithLog(l))
+	}
+
+	return racer.NewRecorder(chatID, racer.NewBackupper(chatID, rs.repo, opts...)), nil
+}
+
+// lastSeq returns the sequence number a new topic for chatID carries on from: the last one reserved for the room,
+// or that of the most recent message stored for it if the repo does not reserve them or the room has none reserved yet.
+func (rs *rooms) lastSeq(chatID string) (uint64, error) {
+	if rs.repo == nil {
+		return 0, nil
+	}
+
+	if sr, ok := rs.repo.(racer.SeqRepo); ok {
+		seq, err := sr.LastSeq(chatID)
+
+		if err != nil || seq != 0 {
+			return seq, errors.Wrapf(err, "could not find the last seq of %s", chatID)
+		}
+	}
+
+	last, err := rs.repo.FetchX(chatID, 1)
+
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not fetch the last message of %s", chatID)
+	}
+
+	if len(last) == 0 {
+		return 0, nil
+	}
+
+	return last[0].Seq, nil
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/broker"
+)
+
+// seqrepo is a testrepo that reserves sequence numbers, see racer.SeqRepo
+type seqrepo struct {
+	*testrepo
+
+	mu       sync.Mutex
+	last     uint64
+	reserved []uint64
+	err      error // returned by LastSeq
+}
+
+func (sr *seqrepo) LastSeq(ID string) (uint64, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	return sr.last, sr.err
+}
+
+func (sr *seqrepo) ReserveSeq(ID string, seq uint64) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	sr.reserved = append(sr.reserved, seq)
+
+	return nil
+}
+
+func TestRooms_Room(t *testing.T) {
+	t.Run("It carries on from the last seq reserved for the room", func(t *testing.T) {
+		repo := &seqrepo{testrepo: newTestRepo(), last: 2000}
+		repo.Put("23", &racer.Message{Seq: 5})
+
+		b := broker.NewBroker()
+		room, err := NewHandler(repo).newRooms(b).Room("23")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub := make(chan *broker.Message, 1)
+		room.Register() <- sub
+		room.Broadcast() <- &broker.Message{Payload: &racer.Message{}}
+
+		if got := <-sub; got.Seq != 2001 {
+			t.Fatalf("got: %d, want: %d", got.Seq, 2001)
+		}
+
+		room.Unregister() <- sub
+
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+
+		if len(repo.reserved) != 1 || repo.reserved[0] != 2000+seqBlock {
+			t.Fatalf("got: %v, want: %v", repo.reserved, []uint64{2000 + seqBlock})
+		}
+	})
+
+	t.Run("It returns an error when the last seq of the room cannot be found", func(t *testing.T) {
+		repo := &seqrepo{testrepo: newTestRepo(), err: errors.New("unavailable")}
+
+		b := broker.NewBroker()
+		room, err := NewHandler(repo).newRooms(b).Room("23")
+
+		if err == nil {
+			t.Fatalf("got: %v, want: an error", room)
+		}
+
+		if _, ok := b.Exists("23"); ok {
+			t.Fatalf("got: a topic left in the broker, want: none")
+		}
+	})
+}
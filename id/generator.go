@@ -3,6 +3,7 @@ package id
 import (
 	"fmt"
 	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/speps/go-hashids"
@@ -20,6 +21,7 @@ const (
 // Generator generates random hash id strings.
 // These are used to uniquely indentify topics started by a broker.
 type Generator struct {
+	seq     uint64 // the number of ids handed out by NextID
 	encoder *hashids.HashID
 	salt    []byte
 	minlen  int
@@ -81,6 +83,19 @@ func (g *Generator) NewID() (string, error) {
 	return id[:g.minlen], nil
 }
 
+// NextID returns an id the generator has never returned from NextID before, by encoding a count of the ids it has handed out.
+// Unlike NewID the id is never truncated, so it is collision free but grows longer than the minimum length once enough ids have been generated.
+// Generators with different salts may still return the same id.
+func (g *Generator) NextID() (string, error) {
+	id, err := g.encoder.Encode([]int{int(atomic.AddUint64(&g.seq, 1))})
+
+	if err != nil {
+		return "", fmt.Errorf("Failed encoding ints to ID %v", err)
+	}
+
+	return id, nil
+}
+
 // // ParseID takes a hashID created by the generator and returns
 // // the slice of n integers used to create it.
 // func (g *Generator) ParseID(ID string) ([]int, error) {
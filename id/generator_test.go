@@ -44,7 +44,7 @@ func TestGenerator_NewID(t *testing.T) {
 					id, err := gen.NewID()
 
 					if err != nil {
-						t.Fatalf("%v", err)
+						t.Errorf("%v", err)
 					}
 
 					res <- id
@@ -66,3 +66,38 @@ func TestGenerator_NewID(t *testing.T) {
 	})
 
 }
+
+func TestGenerator_NextID(t *testing.T) {
+	t.Run("It never generates the same id twice", func(t *testing.T) {
+		gen, _ := id.NewGenerator()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		seen := map[string]struct{}{}
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for n := 0; n < 1000; n++ {
+					id, err := gen.NextID()
+					if err != nil {
+						t.Errorf("%v", err)
+						return
+					}
+
+					mu.Lock()
+					seen[id] = struct{}{}
+					mu.Unlock()
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if got, want := len(seen), 10000; got != want {
+			t.Fatalf("got: %d want: %d", got, want)
+		}
+	})
+}
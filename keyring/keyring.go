@@ -0,0 +1,310 @@
+// Package keyring implements envelope encryption with AES-256-GCM.
+//
+// Data is sealed with a data key, and every data key is wrapped by a master key so only the wrapped key is ever stored.
+// Rotating the master key rewraps the data keys without touching the data they sealed. A keyring holds the primary master key,
+// which wraps every new data key, along with any previous master keys still needed to unwrap data keys they wrapped.
+//
+// A wrapped data key is laid out as
+//
+//	id      8 bytes, the id of the master key that wrapped it, see ID
+//	nonce   12 bytes
+//	sealed  the data key sealed by the master key, followed by the 16 byte gcm tag
+//
+// and sealed data as
+//
+//	version 1 byte, always Version
+//	nonce   12 bytes
+//	sealed  the data sealed by the data key, followed by the 16 byte gcm tag
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// KeySize is the size in bytes of every master and data key
+	KeySize = 32
+
+	// Version is the first byte of all sealed data
+	Version = 1
+
+	// EnvMasterKey is the environment variable the master key is read from when it is not read from a file, see Load
+	EnvMasterKey = "RACER_MASTER_KEY"
+
+	// idSize is the size of the id a wrapped data key starts with
+	idSize = 8
+
+	// nonceSize is the size of the nonce of every sealed value
+	nonceSize = 12
+)
+
+var (
+	// ErrUnknownMasterKey is returned when a data key was wrapped by a master key the keyring does not hold
+	ErrUnknownMasterKey = errors.New("data key was wrapped by an unknown master key")
+
+	// ErrCorrupt is returned when sealed data or a wrapped data key cannot be opened,
+	// it was either tampered with or sealed by another key
+	ErrCorrupt = errors.New("sealed data is corrupt or was sealed by another key")
+)
+
+// Keyring holds the master keys that wrap data keys.
+type Keyring struct {
+	primary string                 // the id of the master key that wraps every new data key
+	masters map[string]cipher.AEAD // keyed by id
+}
+
+// New returns a keyring that wraps data keys with primary, and can still unwrap data keys wrapped by any of the previous master keys.
+// Every key must be KeySize bytes.
+func New(primary []byte, previous ...[]byte) (*Keyring, error) {
+	k := &Keyring{masters: make(map[string]cipher.AEAD)}
+
+	for _, key := range append([][]byte{primary}, previous...) {
+		aead, err := newAEAD(key)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid master key")
+		}
+
+		id := ID(key)
+
+		if k.primary == "" {
+			k.primary = id
+		}
+
+		k.masters[id] = aead
+	}
+
+	return k, nil
+}
+
+// ID returns the id of a master key, the hex encoded start of its sha256 digest.
+// The id is stored along with every data key the master key wraps, it reveals nothing about the key itself.
+func ID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:idSize])
+}
+
+// Primary returns the id of the master key that wraps every new data key.
+func (k *Keyring) Primary() string { return k.primary }
+
+// NewDataKey generates a data key and wraps it with the primary master key, returning the key and its wrapped form.
+// ad is bound to the wrapped key, the same ad must be passed to Unwrap it.
+func (k *Keyring) NewDataKey(ad []byte) (key []byte, wrapped []byte, err error) {
+	key = make([]byte, KeySize)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate data key")
+	}
+
+	wrapped, err = k.wrap(key, ad)
+
+	return key, wrapped, err
+}
+
+// Unwrap returns the data key wrapped holds, wrapped by any master key in the keyring.
+func (k *Keyring) Unwrap(wrapped, ad []byte) ([]byte, error) {
+	if len(wrapped) < idSize+nonceSize {
+		return nil, ErrCorrupt
+	}
+
+	aead, ok := k.masters[hex.EncodeToString(wrapped[:idSize])]
+
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+
+	key, err := aead.Open(nil, wrapped[idSize:idSize+nonceSize], wrapped[idSize+nonceSize:], ad)
+
+	if err != nil || len(key) != KeySize {
+		return nil, ErrCorrupt
+	}
+
+	return key, nil
+}
+
+// Rewrap unwraps wrapped and wraps the data key again with the primary master key.
+// It reports false and returns wrapped as is if it is already wrapped by the primary master key.
+func (k *Keyring) Rewrap(wrapped, ad []byte) ([]byte, bool, error) {
+	key, err := k.Unwrap(wrapped, ad)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if k.WrappedBy(wrapped) == k.primary {
+		return wrapped, false, nil
+	}
+
+	rewrapped, err := k.wrap(key, ad)
+
+	return rewrapped, err == nil, err
+}
+
+// WrappedBy returns the id of the master key that wrapped the data key, whether or not the keyring holds it.
+func (k *Keyring) WrappedBy(wrapped []byte) string {
+	if len(wrapped) < idSize {
+		return ""
+	}
+
+	return hex.EncodeToString(wrapped[:idSize])
+}
+
+// wrap seals key with the primary master key
+func (k *Keyring) wrap(key, ad []byte) ([]byte, error) {
+	id, _ := hex.DecodeString(k.primary)
+
+	nonce, err := newNonce()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return k.masters[k.primary].Seal(append(id, nonce...), nonce, key, ad), nil
+}
+
+// Seal seals data with the data key, see Open.
+func Seal(key, data, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := newNonce()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(append([]byte{Version}, nonce...), nonce, data, ad), nil
+}
+
+// Open opens data sealed by Seal with the same data key and ad.
+func Open(key, sealed, ad []byte) ([]byte, error) {
+	if !Sealed(sealed) || len(sealed) < 1+nonceSize {
+		return nil, ErrCorrupt
+	}
+
+	aead, err := newAEAD(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := aead.Open(nil, sealed[1:1+nonceSize], sealed[1+nonceSize:], ad)
+
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+
+	return data, nil
+}
+
+// MAC returns an hmac-sha256 of data under the data key, so data can be looked up by its mac without being stored.
+// The mac is keyed with a key derived from the data key rather than the data key itself, which only ever seals.
+func MAC(key, data []byte) []byte {
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("racer mac"))
+
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// Sealed reports whether data looks like it was sealed by Seal, rather than stored as is.
+func Sealed(data []byte) bool {
+	return len(data) > 0 && data[0] == Version
+}
+
+// newAEAD returns AES-256-GCM keyed with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errors.Errorf("keys must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// newNonce returns a random gcm nonce
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "could not generate nonce")
+	}
+
+	return nonce, nil
+}
+
+// Generate returns a new random master key, encoded as base64 so it can be kept in a file or the environment.
+func Generate() (string, error) {
+	key := make([]byte, KeySize)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", errors.Wrap(err, "could not generate master key")
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Parse decodes a master key encoded as base64 or hex, surrounding whitespace is ignored.
+func Parse(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil || len(key) != KeySize {
+		return nil, errors.Errorf("master keys must be %d bytes encoded as base64 or hex", KeySize)
+	}
+
+	return key, nil
+}
+
+// Load reads the master key from the file at path, or from the EnvMasterKey environment variable if path is empty.
+// It returns nil without an error if path is empty and the variable is not set.
+func Load(path string) ([]byte, error) {
+	if path == "" {
+		encoded, ok := os.LookupEnv(EnvMasterKey)
+
+		if !ok {
+			return nil, nil
+		}
+
+		key, err := Parse(encoded)
+
+		return key, errors.Wrap(err, EnvMasterKey)
+	}
+
+	encoded, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read master key")
+	}
+
+	key, err := Parse(string(encoded))
+
+	return key, errors.Wrapf(err, "%s", path)
+}
@@ -0,0 +1,140 @@
+package keyring_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer/keyring"
+)
+
+var (
+	oldKey = bytes.Repeat([]byte{1}, keyring.KeySize)
+	newKey = bytes.Repeat([]byte{2}, keyring.KeySize)
+)
+
+func TestKeyring_Unwrap(t *testing.T) {
+	old, _ := keyring.New(oldKey)
+	_, wrapped, err := old.NewDataKey([]byte("23"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, wrapped...)
+	tampered[len(tampered)-1] ^= 1
+
+	rotated, _ := keyring.New(newKey, oldKey)
+	forgotten, _ := keyring.New(newKey)
+
+	cases := []struct {
+		name    string
+		k       *keyring.Keyring
+		wrapped []byte
+		ad      string
+		wantErr error
+	}{
+		{name: "It unwraps data keys wrapped by a previous master key", k: rotated, wrapped: wrapped, ad: "23"},
+		{name: "It rejects data keys wrapped by a master key it does not hold", k: forgotten, wrapped: wrapped, ad: "23", wantErr: keyring.ErrUnknownMasterKey},
+		{name: "It rejects data keys wrapped for another room", k: old, wrapped: wrapped, ad: "24", wantErr: keyring.ErrCorrupt},
+		{name: "It rejects tampered data keys", k: old, wrapped: tampered, ad: "23", wantErr: keyring.ErrCorrupt},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := tc.k.Unwrap(tc.wrapped, []byte(tc.ad)); errors.Cause(err) != tc.wantErr {
+				t.Fatalf("got: %v, want: %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	t.Run("It rewraps data keys with the primary master key", func(t *testing.T) {
+		rewrapped, ok, err := rotated.Rewrap(wrapped, []byte("23"))
+
+		if err != nil || !ok || rotated.WrappedBy(rewrapped) != keyring.ID(newKey) {
+			t.Fatalf("got: %v %v, want the data key wrapped by %s", ok, err, keyring.ID(newKey))
+		}
+
+		if _, ok, _ := rotated.Rewrap(rewrapped, []byte("23")); ok {
+			t.Fatalf("got: rewrapped again, want a data key already wrapped by the primary left as is")
+		}
+
+		want, _ := old.Unwrap(wrapped, []byte("23"))
+
+		if got, err := forgotten.Unwrap(rewrapped, []byte("23")); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("got: %v, want the same data key", err)
+		}
+	})
+}
+
+func TestSeal(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, keyring.KeySize)
+
+	sealed, err := keyring.Seal(key, []byte(`{"body":"hi"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("It opens what it sealed", func(t *testing.T) {
+		if got, err := keyring.Open(key, sealed, nil); err != nil || string(got) != `{"body":"hi"}` {
+			t.Fatalf("got: %s %v, want: %s", got, err, `{"body":"hi"}`)
+		}
+	})
+
+	t.Run("It tells sealed data from plaintext json", func(t *testing.T) {
+		if !keyring.Sealed(sealed) || keyring.Sealed([]byte(`{"body":"hi"}`)) {
+			t.Fatalf("got: sealed data mistaken for plaintext or the other way around")
+		}
+	})
+
+	t.Run("It rejects data sealed by another key", func(t *testing.T) {
+		if _, err := keyring.Open(newKey, sealed, nil); err != keyring.ErrCorrupt {
+			t.Fatalf("got: %v, want: %v", err, keyring.ErrCorrupt)
+		}
+	})
+}
+
+func TestMAC(t *testing.T) {
+	t.Run("It returns the same mac for the same key and data", func(t *testing.T) {
+		if !bytes.Equal(keyring.MAC(oldKey, []byte("👍")), keyring.MAC(oldKey, []byte("👍"))) {
+			t.Fatalf("got: different macs, want the same")
+		}
+	})
+
+	t.Run("It returns another mac under another key", func(t *testing.T) {
+		if bytes.Equal(keyring.MAC(oldKey, []byte("👍")), keyring.MAC(newKey, []byte("👍"))) {
+			t.Fatalf("got: the same mac, want a different one")
+		}
+	})
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{name: "It parses base64 keys", encoded: base64.StdEncoding.EncodeToString(newKey) + "\n"},
+		{name: "It parses hex keys", encoded: hex.EncodeToString(newKey)},
+		{name: "It rejects keys of the wrong size", encoded: base64.StdEncoding.EncodeToString(newKey[:16]), wantErr: true},
+		{name: "It rejects keys that are not encoded", encoded: "hunter2", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := keyring.Parse(tc.encoded)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got: %x, want an error", got)
+				}
+				return
+			}
+
+			if err != nil || !bytes.Equal(got, newKey) {
+				t.Fatalf("got: %x %v, want: %x", got, err, newKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package racer
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// SchemaVersion is the version of the Message schema written by this version of racer.
+// Messages without a version were written before the schema was versioned, see Message.UnmarshalJSON.
+const SchemaVersion = 2
+
+// Message types, a message without a type is a text message.
+const (
+	TypeText       = "text"       // written by a user
+	TypeSystem     = "system"     // generated by the server
+	TypeEdit       = "edit"       // replaces the body of the message identified by ParentID
+	TypeDelete     = "delete"     // deletes the message identified by ParentID
+	TypeReaction   = "reaction"   // reacts to the message identified by ParentID, the body holds the reaction
+	TypeUnreaction = "unreaction" // takes back a reaction the sender made to the message identified by ParentID
+	TypeFile       = "file"       // shares a file, described by its metadata, see the Meta keys
+	TypeRead       = "read"       // the sender has read the room up to and including the message identified by ParentID
+	TypeTyping     = "typing"     // a user started or stopped typing, see TypingStarted and TypingStopped
+	TypePresence   = "presence"   // a user joined or left, see NewPresence
+	TypeError      = "error"      // tells a client why the message identified by ParentID was rejected, see Rejection
+
+	TypeSubscribe   = "subscribe"   // asks for the client to be subscribed to the room named by ChatID
+	TypeUnsubscribe = "unsubscribe" // asks for the client to be unsubscribed from the room named by ChatID
+)
+
+// Presence message bodies
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// Typing message bodies, a typing message without a body means the sender started typing.
+// Typing expires on its own if the sender does not keep sending TypingStarted, see WithTyping.
+const (
+	TypingStarted = "start"
+	TypingStopped = "stop"
+)
+
+// Well known metadata keys
+const (
+	MetaFileName = "fileName"
+	MetaFileURL  = "fileURL"
+	MetaFileType = "fileType" // the media type of the file
+	MetaFileSize = "fileSize" // the size of the file in bytes
+
+	MetaErrorCode = "errorCode" // the code of an error message, see Rejection
+)
+
+// Message is data that is sent as json through the connection.
+// The ID, Seq, Timestamp and Sent of a message are always assigned by the server.
+type Message struct {
+	ID        string            `json:"id"`
+	Version   int               `json:"v,omitempty"`
+	Type      string            `json:"type,omitempty"`
+	ChatID    string            `json:"chatID,omitempty"`
+	Seq       uint64            `json:"seq,omitempty"`      // position of the message in its room, see broker.Message
+	ParentID  string            `json:"parentID,omitempty"` // the root of the thread this one replies to, or the message it edits, deletes or reacts to
+	Timestamp int64             `json:"timestamp"`
+	Sent      string            `json:"sent"`
+	Body      string            `json:"body"`
+	SenderID  int               `json:"senderID"`
+	Meta      map[string]string `json:"meta,omitempty"`      // arbitrary metadata, values are strings so every codec decodes them the same way
+	Edited    int64             `json:"edited,omitempty"`    // timestamp of the last edit or delete applied to the message, see Apply
+	Deleted   bool              `json:"deleted,omitempty"`   // the message is a tombstone left in place of a deleted message
+	Reactions []*Reaction       `json:"reactions,omitempty"` // the reactions to the message, only filled in on messages fetched from a MessageRepo
+
+	// a summary of the thread the message is the root of, only filled in on messages fetched from a MessageRepo
+	ReplyCount int   `json:"replyCount,omitempty"`
+	LastReply  int64 `json:"lastReply,omitempty"` // timestamp of the latest reply
+}
+
+// Reaction tallies everyone who reacted to a message with the same reaction.
+type Reaction struct {
+	Body      string `json:"body"` // the reaction, usually an emoji
+	Count     int    `json:"count"`
+	SenderIDs []int  `json:"senderIDs"`
+}
+
+// maxReactionSize is the most bytes a reaction can take up
+const maxReactionSize = 64
+
+// NewPresence returns a presence message announcing that a client has joined or left the room identified by chatID.
+// The body is one of PresenceJoin or PresenceLeave.
+func NewPresence(chatID, body string) *Message {
+	return &Message{Version: SchemaVersion, Type: TypePresence, ChatID: chatID, Body: body, Timestamp: time.Now().UTC().UnixNano()}
+}
+
+// Ephemeral reports whether the message only matters to the clients connected when it is sent
+// and so should never be stored.
+func (m *Message) Ephemeral() bool {
+	switch m.Type {
+	case TypeTyping, TypePresence, TypeSubscribe, TypeUnsubscribe, TypeError:
+		return true
+	}
+
+	return false
+}
+
+// Changes reports whether the message edits or deletes the message identified by its ParentID.
+func (m *Message) Changes() bool {
+	return m.Type == TypeEdit || m.Type == TypeDelete
+}
+
+// Reacts reports whether the message adds or takes back a reaction to the message identified by its ParentID.
+func (m *Message) Reacts() bool {
+	return m.Type == TypeReaction || m.Type == TypeUnreaction
+}
+
+// Replies reports whether the message is a reply in the thread of the message identified by its ParentID.
+// Threads are flat, the parent of a reply is always the root of the thread and never another reply.
+func (m *Message) Replies() bool {
+	return (m.Type == TypeText || m.Type == TypeFile || m.Type == "") && m.ParentID != ""
+}
+
+// Changeable reports whether the message can be edited or deleted.
+// Only text and file messages can be, and never once they have been deleted.
+func (m *Message) Changeable() bool {
+	return (m.Type == TypeText || m.Type == TypeFile || m.Type == "") && !m.Deleted
+}
+
+// Apply changes the message by an edit or delete message that names it as its parent,
+// and reports whether it was changed. An edit replaces the body of the message,
+// a delete leaves a tombstone in its place that keeps the id, seq and sender of the message but none of its content or reactions.
+func (m *Message) Apply(change *Message) bool {
+	if change.ParentID != m.ID || !m.Changeable() {
+		return false
+	}
+
+	switch change.Type {
+	case TypeEdit:
+		m.Body = change.Body
+		m.Edited = change.Timestamp
+	case TypeDelete:
+		m.Body = ""
+		m.Meta = nil
+		m.Reactions = nil
+		m.Edited = change.Timestamp
+		m.Deleted = true
+	default:
+		return false
+	}
+
+	return true
+}
+
+// StampID returns the id of the message the server stamped with timestamp.
+// The server never hands out the same timestamp twice, so the id is unique across every room and connection.
+func StampID(timestamp int64) string {
+	return strconv.FormatInt(timestamp, 36)
+}
+
+// message has the fields of Message without its methods, so it can be decoded without recursing into UnmarshalJSON
+type message Message
+
+// UnmarshalJSON decodes a message of any schema version and upgrades it to the current one.
+// Messages from before the schema was versioned have no type, and may have no id if they were stored by an early version of racer.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*message)(m)); err != nil {
+		return err
+	}
+
+	m.upgrade()
+
+	return nil
+}
+
+// upgrade brings a message decoded from an older schema version up to date.
+func (m *Message) upgrade() {
+	if m.Version >= SchemaVersion {
+		return
+	}
+
+	if m.Type == "" {
+		m.Type = TypeText
+	}
+
+	// messages are stored keyed by their timestamp, which makes it a unique id within a room
+	if m.ID == "" && m.Timestamp != 0 {
+		m.ID = StampID(m.Timestamp)
+	}
+
+	m.Version = SchemaVersion
+}
@@ -0,0 +1,100 @@
+package racer_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tinylttl/racer"
+)
+
+func TestMessage_UnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		name string
+		json string
+		want racer.Message
+	}{
+		{
+			name: "It upgrades messages from before the schema was versioned",
+			json: `{"id":"a","timestamp":1551042839000000000,"sent":"02/24/19 9:13 pm","body":"hi","senderID":7}`,
+			want: racer.Message{ID: "a", Version: racer.SchemaVersion, Type: racer.TypeText, Timestamp: 1551042839000000000, Sent: "02/24/19 9:13 pm", Body: "hi", SenderID: 7},
+		},
+		{
+			name: "It gives stored messages without an id one based on their timestamp",
+			json: `{"id":"","timestamp":35,"body":"hi"}`,
+			want: racer.Message{ID: "z", Version: racer.SchemaVersion, Type: racer.TypeText, Timestamp: 35, Body: "hi"},
+		},
+		{
+			name: "It leaves messages of the current version as they are",
+			json: `{"id":"a","v":2,"type":"reaction","parentID":"b","timestamp":1,"body":"+1","meta":{"k":"v"}}`,
+			want: racer.Message{ID: "a", Version: 2, Type: racer.TypeReaction, ParentID: "b", Timestamp: 1, Body: "+1", Meta: map[string]string{"k": "v"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got racer.Message
+
+			if err := json.Unmarshal([]byte(tc.json), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.ID != tc.want.ID || got.Version != tc.want.Version || got.Type != tc.want.Type || got.ParentID != tc.want.ParentID ||
+				got.Timestamp != tc.want.Timestamp || got.Sent != tc.want.Sent || got.Body != tc.want.Body || got.SenderID != tc.want.SenderID ||
+				len(got.Meta) != len(tc.want.Meta) {
+				t.Fatalf("got: %+v, want: %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMessage_Apply(t *testing.T) {
+	cases := []struct {
+		name   string
+		msg    racer.Message
+		change racer.Message
+		want   racer.Message
+		ok     bool
+	}{
+		{
+			name:   "It replaces the body of an edited message",
+			msg:    racer.Message{ID: "a", Type: racer.TypeText, Body: "helo"},
+			change: racer.Message{Type: racer.TypeEdit, ParentID: "a", Timestamp: 2, Body: "hello"},
+			want:   racer.Message{ID: "a", Type: racer.TypeText, Body: "hello", Edited: 2},
+			ok:     true,
+		},
+		{
+			name:   "It leaves a tombstone in place of a deleted message",
+			msg:    racer.Message{ID: "a", Type: racer.TypeFile, Body: "cat", SenderID: 7, Meta: map[string]string{racer.MetaFileName: "cat.png"}},
+			change: racer.Message{Type: racer.TypeDelete, ParentID: "a", Timestamp: 2},
+			want:   racer.Message{ID: "a", Type: racer.TypeFile, SenderID: 7, Edited: 2, Deleted: true},
+			ok:     true,
+		},
+		{
+			name:   "It ignores changes to other messages",
+			msg:    racer.Message{ID: "a", Type: racer.TypeText, Body: "helo"},
+			change: racer.Message{Type: racer.TypeEdit, ParentID: "b", Timestamp: 2, Body: "hello"},
+			want:   racer.Message{ID: "a", Type: racer.TypeText, Body: "helo"},
+		},
+		{
+			name:   "It never changes a deleted message",
+			msg:    racer.Message{ID: "a", Type: racer.TypeText, Deleted: true},
+			change: racer.Message{Type: racer.TypeEdit, ParentID: "a", Timestamp: 2, Body: "hello"},
+			want:   racer.Message{ID: "a", Type: racer.TypeText, Deleted: true},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.msg
+
+			if ok := got.Apply(&tc.change); ok != tc.ok {
+				t.Fatalf("got: %v, want: %v", ok, tc.ok)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got: %+v, want: %+v", got, tc.want)
+			}
+		})
+	}
+}
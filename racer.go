@@ -3,180 +3,1542 @@ package racer
 import (
 	"context"
 	"fmt"
+	"log"
 	"math/rand"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/tinylttl/racer/broker"
+	"github.com/tinylttl/racer/id"
 )
 
 // Client represents that chat client. Everytime a new connection is made
-// to the server, a new client is created.
+// to the server, a new client is created. A client can be subscribed to any number of rooms,
+// all of which share its one connection.
 type Client struct {
+	Conn  Connector
+	Rooms Rooms
+	Repo  MessageRepo
+	ID    string // identifies the clients session, no two clients share one
+
+	// Identity is who the client is, it is stamped onto every message the client sends, see WithIdentity
+	Identity Identity
+
+	// Moderator clients can edit and delete the messages of any sender, see AsModerator
+	Moderator bool
+
+	typingInterval time.Duration // typing signals sent more often than this are coalesced, see WithTyping
+	typingTimeout  time.Duration // typing expires once a typist has not signaled for this long
+
+	send chan<- *Message
+	subs map[string]*Subscription // keyed by chatID
+
+	wg   sync.WaitGroup // tracks the goroutines of every subscription
+	done chan struct{}  // closed once the client starts shutting down
+	stop sync.Once
+	mu   sync.Mutex
+	err  error // the first error that caused the client to shut down
+}
+
+// Identity is who a client is. It is established by the server when the client connects,
+// never by anything the client sends.
+type Identity struct {
+	SenderID int                    // stamped onto every message the client sends, 0 for an anonymous client
+	Claims   map[string]interface{} // the verified claims of the token the identity was established from, nil without one
+	Grants   Grants                 // restricts the client to the rooms and scopes it was granted, nil for no restrictions
+}
+
+// Anonymous reports whether the identity belongs to a client that has not been authenticated.
+func (i Identity) Anonymous() bool { return i.SenderID == 0 }
+
+// Can reports whether the identity is allowed scope in the room identified by chatID.
+// An identity without grants can read and post in any room but administer none.
+func (i Identity) Can(chatID string, scope Scope) bool {
+	if i.Grants == nil {
+		return scope != ScopeAdmin
+	}
+
+	return i.Grants.allow(chatID, scope) || i.Grants.allow(AllRooms, scope)
+}
+
+// Scope is something an identity can be granted in a room
+type Scope string
+
+const (
+	// ScopeRead lets a client subscribe to a room and be sent its messages
+	ScopeRead Scope = "read"
+
+	// ScopePost lets a client send messages to a room
+	ScopePost Scope = "post"
+
+	// ScopeAdmin lets a client moderate a room, it implies read and post
+	ScopeAdmin Scope = "admin"
+)
+
+// AllRooms is the chatID of a grant that applies to every room
+const AllRooms = "*"
+
+// Grants maps the chatID of a room, or AllRooms, to the scopes granted in it
+type Grants map[string][]Scope
+
+// allow reports whether g grants scope in the room identified by chatID itself
+func (g Grants) allow(chatID string, scope Scope) bool {
+	for _, granted := range g[chatID] {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sessions generates the ID of every client
+var sessions = newSessions()
+
+// newSessions returns the generator of client IDs. A generator is only ever misconfigured by a bug, so it panics if it cannot create one.
+func newSessions() *id.Generator {
+	gen, err := id.NewGenerator()
+
+	if err != nil {
+		panic(errors.Wrap(err, "could not create session id generator"))
+	}
+
+	return gen
+}
+
+// Subscription is a clients membership of a single room.
+type Subscription struct {
+	ChatID      string
 	Broadcaster Broadcaster
-	Conn        Connector
 	Receive     chan *broker.Message // receive messages from the broadcaster
-	Backupper   *Backupper
-	ID          string
+
+	left   chan struct{} // closed when the client unsubscribes
+	closed chan struct{} // closed once the broadcaster has closed Receive
+
+	mu sync.Mutex
+	// threads maps the id of every message known to be part of a thread the client follows to the id of the threads root,
+	// it is nil if the client follows the whole room
+	threads map[string]string
+
+	typists map[string]*typist // the client typing in the room and its threads, keyed by the parentID of the typing message
+
+	writeOnly bool // the client may post to the room but not read it, so it is sent none of the rooms messages
+}
+
+// typist tracks a client typing in a room, or a thread of the room.
+type typist struct {
+	last    *Message  // the last typing message broadcast
+	sent    time.Time // when the last typing message was broadcast
+	expires *time.Timer
+}
+
+// Connector is the source of data to and from the client and server.
+// The default connection type for racer is socket.
+type Connector interface {
+	Read() <-chan *Message
+	Write() chan<- *Message
+}
+
+// Closer is implemented by connectors that the server can close.
+// Err reports the error that ended the connection, it is nil if the connection was closed cleanly by either side.
+// Err is only meaningful once the connectors Read channel has been closed.
+type Closer interface {
+	Close() error
+	Err() error
+}
+
+// Terminator is implemented by connectors that can tell the client why the server is disconnecting it.
+// A client that fails terminates its connection with the error it failed with in place of closing it.
+type Terminator interface {
+	Terminate(err error) error
+}
+
+// ErrFellBehind is the cause of the error a client fails with when a room drops it for falling too far behind.
+var ErrFellBehind = errors.New("fell too far behind")
+
+// HistoryWriter is implemented by connectors that can send the past messages of a room to the client in a single batch.
+type HistoryWriter interface {
+	WriteHistory(chatID string, msgs []*Message)
+}
+
+// Broadcaster can broadcast messages to other listening client goroutines
+type Broadcaster interface {
+	Register() chan chan<- *broker.Message // switch this back to the old register method approach with subscriber Register(*Client)
+	Unregister() chan chan<- *broker.Message
+	Broadcast() chan<- *broker.Message
+
+	// Resume registers a subscriber and returns what it missed since a sequence number, see broker.Topic.Resume
+	Resume(subscriber chan<- *broker.Message, since uint64) (missed []*broker.Message, ok bool)
+
+	// Query searches the messages the broadcaster still holds, see broker.Query
+	Query() chan<- *broker.Query
+}
+
+// ThreadRepo is implemented by repos that can fetch the replies in a thread.
+type ThreadRepo interface {
+	// FetchThread fetches up to x replies to the message identified by rootID that were sent after the timestamp after, oldest first
+	FetchThread(ID string, rootID string, after int64, x int) ([]*Message, error)
+}
+
+// ReceiptRepo is implemented by repos that keep track of the last message every user read in every room.
+type ReceiptRepo interface {
+	// Unread counts the messages sent by anyone else after the last message the user read, keyed by chatID.
+	// Only rooms the user has read messages in are counted.
+	Unread(senderID int) (map[string]int, error)
+}
+
+// SeqRepo is implemented by repos that keep the highest sequence number reserved in every room.
+// A room reserves sequence numbers before it hands them out, whether or not the messages they are handed to are ever stored,
+// so a room that starts again carries on after the last one it reserved and never hands out the same sequence number twice.
+type SeqRepo interface {
+	// LastSeq returns the highest sequence number reserved in the room identified by ID, 0 if none has been
+	LastSeq(ID string) (uint64, error)
+	// ReserveSeq records that sequence numbers up to and including seq may be handed out in the room identified by ID
+	ReserveSeq(ID string, seq uint64) error
+}
+
+// Rooms finds the broadcaster for a room, starting a new one if it is not already running.
+// It returns an error if the room is not running and cannot be started.
+type Rooms interface {
+	Room(chatID string) (Broadcaster, error)
+}
+
+const (
+	// historySize is the number of past messages sent to a client when it subscribes to a room
+	historySize = 50
+
+	// replayLimit is the most messages replayed to a client that resumes a subscription,
+	// a client that missed more than this only recieves the most recent.
+	replayLimit = 1000
+
+	// receiveSize is the number of messages a room can queue for a client before it is dropped for falling behind
+	receiveSize = 64
+
+	// DefaultTypingInterval is how often a typing client is broadcast as still typing, more frequent typing signals are dropped
+	DefaultTypingInterval = 2 * time.Second
+
+	// DefaultTypingTimeout is how long a client stays typing without signaling again,
+	// once it expires the room is told the client stopped typing.
+	DefaultTypingTimeout = 6 * time.Second
+)
+
+// NewClient returns a new Chat client instance that can subscribe to any of the rooms.
+// The history of the rooms it subscribes to is fetched from repo, the rooms themselves are responsible for backing up messages.
+// A client without a connection, conn is nil, can only Post. It can take a variadic number of functional options.
+func NewClient(rooms Rooms, conn Connector, repo MessageRepo, opts ...func(*Client)) *Client {
+	sid, err := sessions.NextID()
+
+	if err != nil {
+		// encoding a count only fails if the generator is misconfigured
+		panic(errors.Wrap(err, "could not generate session id"))
+	}
+
+	c := &Client{
+		ID:    sid,
+		Conn:  conn,
+		Rooms: rooms,
+		Repo:  repo,
+		subs:  make(map[string]*Subscription),
+		done:  make(chan struct{}),
+
+		typingInterval: DefaultTypingInterval,
+		typingTimeout:  DefaultTypingTimeout,
+	}
+
+	if conn != nil {
+		c.send = conn.Write()
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// WithIdentity sets who the client is, without it the client is anonymous. Use with NewClient()
+func WithIdentity(identity Identity) func(*Client) {
+	return func(c *Client) {
+		c.Identity = identity
+	}
+}
+
+// AsModerator lets the client edit and delete the messages of any sender,
+// without it a client can only change the messages it sent.
+// Use with NewClient()
+func AsModerator() func(*Client) {
+	return func(c *Client) {
+		c.Moderator = true
+	}
+}
+
+// WithTyping sets how often a typing client is broadcast as still typing and how long it stays typing without signaling again.
+// Use with NewClient()
+func WithTyping(interval, timeout time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.typingInterval = interval
+		c.typingTimeout = timeout
+	}
+}
+
+// Subscribe registers the client with the broadcaster of the room identified by chatID
+// and announces its presence to the room. Subscribing to a room twice has no effect,
+// a client that only follows some of the rooms threads starts following the whole room.
+//
+// A client that was previously subscribed resumes the subscription by passing the sequence number of the last message
+// it recieved from the room as since, everything it missed is replayed to it before any new messages.
+// Otherwise since should be 0 and the client is sent the rooms most recent messages.
+//
+// A client that is neither allowed to read nor post in the room is not subscribed, a Rejection is returned instead.
+// NOTE: Subscribe and Unsubscribe are not safe to call concurrently, once the client is running
+// they should only be called in response to messages read from its connection.
+func (c *Client) Subscribe(chatID string, since uint64) error {
+	return c.subscribe(chatID, "", since)
+}
+
+// SubscribeThread subscribes the client to the room identified by chatID just like Subscribe,
+// except that it is only sent the thread of the message identified by rootID: the root, its replies and any changes and reactions to them.
+// A client can follow any number of threads in a room. It has no effect on a client that already follows the whole room.
+// A newly followed thread of a room the client is already subscribed to ignores since and always sends the threads history.
+func (c *Client) SubscribeThread(chatID, rootID string, since uint64) error {
+	return c.subscribe(chatID, rootID, since)
+}
+
+// subscribe subscribes the client to the thread of the message identified by rootID, or the whole room if rootID is empty.
+// It returns an error if the client is not allowed in the room.
+func (c *Client) subscribe(chatID, rootID string, since uint64) error {
+	if chatID == "" {
+		return nil
+	}
+
+	if s, exists := c.subs[chatID]; exists {
+		if s.follow(rootID) {
+			c.writeHistory(s, rootID)
+		}
+
+		return nil
+	}
+
+	canRead := c.Identity.Can(chatID, ScopeRead)
+
+	if !canRead && !c.Identity.Can(chatID, ScopePost) {
+		return rejection(CodeForbidden, "not allowed in room %s", chatID)
+	}
+
+	room, err := c.Rooms.Room(chatID)
+
+	if err != nil {
+		return errors.Wrapf(err, "could not start room %s", chatID)
+	}
+
+	s := &Subscription{
+		ChatID:      chatID,
+		Broadcaster: room,
+		Receive:     make(chan *broker.Message, receiveSize),
+		left:        make(chan struct{}),
+		closed:      make(chan struct{}),
+		typists:     make(map[string]*typist),
+		writeOnly:   !canRead,
+	}
+
+	if rootID != "" {
+		s.threads = map[string]string{rootID: rootID}
+	}
+
+	c.subs[chatID] = s
+
+	if since == 0 {
+		s.Broadcaster.Register() <- s.Receive
+		c.writeHistory(s, rootID)
+	} else {
+		missed, ok := s.Broadcaster.Resume(s.Receive, since)
+		c.replay(s, since, missed, ok)
+	}
+
+	c.wg.Add(1)
+
+	// relay messages recieved from the room back through to the connection.
+	// Once the client is shutting down messages are still drained so the room is never blocked by it.
+	go func() {
+		defer c.wg.Done()
+
+		for bmsg := range s.Receive {
+			msg := sequenced(bmsg)
+
+			if !s.follows(msg) {
+				continue
+			}
+
+			select {
+			case c.send <- msg:
+			case <-c.done:
+			}
+		}
+
+		close(s.closed)
+
+		// the room only closes Receive without being asked when the client falls too far behind
+		select {
+		case <-s.left:
+		default:
+			c.fail(errors.Wrapf(ErrFellBehind, "dropped by room %s", chatID))
+		}
+	}()
+
+	// the room may drop the client before it is announced, see handle
+	select {
+	case s.Broadcaster.Broadcast() <- &broker.Message{Payload: NewPresence(chatID, PresenceJoin), Ephemeral: true}:
+	case <-s.closed:
+	case <-c.done:
+	}
+
+	return nil
+}
+
+// follow widens the subscription to the thread of the message identified by rootID, or the whole room if rootID is empty.
+// It reports whether the subscription was widened.
+func (s *Subscription) follow(rootID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.threads == nil:
+		return false
+	case rootID == "":
+		s.threads = nil
+	case s.threads[rootID] == rootID:
+		return false
+	default:
+		s.threads[rootID] = rootID
+	}
+
+	return true
+}
+
+// unfollow stops following the thread of the message identified by rootID,
+// it reports whether the subscription no longer follows anything.
+func (s *Subscription) unfollow(rootID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.threads == nil {
+		return false
+	}
+
+	for id, root := range s.threads {
+		if root == rootID {
+			delete(s.threads, id)
+		}
+	}
+
+	return len(s.threads) == 0
+}
+
+// follows reports whether msg should be sent to a client with the subscription.
+// Messages have to pass through follows in the order they were broadcast, replies are only known to be part of a thread once they have.
+func (s *Subscription) follows(msg *Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writeOnly {
+		return false
+	}
+
+	if s.threads == nil {
+		return true
+	}
+
+	root, ok := s.threads[msg.ID]
+
+	if !ok && msg.ParentID != "" {
+		root, ok = s.threads[msg.ParentID]
+	}
+
+	if ok && msg.Replies() {
+		s.threads[msg.ID] = root
+	}
+
+	return ok
+}
+
+// filter returns the messages in msgs that should be sent to a client with the subscription, see follows.
+func (s *Subscription) filter(msgs []*Message) []*Message {
+	followed := msgs[:0]
+
+	for _, msg := range msgs {
+		if s.follows(msg) {
+			followed = append(followed, msg)
+		}
+	}
+
+	return followed
+}
+
+// sequenced returns a copy of the message carried by bmsg stamped with the sequence number its room gave it.
+// Every subscriber recieves the same payload so it is never modified in place.
+func sequenced(bmsg *broker.Message) *Message {
+	msg := *bmsg.Payload.(*Message)
+	msg.Seq = bmsg.Seq
+
+	return &msg
+}
+
+// replay sends a resuming client every message it missed from the room of s.
+// Messages the room no longer holds in memory are looked up in the clients repo.
+func (c *Client) replay(s *Subscription, since uint64, missed []*broker.Message, ok bool) {
+	chatID := s.ChatID
+	hw, canWrite := c.Conn.(HistoryWriter)
+
+	if !canWrite {
+		return
+	}
+
+	msgs := make([]*Message, 0, len(missed))
+
+	if !ok && c.Repo != nil {
+		stored, err := c.Repo.FetchSince(chatID, since, replayLimit)
+
+		if err != nil {
+			log.Printf("error: could not fetch missed messages for %s: %v", chatID, err)
+		}
+
+		for _, msg := range stored {
+			// anything the room still holds is replayed from memory below
+			if len(missed) > 0 && msg.Seq >= missed[0].Seq {
+				break
+			}
+
+			msgs = append(msgs, msg)
+		}
+	}
+
+	for _, bmsg := range missed {
+		if msg := sequenced(bmsg); !msg.Ephemeral() {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	msgs = s.filter(msgs)
+
+	if len(msgs) > replayLimit {
+		msgs = msgs[len(msgs)-replayLimit:]
+	}
+
+	hw.WriteHistory(chatID, msgs)
+}
+
+// Unsubscribe announces that the client is leaving the room identified by chatID and unregisters it from the rooms broadcaster.
+func (c *Client) Unsubscribe(chatID string) {
+	s, exists := c.subs[chatID]
+
+	if !exists {
+		return
+	}
+
+	delete(c.subs, chatID)
+	close(s.left)
+	s.stopTyping()
+
+	// a room that has already dropped the client may have stopped running
+	select {
+	case s.Broadcaster.Broadcast() <- &broker.Message{Payload: NewPresence(chatID, PresenceLeave), Ephemeral: true}:
+	case <-s.closed:
+	}
+
+	select {
+	case s.Broadcaster.Unregister() <- s.Receive:
+	case <-s.closed:
+	}
+}
+
+// UnsubscribeThread stops the client following the thread of the message identified by rootID in the room identified by chatID,
+// once it follows no threads in the room it is unsubscribed from the room. It has no effect on a client that follows the whole room.
+func (c *Client) UnsubscribeThread(chatID, rootID string) {
+	if s, exists := c.subs[chatID]; exists && s.unfollow(rootID) {
+		c.Unsubscribe(chatID)
+	}
+}
+
+// writeHistory sends the most recent messages of the room of s to the client, oldest first, if its connector is able to.
+// If rootID is not empty the client is sent the thread of the message identified by rootID instead.
+func (c *Client) writeHistory(s *Subscription, rootID string) {
+	hw, ok := c.Conn.(HistoryWriter)
+
+	if !ok || c.Repo == nil || s.writeOnly {
+		return
+	}
+
+	if rootID != "" {
+		hw.WriteHistory(s.ChatID, s.filter(c.thread(s.ChatID, rootID)))
+		return
+	}
+
+	history, err := c.Repo.FetchX(s.ChatID, historySize)
+
+	if err != nil {
+		log.Printf("error: could not fetch history for %s: %v", s.ChatID, err)
+	}
+
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+
+	hw.WriteHistory(s.ChatID, history)
+}
+
+// thread fetches the message identified by rootID from the room identified by chatID followed by the first replies to it.
+func (c *Client) thread(chatID, rootID string) []*Message {
+	root, err := c.Repo.Fetch(chatID, rootID)
+
+	if err != nil || root == nil {
+		if err != nil {
+			log.Printf("error: could not fetch thread %s in %s: %v", rootID, chatID, err)
+		}
+
+		return nil
+	}
+
+	tr, ok := c.Repo.(ThreadRepo)
+
+	if !ok {
+		return []*Message{root}
+	}
+
+	replies, err := tr.FetchThread(chatID, rootID, 0, historySize)
+
+	if err != nil {
+		log.Printf("error: could not fetch thread %s in %s: %v", rootID, chatID, err)
+	}
+
+	return append([]*Message{root}, replies...)
+}
+
+// Run reads incoming messages from the clients connection, blocking until the client is done.
+// Subscribe and unsubscribe messages are handled by the client, all others are broadcast to the subscribers of the room they were sent to.
+//
+// The client is done once its connection closes, ctx is canceled, Close is called or any part of the client fails.
+// Either way it is unsubscribed from every room and its connection is closed before Run returns,
+// a client that failed terminates its connection instead if the connector is a Terminator.
+// The error returned is the first failure of the connection or a room, it is nil if the client was closed or ctx was canceled.
+// Run must only be called once.
+func (c *Client) Run(ctx context.Context) error {
+	read := c.Conn.Read()
+
+loop:
+	for {
+		select {
+		case msg, ok := <-read:
+			if !ok {
+				if cl, ok := c.Conn.(Closer); ok && cl.Err() != nil {
+					c.fail(errors.Wrap(cl.Err(), "connection failed"))
+				}
+
+				break loop
+			}
+
+			c.handle(msg)
+
+		case <-ctx.Done():
+			break loop
+
+		case <-c.done:
+			break loop
+		}
+	}
+
+	c.stop.Do(func() { close(c.done) })
+
+	for chatID := range c.subs {
+		c.Unsubscribe(chatID)
+	}
+
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+
+	if t, ok := c.Conn.(Terminator); ok && err != nil {
+		t.Terminate(err)
+	} else if cl, ok := c.Conn.(Closer); ok {
+		cl.Close()
+	}
+
+	c.wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// Close stops a running client, Run returns once the client has shut down.
+func (c *Client) Close() error {
+	c.stop.Do(func() { close(c.done) })
+
+	return nil
+}
+
+// fail records the first error that occurs and shuts the client down.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	c.stop.Do(func() { close(c.done) })
+}
+
+// handle acts on a single message read from the connection.
+// Whoever the message claims to be from, it is from the client.
+func (c *Client) handle(msg *Message) {
+	msg.SenderID = c.Identity.SenderID
+
+	switch msg.Type {
+	case TypeSubscribe:
+		if err := c.subscribe(msg.ChatID, msg.ParentID, msg.Seq); err != nil {
+			c.reject(msg, err)
+		}
+	case TypeUnsubscribe:
+		if msg.ParentID != "" {
+			c.UnsubscribeThread(msg.ChatID, msg.ParentID)
+		} else {
+			c.Unsubscribe(msg.ChatID)
+		}
+	default:
+		s := c.route(msg)
+
+		if s == nil {
+			c.reject(msg, c.unrouted(msg))
+			return
+		}
+
+		msg.ChatID = s.ChatID
+
+		if err := c.permit(s, msg); err != nil {
+			c.reject(msg, err)
+			return
+		}
+
+		if msg.Type == TypeTyping {
+			c.typing(s, msg)
+			return
+		}
+
+		if err := c.check(s, msg); err != nil {
+			c.reject(msg, err)
+			return
+		}
+
+		// a room that dropped the client, or stopped, is no longer reading broadcasts but the connection stays open
+		select {
+		case s.Broadcaster.Broadcast() <- &broker.Message{Payload: msg, Ephemeral: msg.Ephemeral()}:
+		case <-s.closed:
+		case <-c.done:
+		}
+	}
+}
+
+// Post broadcasts msg to the room identified by chatID on behalf of the client without subscribing it to the room,
+// checked the same way as a message the client sends over its connection. Clients without a connection, such as bots posting over http, send messages this way.
+// It returns a Rejection if the message was refused, any other error is a failure of the server. Ephemeral messages cannot be posted.
+func (c *Client) Post(chatID string, msg *Message) error {
+	msg.SenderID = c.Identity.SenderID
+	msg.ChatID = chatID
+
+	if msg.Ephemeral() {
+		return rejection(CodeInvalid, "%s messages cannot be posted", msg.Type)
+	}
+
+	s := &Subscription{
+		ChatID:    chatID,
+		Receive:   make(chan *broker.Message, receiveSize),
+		closed:    make(chan struct{}),
+		writeOnly: true,
+	}
+
+	if err := c.permit(s, msg); err != nil {
+		return err
+	}
+
+	room, err := c.Rooms.Room(chatID)
+
+	if err != nil {
+		return errors.Wrapf(err, "could not start room %s", chatID)
+	}
+
+	s.Broadcaster = room
+
+	// registering keeps the room running while the message is checked and broadcast,
+	// nothing it broadcasts in the meantime is sent anywhere
+	room.Register() <- s.Receive
+
+	go func() {
+		for range s.Receive {
+		}
+
+		close(s.closed)
+	}()
+
+	defer func() {
+		select {
+		case room.Unregister() <- s.Receive:
+		case <-s.closed:
+		}
+	}()
+
+	if err := c.check(s, msg); err != nil {
+		return err
+	}
+
+	select {
+	case room.Broadcast() <- &broker.Message{Payload: msg}:
+		return nil
+	case <-s.closed:
+		return errors.Errorf("room %s is no longer running", chatID)
+	}
+}
+
+// check checks that msg can be broadcast to the room of s, for the kinds of message that act on another message.
+func (c *Client) check(s *Subscription, msg *Message) error {
+	switch {
+	case msg.Changes():
+		return c.authorize(s, msg)
+	case msg.Reacts():
+		return c.checkReaction(s, msg)
+	case msg.Replies():
+		return c.checkReply(s, msg)
+	case msg.Type == TypeRead:
+		return c.checkRead(s, msg)
+	}
+
+	return nil
+}
+
+// typing broadcasts a typing message to the room of s.
+// A client that keeps signaling that it is typing is only broadcast once every typing interval, signals in between just keep it typing.
+// If it stops signaling for longer than the typing timeout the room is told it stopped typing.
+func (c *Client) typing(s *Subscription, msg *Message) {
+	if msg.Body != TypingStopped {
+		msg.Body = TypingStarted
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	t := s.typists[msg.ParentID]
+
+	switch {
+	case msg.Body == TypingStopped && t == nil:
+		// the client was not typing, there is nothing to tell the room
+		s.mu.Unlock()
+		return
+
+	case msg.Body == TypingStopped:
+		t.expires.Stop()
+		delete(s.typists, msg.ParentID)
+
+	case t != nil && now.Sub(t.sent) < c.typingInterval:
+		t.expires.Reset(c.typingTimeout)
+		s.mu.Unlock()
+		return
+
+	case t != nil:
+		t.expires.Reset(c.typingTimeout)
+		t.last, t.sent = msg, now
+
+	default:
+		t = &typist{last: msg, sent: now}
+		t.expires = time.AfterFunc(c.typingTimeout, func() { s.expire(msg.ParentID, t) })
+		s.typists[msg.ParentID] = t
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.Broadcaster.Broadcast() <- &broker.Message{Payload: msg, Ephemeral: true}:
+	case <-s.closed:
+	}
 }
 
-// Connector is the source of data to and from the client and server.
-// The default connection type for racer is socket.
-type Connector interface {
-	Read() <-chan *Message
-	Write() chan<- *Message
+// expire tells the room the typist t stopped typing, unless it already has.
+func (s *Subscription) expire(parentID string, t *typist) {
+	s.mu.Lock()
+
+	if s.typists[parentID] != t {
+		s.mu.Unlock()
+		return
+	}
+
+	delete(s.typists, parentID)
+
+	stopped := *t.last
+	stopped.Body = TypingStopped
+	stopped.Timestamp = time.Now().UTC().UnixNano()
+	s.mu.Unlock()
+
+	select {
+	case s.Broadcaster.Broadcast() <- &broker.Message{Payload: &stopped, Ephemeral: true}:
+	case <-s.left:
+	case <-s.closed:
+	}
 }
 
-// Broadcaster can broadcast messages to other listening client goroutines
-type Broadcaster interface {
-	Register() chan chan<- *broker.Message // switch this back to the old register method approach with subscriber Register(*Client)
-	Unregister() chan chan<- *broker.Message
-	Broadcast() chan<- *broker.Message
+// stopTyping stops every typist of the subscription from expiring.
+func (s *Subscription) stopTyping() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for parentID, t := range s.typists {
+		t.expires.Stop()
+		delete(s.typists, parentID)
+	}
 }
 
-// NewClient returns a new Chat client instance that is registered with a broadcaster
-func NewClient(broadcaster Broadcaster, conn Connector, backupper *Backupper) *Client {
-	c := &Client{
-		ID: fmt.Sprintf("%d", rand.Intn(100000)), 
-		Receive: make(chan *broker.Message, 1), 
-		Broadcaster: broadcaster, 
-		Conn: conn,
-		Backupper: backupper,
+// permit checks that the client was granted the scope msg needs in the room of s,
+// marking a message read needs the client to be able to read the room and anything else needs it to be able to post.
+func (c *Client) permit(s *Subscription, msg *Message) error {
+	scope := ScopePost
+
+	if msg.Type == TypeRead {
+		scope = ScopeRead
 	}
 
-	c.Broadcaster.Register() <- c.Receive
+	if !c.Identity.Can(s.ChatID, scope) {
+		return rejection(CodeForbidden, "not allowed to %s in room %s", scope, s.ChatID)
+	}
 
-	return c
+	return nil
 }
 
-// Run starts three goroutines. The first backs up messages to an in-memory data store at a set interval.
-// The second reads incoming messages from the Clients connection and broadcasts them to all other clients sharing the same broadcaster.
-// The third reads messages recieved from said broadcaster finally writing them back through to the connection.
-func (c *Client) Run() {
-	ctx, cancel := context.WithCancel(context.Background())
-	// TODO: Possibly switch these to prioritize select statements
-	// to handle case where backupper returns an error
-	// https://stackoverflow.com/questions/46200343/force-priority-of-go-select-statement/46202533#46202533
-	go func() {
-		c.Backupper.Run(ctx)
-	}()
+// moderates reports whether the client can change the messages of any sender in the room of s.
+func (c *Client) moderates(s *Subscription) bool {
+	return c.Moderator || c.Identity.Can(s.ChatID, ScopeAdmin)
+}
 
-	go func() {
-		for msg := range c.Conn.Read() {
-			c.Broadcaster.Broadcast() <- &broker.Message{Payload: msg}
+// authorize checks that the client is allowed to make the change msg makes to its parent message.
+// Only the sender of a message or a moderator of its room can change it, anonymous clients can not change anything.
+func (c *Client) authorize(s *Subscription, msg *Message) error {
+	if c.Identity.Anonymous() && !c.moderates(s) {
+		return rejection(CodeForbidden, "anonymous clients cannot %s messages", msg.Type)
+	}
 
-			c.Backupper.Hold(msg)
-		}
-		c.Broadcaster.Unregister() <- c.Receive // shutdown the client because the connection was closed
-	}()
+	if msg.ParentID == "" {
+		return rejection(CodeInvalid, "a %s must name the message it changes", msg.Type)
+	}
 
-	go func() {
-		for bmsg := range c.Receive {
-			c.Conn.Write() <- bmsg.Payload.(*Message)
+	parent, err := c.find(s, msg.ParentID)
+
+	if err != nil {
+		return err
+	}
+
+	if parent == nil {
+		return rejection(CodeNotFound, "message %s does not exist in room %s", msg.ParentID, s.ChatID)
+	}
+
+	if !parent.Changeable() {
+		return rejection(CodeInvalid, "message %s cannot be changed", msg.ParentID)
+	}
+
+	if !c.moderates(s) && parent.SenderID != msg.SenderID {
+		return rejection(CodeForbidden, "only the sender of message %s or a moderator can change it", msg.ParentID)
+	}
+
+	return nil
+}
+
+// checkReaction checks that msg reacts to a message in the room of s that can still be reacted to.
+// Anyone but an anonymous client can react to a message, and a reaction can only be taken back by the sender who made it.
+func (c *Client) checkReaction(s *Subscription, msg *Message) error {
+	if c.Identity.Anonymous() {
+		return rejection(CodeForbidden, "anonymous clients cannot react to messages")
+	}
+
+	if msg.ParentID == "" || msg.Body == "" {
+		return rejection(CodeInvalid, "a %s must name the message it reacts to and the reaction", msg.Type)
+	}
+
+	if len(msg.Body) > maxReactionSize {
+		return rejection(CodeInvalid, "a reaction can be at most %d bytes", maxReactionSize)
+	}
+
+	parent, err := c.find(s, msg.ParentID)
+
+	if err != nil {
+		return err
+	}
+
+	if parent == nil {
+		return rejection(CodeNotFound, "message %s does not exist in room %s", msg.ParentID, s.ChatID)
+	}
+
+	if !parent.Changeable() {
+		return rejection(CodeInvalid, "message %s cannot be reacted to", msg.ParentID)
+	}
+
+	return nil
+}
+
+// checkReply checks that msg replies to a message in the room of s that can still be replied to.
+// A reply to a reply is moved to the thread of the message replied to, so threads are never more than one level deep.
+func (c *Client) checkReply(s *Subscription, msg *Message) error {
+	parent, err := c.find(s, msg.ParentID)
+
+	if err != nil {
+		return err
+	}
+
+	if parent == nil {
+		return rejection(CodeNotFound, "message %s does not exist in room %s", msg.ParentID, s.ChatID)
+	}
+
+	if !parent.Changeable() {
+		return rejection(CodeInvalid, "message %s cannot be replied to", msg.ParentID)
+	}
+
+	if parent.Replies() {
+		msg.ParentID = parent.ParentID
+	}
+
+	return nil
+}
+
+// checkRead checks that msg reports reading a message in the room of s.
+// Anonymous clients have nowhere to keep track of what they read.
+func (c *Client) checkRead(s *Subscription, msg *Message) error {
+	if c.Identity.Anonymous() {
+		return rejection(CodeForbidden, "anonymous clients cannot mark messages read")
+	}
+
+	if msg.ParentID == "" {
+		return rejection(CodeInvalid, "a read must name the last message read")
+	}
+
+	parent, err := c.find(s, msg.ParentID)
+
+	if err != nil {
+		return err
+	}
+
+	if parent == nil {
+		return rejection(CodeNotFound, "message %s does not exist in room %s", msg.ParentID, s.ChatID)
+	}
+
+	return nil
+}
+
+// find returns the message identified by msgID from the room of s, or nil if it does not exist.
+// Recent messages are found in the rooms broadcaster, where they may still be waiting to be backed up, the rest in the clients repo.
+// A message deleted while the broadcaster still holds the delete is returned as a tombstone.
+func (c *Client) find(s *Subscription, msgID string) (*Message, error) {
+	q := &broker.Query{
+		Match: func(bmsg *broker.Message) bool {
+			msg, ok := bmsg.Payload.(*Message)
+			return ok && (msg.ID == msgID && !msg.Changes() || msg.Type == TypeDelete && msg.ParentID == msgID)
+		},
+		Reply: make(chan *broker.Message, 1),
+	}
+
+	select {
+	case s.Broadcaster.Query() <- q:
+	case <-s.closed:
+		return nil, errors.Errorf("room %s is no longer running", s.ChatID)
+	}
+
+	if bmsg := <-q.Reply; bmsg != nil {
+		msg := sequenced(bmsg)
+
+		if msg.Type == TypeDelete {
+			return &Message{ID: msgID, ChatID: s.ChatID, Deleted: true}, nil
 		}
-		cancel()
-	}()
+
+		return msg, nil
+	}
+
+	if c.Repo == nil {
+		return nil, nil
+	}
+
+	msg, err := c.Repo.Fetch(s.ChatID, msgID)
+
+	return msg, errors.Wrap(err, "could not fetch message")
+}
+
+// Codes of the errors a client is sent when a message it sent is rejected, see Rejection
+const (
+	CodeForbidden   = "forbidden"       // the client is not allowed to do what the message asks
+	CodeNotFound    = "not_found"       // the message names a message that does not exist
+	CodeInvalid     = "invalid_message" // the message asks for something that cannot be done
+	CodeUnavailable = "unavailable"     // the message could not be acted on right now, it can be sent again
+)
+
+// Rejection is the reason a message sent by a client was not broadcast.
+// The client is sent it as an error message, see Client.reject.
+type Rejection struct {
+	Code   string
+	Reason string
+}
+
+func (r *Rejection) Error() string { return r.Reason }
+
+// rejection returns a Rejection with the given code, its reason is formatted from format and args
+func rejection(code, format string, args ...interface{}) error {
+	return &Rejection{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// reject tells the client why the message it sent was not broadcast, with an error message whose parentID is the id of the message.
+// Errors that are not a Rejection are failures of the server, the client is only told to try again.
+func (c *Client) reject(msg *Message, err error) {
+	r, ok := err.(*Rejection)
+
+	if !ok {
+		log.Printf("error: could not check message %s in %s: %v", msg.ID, msg.ChatID, err)
+		r = &Rejection{Code: CodeUnavailable, Reason: "the message could not be checked, try sending it again"}
+	}
+
+	notice := &Message{
+		Version:   SchemaVersion,
+		Type:      TypeError,
+		ChatID:    msg.ChatID,
+		ParentID:  msg.ID,
+		Timestamp: time.Now().UTC().UnixNano(),
+		Body:      r.Reason,
+		Meta:      map[string]string{MetaErrorCode: r.Code},
+	}
+
+	select {
+	case c.send <- notice:
+	case <-c.done:
+	}
+}
+
+// route returns the subscription a message was sent to.
+// A message that does not name a room belongs to the clients only room, if it has exactly one.
+func (c *Client) route(msg *Message) *Subscription {
+	if msg.ChatID != "" {
+		return c.subs[msg.ChatID]
+	}
+
+	if len(c.subs) != 1 {
+		return nil
+	}
+
+	for _, s := range c.subs {
+		return s
+	}
+
+	return nil
 }
 
-// Message is data that is sent as json through the connection.
-type Message struct {
-	Timestamp int64  `json:"timestamp"`
-	Sent      string `json:"sent"`
-	Body      string `json:"body"`
-	SenderID  int    `json:"senderID"`
+// unrouted returns the Rejection of a message that does not belong to any room the client is subscribed to.
+func (c *Client) unrouted(msg *Message) error {
+	if msg.ChatID != "" {
+		return rejection(CodeInvalid, "not subscribed to room %s", msg.ChatID)
+	}
+
+	return rejection(CodeInvalid, "a client subscribed to %d rooms must name the room of every message", len(c.subs))
 }
 
 // MessageRepo provides an interface for interacting with a storage solution
 type MessageRepo interface {
-	// Fetch(ID string) []*Message
+	// Fetch fetches the message identified by msgID from the room identified by ID, it returns nil if there is no such message
+	Fetch(ID string, msgID string) (*Message, error)
 	FetchX(ID string, x int) ([]*Message, error)
+	// FetchSince fetches up to the latest x messages with a sequence number greater than seq, oldest first
+	FetchSince(ID string, seq uint64, x int) ([]*Message, error)
 	Put(ID string, msgs ...*Message) error
 	// Delete(ID string) error
 }
 
+// recordSize is the number of messages a room can queue for its recorder before the room waits for it
+const recordSize = 256
+
+// Recorder backs up every message broadcast to a single room exactly once, in the order the room broadcast them.
+// A room has one recorder no matter how many clients are subscribed to it, see broker.WithRecorder.
+type Recorder struct {
+	ChatID    string
+	Receive   chan *broker.Message // receives every message the room broadcasts that is not ephemeral
+	Backupper *Backupper
+}
+
+// NewRecorder returns a recorder for the room identified by chatID that backs up messages with b.
+func NewRecorder(chatID string, b *Backupper) *Recorder {
+	return &Recorder{
+		ChatID:    chatID,
+		Receive:   make(chan *broker.Message, recordSize),
+		Backupper: b,
+	}
+}
+
+// Run holds every message recieved from the room until the room stops and closes Receive,
+// then backs up whatever is still held and returns.
+// The error returned means some messages could not be backed up, see Backupper.Run.
+func (r *Recorder) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	backedup := make(chan error, 1)
+
+	go func() { backedup <- r.Backupper.Run(ctx) }()
+
+	var err error
+
+	for bmsg := range r.Receive {
+		if herr := r.Backupper.Hold(sequenced(bmsg)); herr != nil && err == nil {
+			err = errors.Wrap(herr, "could not hold message")
+		}
+	}
+
+	cancel()
+
+	if berr := <-backedup; berr != nil {
+		err = berr
+	}
+
+	return err
+}
+
+// Journal opens write-ahead logs for backuppers.
+// Every backupper gets a log of its own, any messages left in a log when the process exits
+// are expected to be recovered by the journal the next time it starts.
+type Journal interface {
+	Open(id string) (Log, error)
+}
+
+// Log is a write-ahead log of the messages held by a single Backupper, split into numbered segments.
+// Messages are appended to the current segment until it is rotated.
+type Log interface {
+	// Append durably writes msgs to the current segment
+	Append(msgs ...*Message) error
+	// Rotate ends the current segment and returns its number, later messages are appended to a new segment
+	Rotate() (segment uint64, err error)
+	// Truncate removes every segment numbered up to and including segment, once their messages have been backed up
+	Truncate(segment uint64) error
+	// Close closes the log, a log that has been truncated up to its current segment is removed entirely
+	Close() error
+}
+
+// DeadLetter keeps batches of messages that could not be backed up, so they can be imported into the store later.
+type DeadLetter interface {
+	// Spill stores msgs held for the room identified by id along with the reason they could not be backed up
+	Spill(id string, reason error, msgs ...*Message) error
+}
+
+// Default Backupper settings
+const (
+	DefaultBackupInterval = 5 * time.Minute
+	DefaultBackupCapacity = 25
+
+	DefaultBackupAttempts   = 4                           // attempts made to put a batch into the store before giving up on it
+	DefaultBackupRetryDelay = 50 * time.Millisecond       // delay before the first retry, doubled for every retry after
+	DefaultBackupMaxDelay   = 5 * time.Second             // longest delay between retries
+	DefaultBackupMaxHeld    = 100 * DefaultBackupCapacity // most messages held on to while the store keeps failing without a dead letter
+)
+
 // Backupper will backup messages to its store after
 // A: the set time interval has passed or
 // B: the in memeory cache has reached its capacity
 //
+// A Backupper is safe for concurrent use, messages are usually held by one goroutine
+// while Run backs them up from another.
+//
 // NOTE: id is used as the key that the data will saved under
 // in the data store.
 type Backupper struct {
+	mu       sync.Mutex // guards cache
 	cache    []*Message
-	ticker   *time.Ticker
+	flushing sync.Mutex // held for the length of a backup so messages reach the store in the order they were held
+	full     chan struct{}
+	interval time.Duration
+	capacity int
+	log      Log // may be nil, in which case held messages are only kept in memory
 	store    MessageRepo
 	id       string
-	busy     bool
-}
 
+	attempts   int
+	retryDelay time.Duration
+	maxDelay   time.Duration
+	deadletter DeadLetter // may be nil, in which case a failed batch is held on to until the next backup
+	maxHeld    int        // most messages held on to, failed batches that do not fit are dropped
+
+	stop    sync.Once
+	stopped chan struct{} // closed once the context Run was passed is done, cutting any retries short
+}
 
 // NewBackupper creates a new Backupper initialized with default settings.
+// It can take a variadic number of functional options.
 func NewBackupper(id string, store MessageRepo, opts ...func(*Backupper)) *Backupper {
 	b := &Backupper{
-		cache : make([]*Message, 0, 25),
-		ticker : time.NewTicker(time.Minute * 5),
-		id : id, 
-		store : store,
-		busy : false,
+		full:     make(chan struct{}, 1),
+		interval: DefaultBackupInterval,
+		capacity: DefaultBackupCapacity,
+		id:       id,
+		store:    store,
+
+		attempts:   DefaultBackupAttempts,
+		retryDelay: DefaultBackupRetryDelay,
+		maxDelay:   DefaultBackupMaxDelay,
+		maxHeld:    DefaultBackupMaxHeld,
+		stopped:    make(chan struct{}),
 	}
 
 	for _, opt := range opts {
 		opt(b)
 	}
 
+	b.cache = make([]*Message, 0, b.capacity)
+
 	return b
 }
 
+// WithInterval sets how often the backupper backs up the messages it holds,
+// an interval that is not positive is ignored. Use with NewBackupper()
+func WithInterval(d time.Duration) func(*Backupper) {
+	return func(b *Backupper) {
+		if d > 0 {
+			b.interval = d
+		}
+	}
+}
+
+// WithCapacity sets the number of messages the backupper holds before it backs them up
+// without waiting for the interval to pass, a capacity that is not positive is ignored. Use with NewBackupper()
+func WithCapacity(capacity int) func(*Backupper) {
+	return func(b *Backupper) {
+		if capacity > 0 {
+			b.capacity = capacity
+		}
+	}
+}
+
+// WithLog sets the write-ahead log that every held message is written to before it is cached,
+// so messages that are yet to be backed up survive a crash. Use with NewBackupper()
+func WithLog(l Log) func(*Backupper) {
+	return func(b *Backupper) {
+		b.log = l
+	}
+}
 
+// WithRetry sets how many attempts are made to put a batch of messages into the store before the backup fails,
+// and the delays between them. The delay before each retry is doubled up to maxDelay and randomly jittered,
+// so backuppers that fail together do not all retry together. Use with NewBackupper()
+func WithRetry(attempts int, delay, maxDelay time.Duration) func(*Backupper) {
+	return func(b *Backupper) {
+		b.attempts = attempts
+		b.retryDelay = delay
+		b.maxDelay = maxDelay
+	}
+}
+
+// WithDeadLetter sets where batches of messages go once every attempt to back them up has failed.
+// Use with NewBackupper()
+func WithDeadLetter(dl DeadLetter) func(*Backupper) {
+	return func(b *Backupper) {
+		b.deadletter = dl
+	}
+}
+
+// WithMaxHeld sets the most messages the backupper holds on to while its store keeps failing,
+// a batch that failed to back up and could not be dead lettered is dropped, oldest messages first, once it no longer fits.
+// A max that is not positive is ignored. Use with NewBackupper()
+func WithMaxHeld(max int) func(*Backupper) {
+	return func(b *Backupper) {
+		if max > 0 {
+			b.maxHeld = max
+		}
+	}
+}
+
+// Run backs up the held messages every interval, or as soon as the cache reaches its capacity, until ctx is done.
+// When ctx is done a backup that is retrying gives up, the messages still held are backed up in a single attempt before Run returns,
+// and the backuppers log is closed.
+// A backup that fails is logged and the messages that could not be backed up are held on to for the next one,
+// so the error returned is that of the final backup, nil means nothing was lost.
+func (b *Backupper) Run(ctx context.Context) (err error) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	// a backup retrying when ctx is done gives up straight away, so shutting down never waits on a failing store
+	go func() {
+		<-ctx.Done()
+		b.stop.Do(func() { close(b.stopped) })
+	}()
+
+	if b.log != nil {
+		defer func() {
+			if cerr := b.log.Close(); err == nil {
+				err = cerr
+			}
+		}()
+	}
 
-// Run starts the backupper and listens forever on its ticker channel,
-// calling backup at the desired interval.
-// When run is terminated using context, we check if a backup is already in progess
-// and if not we backup before terminating.
-func (b *Backupper) Run(ctx context.Context) {
-loop:
 	for {
 		select {
-		case <-b.ticker.C:
-			fmt.Println("Backup called")
-			
-			b.busy = true
+		case <-ticker.C:
+			if err := b.Backup(); err != nil {
+				log.Printf("error: could not back up %s: %v", b.id, err)
+			}
+		case <-b.full:
+			if err := b.Backup(); err != nil {
+				log.Printf("error: could not back up %s: %v", b.id, err)
+			}
+		case <-ctx.Done():
+			return b.Backup()
+		}
+	}
+}
 
-			// TODO: handle error from backup
-			b.Backup()
+// Hold stores any number of messages inside its in mem cache, writing them to the backuppers log first if it has one.
+// Once the cache reaches its capacity a running backupper is signaled to back it up.
+// The messages are held even if they could not be logged, the error only means they will not survive a crash.
+// Ephemeral messages are never held.
+func (b *Backupper) Hold(msgs ...*Message) error {
+	var err error
 
-			b.busy = false
-		case <-ctx.Done():
-			if !b.busy {
-				b.Backup()
-			}
+	msgs = durable(msgs)
 
-			b.ticker.Stop()
+	if len(msgs) == 0 {
+		return nil
+	}
 
-			b.cache = nil // free any leftover memory since we reuse the cache
+	b.mu.Lock()
+	if b.log != nil {
+		err = b.log.Append(msgs...)
+	}
+	b.cache = append(b.cache, msgs...)
+	full := len(b.cache) >= b.capacity
+	b.mu.Unlock()
 
-			break loop
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default: // a backup is already pending
 		}
 	}
+
+	return err
 }
 
-// Hold stores any number of messages inside its in mem cache.
-func (b *Backupper) Hold(msgs ...*Message) {
-	b.cache = append(b.cache, msgs...)
+// durable returns the messages in msgs that are not ephemeral, without modifying msgs.
+func durable(msgs []*Message) []*Message {
+	for i, msg := range msgs {
+		if !msg.Ephemeral() {
+			continue
+		}
+
+		kept := append(make([]*Message, 0, len(msgs)), msgs[:i]...)
+
+		for _, msg := range msgs[i+1:] {
+			if !msg.Ephemeral() {
+				kept = append(kept, msg)
+			}
+		}
+
+		return kept
+	}
+
+	return msgs
 }
 
-// Backup purges all messages from cache into store
-// then reuses the slice. All memory is eventally freed,
-// when the run method ends.
+// Backup purges all messages from cache into store, retrying as many times as the backupper allows.
+// Messages held while the backup is in progress are kept for the next backup.
+// If every attempt fails the purged messages are spilled to the backuppers dead letter,
+// or put back in front of the held messages if it has none or it fails too, as long as they fit, see WithMaxHeld.
+// Once the messages are in the store or dead letter the log segments holding them are truncated.
 func (b *Backupper) Backup() error {
-	err := b.store.Put(b.id, b.cache...)
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+
+	var (
+		seg uint64
+		err error
+	)
+
+	b.mu.Lock()
+	msgs := b.cache
+	b.cache = make([]*Message, 0, b.capacity)
+	if b.log != nil && len(msgs) > 0 {
+		seg, err = b.log.Rotate()
+	}
+	b.mu.Unlock()
+
+	if len(msgs) == 0 {
+		return nil
+	}
 
 	if err != nil {
-		return err
+		b.requeue(msgs)
+		return errors.Wrap(err, "could not rotate log")
+	}
+
+	if err := b.put(msgs); err != nil {
+		if b.deadletter == nil {
+			b.requeue(msgs)
+			return err
+		}
+
+		if derr := b.deadletter.Spill(b.id, err, msgs...); derr != nil {
+			b.requeue(msgs)
+			return errors.Wrapf(derr, "could not dead letter messages that failed to back up with: %v", err)
+		}
+
+		log.Printf("error: %d messages for %s were dead lettered: %v", len(msgs), b.id, err)
 	}
 
-	// reuse the cache
-	// NOTE: see here about possibly mem-leaks with this method
-	// https://stackoverflow.com/questions/16971741/how-do-you-clear-a-slice-in-go
-	b.cache = b.cache[:0]
+	if b.log != nil {
+		return errors.Wrap(b.log.Truncate(seg), "could not truncate log")
+	}
 
 	return nil
 }
+
+// put puts msgs into the store, retrying with exponential backoff until it runs out of attempts
+// or the context Run was passed is done.
+func (b *Backupper) put(msgs []*Message) error {
+	var err error
+
+	delay := b.retryDelay
+
+	for attempt := 1; ; attempt++ {
+		if err = b.store.Put(b.id, msgs...); err == nil || attempt >= b.attempts {
+			return err
+		}
+
+		// full jitter, wait anywhere up to the current delay
+		var jitter time.Duration
+
+		if delay > 0 {
+			jitter = time.Duration(rand.Int63n(int64(delay) + 1))
+		}
+
+		timer := time.NewTimer(jitter)
+
+		select {
+		case <-timer.C:
+		case <-b.stopped:
+			timer.Stop()
+			return err
+		}
+
+		if delay *= 2; delay > b.maxDelay {
+			delay = b.maxDelay
+		}
+	}
+}
+
+// requeue puts msgs back in front of the messages held since they were purged from the cache.
+// Messages that no longer fit within the most the backupper holds are dropped, oldest first, and the loss is logged.
+func (b *Backupper) requeue(msgs []*Message) {
+	b.mu.Lock()
+	held := append(msgs, b.cache...)
+	dropped := len(held) - b.maxHeld
+
+	if dropped > 0 {
+		held = append(make([]*Message, 0, b.maxHeld), held[dropped:]...)
+	}
+
+	b.cache = held
+	b.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("error: dropped %d messages for %s that could not be backed up, the store has failed for too long", dropped, b.id)
+	}
+}
@@ -0,0 +1,1135 @@
+package racer_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/broker"
+)
+
+// testconn is a racer.Connector driven by the test
+type testconn struct {
+	read, write chan *racer.Message
+	err         error
+	terminated  error // the error the connection was terminated with
+	closeOnce   sync.Once
+	closed      chan struct{}
+}
+
+func newTestConn() *testconn {
+	return &testconn{
+		read:   make(chan *racer.Message),
+		write:  make(chan *racer.Message, 100),
+		closed: make(chan struct{}),
+	}
+}
+
+// failing makes the connection report err once its read channel is closed
+func (tc *testconn) failing(err error) *testconn {
+	tc.err = err
+	return tc
+}
+
+func (tc *testconn) Read() <-chan *racer.Message  { return tc.read }
+func (tc *testconn) Write() chan<- *racer.Message { return tc.write }
+func (tc *testconn) Err() error                   { return tc.err }
+
+func (tc *testconn) Close() error {
+	tc.closeOnce.Do(func() { close(tc.closed) })
+	return nil
+}
+
+func (tc *testconn) Terminate(err error) error {
+	tc.terminated = err
+	return tc.Close()
+}
+
+// testrooms starts a topic for every room, shares it between clients while it runs and records when it stops
+type testrooms struct {
+	mu      sync.Mutex
+	topics  map[string]*broker.Topic
+	stopped map[string]chan struct{}
+}
+
+func newTestRooms() *testrooms {
+	return &testrooms{topics: make(map[string]*broker.Topic), stopped: make(map[string]chan struct{})}
+}
+
+func (tr *testrooms) Room(chatID string) (racer.Broadcaster, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if t, ok := tr.topics[chatID]; ok {
+		select {
+		case <-tr.stopped[chatID]:
+		default:
+			return t, nil
+		}
+	}
+
+	t := broker.NewTopic(chatID)
+	stopped := make(chan struct{})
+
+	tr.topics[chatID] = t
+	tr.stopped[chatID] = stopped
+
+	go func() {
+		t.Start()
+		close(stopped)
+	}()
+
+	return t, nil
+}
+
+// waitStopped fails the test if the topic for chatID does not stop, which it does once every subscriber unregisters
+func (tr *testrooms) waitStopped(t *testing.T, chatID string) {
+	tr.mu.Lock()
+	stopped := tr.stopped[chatID]
+	tr.mu.Unlock()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("room %s was never unsubscribed from", chatID)
+	}
+}
+
+// stuckroom is a racer.Broadcaster, and the racer.Rooms holding it, that stops reading broadcasts once its buffer is full,
+// like a room that is about to drop its subscribers. Every subscriber that registers is passed on to the test to drop.
+type stuckroom struct {
+	register  chan chan<- *broker.Message
+	broadcast chan *broker.Message
+}
+
+func newStuckRoom(buffer int) *stuckroom {
+	return &stuckroom{register: make(chan chan<- *broker.Message, 1), broadcast: make(chan *broker.Message, buffer)}
+}
+
+func (sr *stuckroom) Room(string) (racer.Broadcaster, error)  { return sr, nil }
+func (sr *stuckroom) Register() chan chan<- *broker.Message   { return sr.register }
+func (sr *stuckroom) Unregister() chan chan<- *broker.Message { return nil }
+func (sr *stuckroom) Broadcast() chan<- *broker.Message       { return sr.broadcast }
+func (sr *stuckroom) Query() chan<- *broker.Query             { return nil }
+func (sr *stuckroom) Resume(chan<- *broker.Message, uint64) ([]*broker.Message, bool) {
+	return nil, false
+}
+
+// testrepo is a racer.MessageRepo that records every message put into it, or fails every Put with err.
+// If fails is set only that many puts fail.
+type testrepo struct {
+	mu    sync.Mutex
+	err   error
+	fails int
+	msgs  []*racer.Message
+	puts  int
+}
+
+func (tr *testrepo) FetchX(ID string, x int) ([]*racer.Message, error) { return nil, nil }
+func (tr *testrepo) Fetch(ID string, msgID string) (*racer.Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	for _, msg := range tr.msgs {
+		if msg.ID == msgID {
+			return msg, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (tr *testrepo) FetchSince(ID string, seq uint64, x int) ([]*racer.Message, error) {
+	return nil, nil
+}
+
+func (tr *testrepo) Put(ID string, msgs ...*racer.Message) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.err != nil {
+		if tr.fails--; tr.fails == 0 {
+			defer func() { tr.err = nil }()
+		}
+
+		return tr.err
+	}
+
+	tr.msgs = append(tr.msgs, msgs...)
+	tr.puts++
+
+	return nil
+}
+
+// stored returns the number of messages put into the repo and how many puts it took
+func (tr *testrepo) stored() (msgs int, puts int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return len(tr.msgs), tr.puts
+}
+
+// fix stops the repo from failing
+func (tr *testrepo) fix() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.err = nil
+}
+
+func TestClient_Run(t *testing.T) {
+	errConn := errors.New("conn failed")
+
+	cases := []struct {
+		name    string
+		conn    *testconn
+		repo    *testrepo
+		stop    func(c *racer.Client, conn *testconn, cancel context.CancelFunc)
+		wantErr error
+	}{
+		{
+			name: "It returns once the connection is closed by the peer",
+			conn: newTestConn(),
+			repo: &testrepo{},
+			stop: func(c *racer.Client, conn *testconn, cancel context.CancelFunc) { close(conn.read) },
+		},
+		{
+			name: "It returns once it is closed",
+			conn: newTestConn(),
+			repo: &testrepo{},
+			stop: func(c *racer.Client, conn *testconn, cancel context.CancelFunc) { c.Close() },
+		},
+		{
+			name: "It returns once its context is canceled",
+			conn: newTestConn(),
+			repo: &testrepo{},
+			stop: func(c *racer.Client, conn *testconn, cancel context.CancelFunc) { cancel() },
+		},
+		{
+			name:    "It returns the error that ended the connection",
+			conn:    newTestConn().failing(errConn),
+			repo:    &testrepo{},
+			stop:    func(c *racer.Client, conn *testconn, cancel context.CancelFunc) { close(conn.read) },
+			wantErr: errConn,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rooms := newTestRooms()
+			c := racer.NewClient(rooms, tc.conn, tc.repo)
+			c.Subscribe("a", 0)
+			c.Subscribe("b", 0)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			errs := make(chan error, 1)
+			go func() { errs <- c.Run(ctx) }()
+
+			tc.conn.read <- &racer.Message{Type: racer.TypeText, ChatID: "a", Body: "hello"}
+
+			tc.stop(c, tc.conn, cancel)
+
+			var err error
+			select {
+			case err = <-errs:
+			case <-time.After(time.Second):
+				t.Fatalf("Run never returned")
+			}
+
+			if (err == nil) != (tc.wantErr == nil) || (err != nil && !strings.Contains(err.Error(), tc.wantErr.Error())) {
+				t.Fatalf("got: %v, want: %v", err, tc.wantErr)
+			}
+
+			rooms.waitStopped(t, "a")
+			rooms.waitStopped(t, "b")
+
+			select {
+			case <-tc.conn.closed:
+			default:
+				t.Fatalf("the connection was never closed")
+			}
+		})
+	}
+}
+
+func TestClient_FallBehind(t *testing.T) {
+	t.Run("It terminates the connection of a client that falls too far behind", func(t *testing.T) {
+		rooms, conn := newTestRooms(), newTestConn()
+
+		c := racer.NewClient(rooms, conn, nil)
+		c.Subscribe("a", 0)
+
+		errs := make(chan error, 1)
+		go func() { errs <- c.Run(context.Background()) }()
+
+		// the client keeps writing, slower than the room floods it
+		go func() {
+			for range conn.write {
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		room, _ := rooms.Room("a")
+		flood := &racer.Message{Type: racer.TypeText, ChatID: "a", Body: "flood"}
+
+		var err error
+
+	loop:
+		for {
+			select {
+			case room.Broadcast() <- &broker.Message{Payload: flood, Ephemeral: true}:
+			case err = <-errs:
+				break loop
+			case <-time.After(time.Second):
+				t.Fatalf("the client was never dropped")
+			}
+		}
+
+		if err == nil || !strings.Contains(err.Error(), racer.ErrFellBehind.Error()) {
+			t.Fatalf("got: %v, want: %v", err, racer.ErrFellBehind)
+		}
+
+		if conn.terminated != err {
+			t.Fatalf("got: %v, want the connection terminated with %v", conn.terminated, err)
+		}
+	})
+}
+
+func TestClient_Dropped(t *testing.T) {
+	t.Run("It stops subscribing once the room drops it", func(t *testing.T) {
+		room, conn := newStuckRoom(0), newTestConn()
+		c := racer.NewClient(room, conn, nil)
+
+		subscribed := make(chan struct{})
+		go func() {
+			c.Subscribe("a", 0)
+			close(subscribed)
+		}()
+
+		close(<-room.register)
+
+		select {
+		case <-subscribed:
+		case <-time.After(time.Second):
+			t.Fatalf("the client was stuck announcing itself to a room that dropped it")
+		}
+
+		if err := c.Run(context.Background()); err == nil || !strings.Contains(err.Error(), racer.ErrFellBehind.Error()) {
+			t.Fatalf("got: %v, want: %v", err, racer.ErrFellBehind)
+		}
+	})
+
+	t.Run("It stops broadcasting once the room drops it", func(t *testing.T) {
+		room, conn := newStuckRoom(1), newTestConn()
+		c := racer.NewClient(room, conn, nil)
+		c.Subscribe("a", 0)
+
+		errs := make(chan error, 1)
+		go func() { errs <- c.Run(context.Background()) }()
+
+		// the presence of the client filled the rooms buffer, so the client is stuck broadcasting this
+		conn.read <- &racer.Message{Type: racer.TypeText, ChatID: "a", Body: "hi"}
+		close(<-room.register)
+
+		select {
+		case err := <-errs:
+			if err == nil || !strings.Contains(err.Error(), racer.ErrFellBehind.Error()) {
+				t.Fatalf("got: %v, want: %v", err, racer.ErrFellBehind)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the client was stuck broadcasting to a room that dropped it")
+		}
+	})
+}
+
+func TestClient_Handle(t *testing.T) {
+	text := &racer.Message{ID: "1", Type: racer.TypeText, ChatID: "a", Body: "helo", SenderID: 7}
+
+	cases := []struct {
+		name     string
+		opts     []func(*racer.Client) // applied to the client of the last sender
+		stored   []*racer.Message
+		sent     []*racer.Message // sent by a client for each sender, the last message sent is the one checked
+		wantType string
+		wantCode string // the code of the error the last message is rejected with
+	}{
+		{
+			name:     "It broadcasts an edit by the sender",
+			sent:     []*racer.Message{text, {ID: "2", Type: racer.TypeEdit, ParentID: "1", Body: "hello", SenderID: 7}},
+			wantType: racer.TypeEdit,
+		},
+		{
+			name:     "It rejects an edit by anyone else",
+			sent:     []*racer.Message{text, {ID: "2", Type: racer.TypeEdit, ParentID: "1", Body: "hello", SenderID: 8}},
+			wantType: racer.TypeError,
+			wantCode: racer.CodeForbidden,
+		},
+		{
+			name:     "It lets a moderator delete any message",
+			opts:     []func(*racer.Client){racer.AsModerator()},
+			sent:     []*racer.Message{text, {ID: "2", Type: racer.TypeDelete, ParentID: "1", SenderID: 8}},
+			wantType: racer.TypeDelete,
+		},
+		{
+			name:     "It rejects changes to deleted messages",
+			sent:     []*racer.Message{text, {ID: "2", Type: racer.TypeDelete, ParentID: "1", SenderID: 7}, {ID: "3", Type: racer.TypeEdit, ParentID: "1", Body: "hello", SenderID: 7}},
+			wantType: racer.TypeError,
+			wantCode: racer.CodeInvalid,
+		},
+		{
+			name:     "It rejects changes to messages that do not exist",
+			sent:     []*racer.Message{{ID: "2", Type: racer.TypeEdit, ParentID: "1", Body: "hello", SenderID: 7}},
+			wantType: racer.TypeError,
+			wantCode: racer.CodeNotFound,
+		},
+		{
+			name:     "It broadcasts a reaction by anyone",
+			sent:     []*racer.Message{text, {ID: "2", Type: racer.TypeReaction, ParentID: "1", Body: "👍", SenderID: 8}},
+			wantType: racer.TypeReaction,
+		},
+		{
+			name:     "It rejects reactions to deleted messages",
+			sent:     []*racer.Message{text, {ID: "2", Type: racer.TypeDelete, ParentID: "1", SenderID: 7}, {ID: "3", Type: racer.TypeReaction, ParentID: "1", Body: "👍", SenderID: 8}},
+			wantType: racer.TypeError,
+			wantCode: racer.CodeInvalid,
+		},
+		{
+			name:     "It rejects reactions without a reaction",
+			sent:     []*racer.Message{text, {ID: "2", Type: racer.TypeReaction, ParentID: "1", SenderID: 8}},
+			wantType: racer.TypeError,
+			wantCode: racer.CodeInvalid,
+		},
+		{
+			name:     "It broadcasts a read receipt",
+			sent:     []*racer.Message{text, {ID: "2", Type: racer.TypeRead, ParentID: "1", SenderID: 8}},
+			wantType: racer.TypeRead,
+		},
+		{
+			name:     "It rejects read receipts for messages that do not exist",
+			sent:     []*racer.Message{{ID: "2", Type: racer.TypeRead, ParentID: "1", SenderID: 8}},
+			wantType: racer.TypeError,
+			wantCode: racer.CodeNotFound,
+		},
+		{
+			name:     "It rejects changes from anonymous clients",
+			sent:     []*racer.Message{{ID: "1", Type: racer.TypeText, Body: "helo"}, {ID: "2", Type: racer.TypeEdit, ParentID: "1", Body: "hello"}},
+			wantType: racer.TypeError,
+			wantCode: racer.CodeForbidden,
+		},
+		{
+			name:     "It finds messages that have already been backed up",
+			stored:   []*racer.Message{{ID: "1", Type: racer.TypeText, ChatID: "a", Body: "helo", SenderID: 7}},
+			sent:     []*racer.Message{{ID: "2", Type: racer.TypeEdit, ParentID: "1", Body: "hello", SenderID: 7}},
+			wantType: racer.TypeEdit,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rooms, repo := newTestRooms(), &testrepo{msgs: tc.stored}
+			conns := map[int]*testconn{}
+
+			var got *racer.Message
+
+			for i, msg := range tc.sent {
+				conn, ok := conns[msg.SenderID]
+
+				if !ok {
+					opts := []func(*racer.Client){racer.WithIdentity(racer.Identity{SenderID: msg.SenderID})}
+					if i == len(tc.sent)-1 {
+						opts = append(opts, tc.opts...)
+					}
+
+					conn = newTestConn()
+					conns[msg.SenderID] = conn
+
+					c := racer.NewClient(rooms, conn, repo, opts...)
+					c.Subscribe("a", 0)
+
+					go c.Run(context.Background())
+					defer c.Close()
+				}
+
+				// the sender claims to be someone else, which the client must ignore
+				m := *msg
+				m.SenderID = 99
+				conn.read <- &m
+
+				got = reply(t, conn, msg.ID)
+
+				if got.Type != racer.TypeError && got.SenderID != msg.SenderID {
+					t.Fatalf("got: %d, want: %d", got.SenderID, msg.SenderID)
+				}
+			}
+
+			if got.Type != tc.wantType {
+				t.Fatalf("got: %s, want: %s", got.Type, tc.wantType)
+			}
+
+			if code := got.Meta[racer.MetaErrorCode]; code != tc.wantCode {
+				t.Fatalf("got: %q, want: %q", code, tc.wantCode)
+			}
+		})
+	}
+}
+
+// reply returns the message broadcast back to conn for the message identified by msgID, or the error rejecting it
+func reply(t *testing.T, conn *testconn, msgID string) *racer.Message {
+	t.Helper()
+
+	for {
+		select {
+		case msg := <-conn.write:
+			if msg.ID == msgID || (msg.Type == racer.TypeError && msg.ParentID == msgID) {
+				return msg
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("nothing was sent in reply to message %s", msgID)
+		}
+	}
+}
+
+func TestClient_SubscribeThread(t *testing.T) {
+	t.Run("It only sends the thread the client follows", func(t *testing.T) {
+		conn := newTestConn()
+		c := racer.NewClient(newTestRooms(), conn, &testrepo{}, racer.WithIdentity(racer.Identity{SenderID: 7}))
+		c.SubscribeThread("a", "1", 0)
+
+		go c.Run(context.Background())
+		defer c.Close()
+
+		for _, msg := range []*racer.Message{
+			{ID: "1", Type: racer.TypeText, ChatID: "a", SenderID: 7},
+			{ID: "2", Type: racer.TypeText, ChatID: "a", SenderID: 7},
+			{ID: "3", Type: racer.TypeText, ChatID: "a", ParentID: "1", SenderID: 7},
+			{ID: "4", Type: racer.TypeReaction, ChatID: "a", ParentID: "2", Body: "👍", SenderID: 7},
+			{ID: "5", Type: racer.TypeEdit, ChatID: "a", ParentID: "3", SenderID: 7},
+			{ID: "6", Type: racer.TypeText, ChatID: "a", ParentID: "3", SenderID: 7},
+		} {
+			conn.read <- msg
+		}
+
+		want := []string{"1", "3", "5", "6"}
+
+		for i := 0; i < len(want); i++ {
+			select {
+			case msg := <-conn.write:
+				if msg.ID != want[i] {
+					t.Fatalf("got: %s, want: %s", msg.ID, want[i])
+				}
+
+				// a reply to a reply joins the thread of the message it replied to
+				if msg.ID == "6" && msg.ParentID != "1" {
+					t.Fatalf("got: %s, want: %s", msg.ParentID, "1")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("message %s was never sent", want[i])
+			}
+		}
+	})
+
+	t.Run("It leaves the room once it follows no threads", func(t *testing.T) {
+		rooms := newTestRooms()
+		c := racer.NewClient(rooms, newTestConn(), &testrepo{})
+		c.SubscribeThread("a", "1", 0)
+		c.SubscribeThread("a", "2", 0)
+
+		c.UnsubscribeThread("a", "1")
+		c.UnsubscribeThread("a", "2")
+
+		rooms.waitStopped(t, "a")
+	})
+}
+
+func TestClient_Grants(t *testing.T) {
+	t.Run("It keeps a client to the rooms and scopes it was granted", func(t *testing.T) {
+		rooms := newTestRooms()
+
+		listenerConn := newTestConn()
+		listener := racer.NewClient(rooms, listenerConn, &testrepo{}, racer.WithIdentity(racer.Identity{SenderID: 7}))
+		listener.Subscribe("a", 0)
+
+		go listener.Run(context.Background())
+		defer listener.Close()
+
+		botConn := newTestConn()
+		grants := racer.Grants{"a": {racer.ScopePost}, "b": {racer.ScopeRead}}
+		bot := racer.NewClient(rooms, botConn, &testrepo{}, racer.WithIdentity(racer.Identity{SenderID: 9, Grants: grants}))
+		bot.Subscribe("a", 0)
+		bot.Subscribe("b", 0)
+
+		go bot.Run(context.Background())
+		defer bot.Close()
+
+		botConn.read <- &racer.Message{ID: "s", Type: racer.TypeSubscribe, ChatID: "c"}
+		botConn.read <- &racer.Message{ID: "1", Type: racer.TypeText, ChatID: "a", Body: "beep"}
+		botConn.read <- &racer.Message{ID: "2", Type: racer.TypeText, ChatID: "b", Body: "boop"}
+
+		for {
+			select {
+			case msg := <-listenerConn.write:
+				if msg.ID != "1" {
+					continue
+				}
+
+				if msg.SenderID != 9 {
+					t.Fatalf("got: %d, want: %d", msg.SenderID, 9)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("the message posted to a was never sent")
+			}
+			break
+		}
+
+		rejected := map[string]bool{}
+
+		for len(rejected) < 2 {
+			select {
+			case msg := <-botConn.write:
+				if msg.ID == "1" {
+					t.Fatalf("got: the message posted to a, want a client that can only post to a to be sent nothing from it")
+				}
+
+				if msg.Type == racer.TypeError && msg.Meta[racer.MetaErrorCode] == racer.CodeForbidden {
+					rejected[msg.ParentID] = true
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("got rejections: %v, want the subscribe to c and the post to b rejected", rejected)
+			}
+		}
+
+		if !rejected["s"] || !rejected["2"] {
+			t.Fatalf("got rejections: %v, want the subscribe to c and the post to b rejected", rejected)
+		}
+	})
+
+	t.Run("It tells the caller a subscription was refused", func(t *testing.T) {
+		c := racer.NewClient(newTestRooms(), newTestConn(), &testrepo{}, racer.WithIdentity(racer.Identity{SenderID: 9, Grants: racer.Grants{"b": {racer.ScopeRead}}}))
+
+		for _, err := range []error{c.Subscribe("a", 0), c.SubscribeThread("a", "1", 0)} {
+			if r, ok := err.(*racer.Rejection); !ok || r.Code != racer.CodeForbidden {
+				t.Fatalf("got: %v, want: a %s rejection", err, racer.CodeForbidden)
+			}
+		}
+
+		if err := c.Subscribe("b", 0); err != nil {
+			t.Fatalf("got: %v, want: %v", err, nil)
+		}
+
+		c.Close()
+	})
+}
+
+func TestClient_Post(t *testing.T) {
+	t.Run("It broadcasts a message posted without a connection", func(t *testing.T) {
+		rooms := newTestRooms()
+
+		listenerConn := newTestConn()
+		listener := racer.NewClient(rooms, listenerConn, &testrepo{}, racer.WithIdentity(racer.Identity{SenderID: 7}))
+		listener.Subscribe("a", 0)
+
+		go listener.Run(context.Background())
+		defer listener.Close()
+
+		bot := racer.NewClient(rooms, nil, &testrepo{}, racer.WithIdentity(racer.Identity{SenderID: 9, Grants: racer.Grants{"a": {racer.ScopePost}}}))
+
+		if err := bot.Post("a", &racer.Message{ID: "1", Type: racer.TypeText, ChatID: "b", Body: "beep"}); err != nil {
+			t.Fatalf("got: %v, want: %v", err, nil)
+		}
+
+		for {
+			select {
+			case msg := <-listenerConn.write:
+				if msg.ID != "1" {
+					continue
+				}
+
+				if msg.ChatID != "a" || msg.SenderID != 9 {
+					t.Fatalf("got: %+v, want: message 1 sent by %d in a", msg, 9)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("the posted message was never sent")
+			}
+			break
+		}
+	})
+
+	t.Run("It stops a room started only for the post", func(t *testing.T) {
+		rooms := newTestRooms()
+		bot := racer.NewClient(rooms, nil, &testrepo{}, racer.WithIdentity(racer.Identity{SenderID: 9}))
+
+		if err := bot.Post("a", &racer.Message{ID: "1", Type: racer.TypeText, Body: "beep"}); err != nil {
+			t.Fatalf("got: %v, want: %v", err, nil)
+		}
+
+		rooms.waitStopped(t, "a")
+	})
+
+	t.Run("It rejects posts the client may not make", func(t *testing.T) {
+		bot := racer.NewClient(newTestRooms(), nil, &testrepo{}, racer.WithIdentity(racer.Identity{SenderID: 9, Grants: racer.Grants{"a": {racer.ScopePost}}}))
+
+		cases := []struct {
+			chatID string
+			msg    *racer.Message
+			code   string
+		}{
+			{"b", &racer.Message{ID: "1", Type: racer.TypeText, Body: "beep"}, racer.CodeForbidden},
+			{"a", &racer.Message{ID: "2", Type: racer.TypeTyping}, racer.CodeInvalid},
+		}
+
+		for _, c := range cases {
+			if r, ok := bot.Post(c.chatID, c.msg).(*racer.Rejection); !ok || r.Code != c.code {
+				t.Fatalf("got: %v, want: a %s rejection", r, c.code)
+			}
+		}
+	})
+}
+
+func TestClient_Typing(t *testing.T) {
+	typing := func(body string) *racer.Message {
+		return &racer.Message{Type: racer.TypeTyping, ChatID: "a", Body: body, SenderID: 7}
+	}
+
+	cases := []struct {
+		name    string
+		timeout time.Duration
+		sent    []*racer.Message
+		want    []string // bodies of the typing messages sent to the room
+		wait    bool     // wait for typing to expire instead of sending a marker
+	}{
+		{name: "It coalesces typing signals", timeout: time.Hour, sent: []*racer.Message{typing(""), typing(racer.TypingStarted), typing("")}, want: []string{racer.TypingStarted}},
+		{name: "It tells the room when the client stops typing", timeout: time.Hour, sent: []*racer.Message{typing(""), typing(racer.TypingStopped)}, want: []string{racer.TypingStarted, racer.TypingStopped}},
+		{name: "It ignores a client that stops without typing", timeout: time.Hour, sent: []*racer.Message{typing(racer.TypingStopped)}},
+		{name: "It tells the room when typing expires", timeout: 20 * time.Millisecond, sent: []*racer.Message{typing("")}, want: []string{racer.TypingStarted, racer.TypingStopped}, wait: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := newTestConn()
+			c := racer.NewClient(newTestRooms(), conn, &testrepo{}, racer.WithTyping(time.Hour, tc.timeout))
+			c.Subscribe("a", 0)
+
+			go c.Run(context.Background())
+			defer c.Close()
+
+			for _, msg := range tc.sent {
+				conn.read <- msg
+			}
+
+			if !tc.wait {
+				conn.read <- &racer.Message{ID: "marker", Type: racer.TypeText, ChatID: "a"}
+			}
+
+			var got []string
+			marked := tc.wait
+
+			for len(got) < len(tc.want) || !marked {
+				select {
+				case msg := <-conn.write:
+					if msg.Type == racer.TypeTyping {
+						got = append(got, msg.Body)
+					}
+
+					marked = marked || msg.ID == "marker"
+				case <-time.After(time.Second):
+					t.Fatalf("got: %v, want: %v", got, tc.want)
+				}
+			}
+
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackupper_Ephemeral(t *testing.T) {
+	t.Run("It never holds ephemeral messages", func(t *testing.T) {
+		repo := &testrepo{}
+		b := racer.NewBackupper("23", repo)
+
+		b.Hold(&racer.Message{Type: racer.TypeTyping}, &racer.Message{Type: racer.TypeText}, racer.NewPresence("23", racer.PresenceJoin))
+
+		if err := b.Backup(); err != nil {
+			t.Fatal(err)
+		}
+
+		if msgs, _ := repo.stored(); msgs != 1 {
+			t.Fatalf("got: %d messages, want: %d", msgs, 1)
+		}
+	})
+}
+
+func TestBackupper(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     []func(*racer.Backupper)
+		held     int
+		wantPuts int
+	}{
+		{name: "It backs up once the cache reaches capacity", opts: []func(*racer.Backupper){racer.WithCapacity(5), racer.WithInterval(time.Hour)}, held: 5, wantPuts: 1},
+		{name: "It backs up every interval", opts: []func(*racer.Backupper){racer.WithCapacity(100), racer.WithInterval(10 * time.Millisecond)}, held: 3, wantPuts: 1},
+		{name: "It ignores an interval and capacity that are not positive", opts: []func(*racer.Backupper){racer.WithCapacity(0), racer.WithInterval(-time.Second)}, held: racer.DefaultBackupCapacity, wantPuts: 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := &testrepo{}
+			b := racer.NewBackupper("23", repo, tc.opts...)
+
+			for i := 0; i < tc.held; i++ {
+				b.Hold(&racer.Message{})
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go b.Run(ctx)
+
+			deadline := time.Now().Add(time.Second)
+			for n, _ := repo.stored(); n < tc.held && time.Now().Before(deadline); n, _ = repo.stored() {
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			if n, puts := repo.stored(); n != tc.held || puts != tc.wantPuts {
+				t.Fatalf("got: %d messages in %d puts, want: %d in %d", n, puts, tc.held, tc.wantPuts)
+			}
+		})
+	}
+
+	t.Run("It backs up everything held concurrently", func(t *testing.T) {
+		repo := &testrepo{}
+		b := racer.NewBackupper("23", repo, racer.WithCapacity(7), racer.WithInterval(time.Millisecond))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- b.Run(ctx) }()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < 100; j++ {
+					b.Hold(&racer.Message{})
+				}
+			}()
+		}
+
+		wg.Wait()
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if n, _ := repo.stored(); n != 1000 {
+			t.Fatalf("got: %d, want: %d", n, 1000)
+		}
+	})
+
+	t.Run("It keeps messages that could not be backed up", func(t *testing.T) {
+		repo := &testrepo{err: errors.New("repo failed")}
+		b := racer.NewBackupper("23", repo)
+
+		b.Hold(&racer.Message{}, &racer.Message{})
+
+		if err := b.Backup(); err == nil {
+			t.Fatalf("got: nil error, want: %v", repo.err)
+		}
+
+		repo.fix()
+		b.Hold(&racer.Message{})
+
+		if err := b.Backup(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, _ := repo.stored(); n != 3 {
+			t.Fatalf("got: %d, want: %d", n, 3)
+		}
+	})
+}
+
+// testlog is a racer.Log that keeps its segments in memory
+type testlog struct {
+	mu        sync.Mutex
+	seg       uint64
+	segs      map[uint64][]*racer.Message
+	truncated uint64
+	closed    bool
+}
+
+func newTestLog() *testlog {
+	return &testlog{segs: make(map[uint64][]*racer.Message)}
+}
+
+func (tl *testlog) Append(msgs ...*racer.Message) error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	tl.segs[tl.seg] = append(tl.segs[tl.seg], msgs...)
+	return nil
+}
+
+func (tl *testlog) Rotate() (uint64, error) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	tl.seg++
+	return tl.seg - 1, nil
+}
+
+func (tl *testlog) Truncate(seg uint64) error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	for s := range tl.segs {
+		if s <= seg {
+			delete(tl.segs, s)
+		}
+	}
+
+	return nil
+}
+
+func (tl *testlog) Close() error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	tl.closed = true
+	return nil
+}
+
+// logged returns the number of messages left in the log
+func (tl *testlog) logged() int {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	n := 0
+	for _, msgs := range tl.segs {
+		n += len(msgs)
+	}
+
+	return n
+}
+
+func TestBackupper_WithLog(t *testing.T) {
+	t.Run("It logs held messages until they are backed up", func(t *testing.T) {
+		repo := &testrepo{err: errors.New("repo failed")}
+		l := newTestLog()
+		b := racer.NewBackupper("23", repo, racer.WithLog(l))
+
+		b.Hold(&racer.Message{}, &racer.Message{})
+
+		if got := l.logged(); got != 2 {
+			t.Fatalf("got: %d, want: %d", got, 2)
+		}
+
+		// nothing is truncated while the messages are yet to reach the repo
+		b.Backup()
+		b.Hold(&racer.Message{})
+
+		if got := l.logged(); got != 3 {
+			t.Fatalf("got: %d, want: %d", got, 3)
+		}
+
+		repo.fix()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := b.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := l.logged(); got != 0 {
+			t.Fatalf("got: %d, want: %d", got, 0)
+		}
+
+		if n, _ := repo.stored(); n != 3 {
+			t.Fatalf("got: %d, want: %d", n, 3)
+		}
+
+		if !l.closed {
+			t.Fatalf("the log was never closed")
+		}
+	})
+}
+
+// testdeadletter is a racer.DeadLetter that records every batch spilled to it
+type testdeadletter struct {
+	batches [][]*racer.Message
+}
+
+func (td *testdeadletter) Spill(id string, reason error, msgs ...*racer.Message) error {
+	td.batches = append(td.batches, msgs)
+	return nil
+}
+
+func TestBackupper_Retry(t *testing.T) {
+	t.Run("It retries a failed backup", func(t *testing.T) {
+		repo := &testrepo{err: errors.New("repo failed"), fails: 2}
+		b := racer.NewBackupper("23", repo, racer.WithRetry(3, time.Millisecond, time.Millisecond))
+
+		b.Hold(&racer.Message{})
+
+		if err := b.Backup(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, _ := repo.stored(); n != 1 {
+			t.Fatalf("got: %d, want: %d", n, 1)
+		}
+	})
+
+	t.Run("It dead letters a batch once it runs out of attempts", func(t *testing.T) {
+		repo := &testrepo{err: errors.New("repo failed"), fails: 3}
+		l := newTestLog()
+		dl := &testdeadletter{}
+		b := racer.NewBackupper("23", repo, racer.WithRetry(3, time.Millisecond, time.Millisecond), racer.WithDeadLetter(dl), racer.WithLog(l))
+
+		b.Hold(&racer.Message{}, &racer.Message{})
+
+		if err := b.Backup(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(dl.batches) != 1 || len(dl.batches[0]) != 2 {
+			t.Fatalf("got: %v batches, want: 1 batch of 2 messages", dl.batches)
+		}
+
+		// the messages are safe in the dead letter so they are neither held nor logged any longer
+		if got := l.logged(); got != 0 {
+			t.Fatalf("got: %d, want: %d", got, 0)
+		}
+
+		if err := b.Backup(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, _ := repo.stored(); n != 0 {
+			t.Fatalf("got: %d, want: %d", n, 0)
+		}
+	})
+}
+
+func TestBackupper_Budget(t *testing.T) {
+	t.Run("It stops retrying once it is told to stop running", func(t *testing.T) {
+		repo := &testrepo{err: errors.New("repo failed")}
+		b := racer.NewBackupper("23", repo, racer.WithCapacity(1), racer.WithRetry(100, time.Hour, time.Hour))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- b.Run(ctx) }()
+
+		b.Hold(&racer.Message{})
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatalf("got: nil error, want: %v", repo.err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the backupper kept retrying after it was told to stop")
+		}
+	})
+
+	t.Run("It drops the oldest messages once it holds too many", func(t *testing.T) {
+		repo := &testrepo{err: errors.New("repo failed")}
+		b := racer.NewBackupper("23", repo, racer.WithMaxHeld(3), racer.WithRetry(1, 0, 0))
+
+		b.Hold(&racer.Message{Body: "1"}, &racer.Message{Body: "2"})
+		b.Backup()
+		b.Hold(&racer.Message{Body: "3"}, &racer.Message{Body: "4"})
+		b.Backup()
+
+		repo.fix()
+
+		if err := b.Backup(); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, msg := range repo.msgs {
+			got = append(got, msg.Body)
+		}
+
+		if strings.Join(got, ",") != "2,3,4" {
+			t.Fatalf("got: %v, want: [2 3 4]", got)
+		}
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	t.Run("It backs up every message broadcast to the room once and in order", func(t *testing.T) {
+		repo := &testrepo{}
+		rec := racer.NewRecorder("23", racer.NewBackupper("23", repo))
+
+		topic := broker.NewTopic("23", broker.WithRecorder(rec.Receive))
+		go topic.Start()
+
+		done := make(chan error)
+		go func() { done <- rec.Run() }()
+
+		subs := []chan *broker.Message{make(chan *broker.Message, 10), make(chan *broker.Message, 10)}
+		for _, sub := range subs {
+			topic.Register() <- sub
+		}
+
+		topic.Broadcast() <- &broker.Message{Payload: &racer.Message{Body: "1"}}
+		topic.Broadcast() <- &broker.Message{Payload: racer.NewPresence("23", racer.PresenceJoin), Ephemeral: true}
+		topic.Broadcast() <- &broker.Message{Payload: &racer.Message{Body: "2"}}
+
+		// the recorder is not a subscriber, the room stops once its last client leaves
+		for _, sub := range subs {
+			topic.Unregister() <- sub
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the recorder never stopped")
+		}
+
+		if len(repo.msgs) != 2 {
+			t.Fatalf("got: %d messages, want: %d", len(repo.msgs), 2)
+		}
+
+		for i, msg := range repo.msgs {
+			if want := []string{"1", "2"}[i]; msg.Body != want {
+				t.Fatalf("got: %s, want: %s", msg.Body, want)
+			}
+
+			if msg.Seq == 0 {
+				t.Fatalf("got: message %s without a seq", msg.Body)
+			}
+		}
+	})
+
+	t.Run("It returns the error of the final backup", func(t *testing.T) {
+		repo := &testrepo{err: errors.New("repo failed")}
+		rec := racer.NewRecorder("23", racer.NewBackupper("23", repo, racer.WithRetry(1, 0, 0)))
+
+		go func() {
+			rec.Receive <- &broker.Message{Payload: &racer.Message{Body: "1"}}
+			close(rec.Receive)
+		}()
+
+		if err := rec.Run(); err == nil {
+			t.Fatalf("got: nil error, want: %v", repo.err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package racer
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxBodySize is the most bytes the body of a message sent by a client can take up, unless Validate is told otherwise
+	DefaultMaxBodySize = 4096
+
+	// maxRefSize is the most bytes a chatID or parentID can take up
+	maxRefSize = 128
+
+	// maxMetaEntries is the most entries the meta of a message can hold
+	maxMetaEntries = 16
+
+	// maxMetaKeySize and maxMetaValueSize are the most bytes a key and value of the meta of a message can take up
+	maxMetaKeySize   = 64
+	maxMetaValueSize = 1024
+)
+
+// InvalidError is returned by Validate, it names the field of a message that is invalid and why.
+type InvalidError struct {
+	Field  string
+	Reason string
+}
+
+func (e *InvalidError) Error() string { return e.Field + " " + e.Reason }
+
+// Validate checks every field a client can set on the message, so that the message can be accepted from a client.
+// Every field must be valid UTF-8 without control characters, bar the line breaks and tabs a body can hold,
+// and fit within its size limit. A body can take up at most maxBody bytes, or DefaultMaxBodySize if maxBody is not positive.
+// Text and edit messages must have a body.
+func (m *Message) Validate(maxBody int) error {
+	if maxBody <= 0 {
+		maxBody = DefaultMaxBodySize
+	}
+
+	if err := checkText("body", m.Body, maxBody, true); err != nil {
+		return err
+	}
+
+	if (m.Type == TypeText || m.Type == "" || m.Type == TypeEdit) && strings.TrimSpace(m.Body) == "" {
+		return &InvalidError{Field: "body", Reason: "is empty"}
+	}
+
+	if err := checkText("chatID", m.ChatID, maxRefSize, false); err != nil {
+		return err
+	}
+
+	if err := checkText("parentID", m.ParentID, maxRefSize, false); err != nil {
+		return err
+	}
+
+	if len(m.Meta) > maxMetaEntries {
+		return &InvalidError{Field: "meta", Reason: "has too many entries"}
+	}
+
+	for k, v := range m.Meta {
+		if k == "" {
+			return &InvalidError{Field: "meta", Reason: "has an empty key"}
+		}
+
+		if err := checkText("meta key", k, maxMetaKeySize, false); err != nil {
+			return err
+		}
+
+		if err := checkText("meta "+k, v, maxMetaValueSize, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateChatID checks the chatID a client names a room by in the same way Validate checks the chatID of a message,
+// so that a room a client connects to could also be named by the messages it sends.
+func ValidateChatID(chatID string) error {
+	return checkText("chatID", chatID, maxRefSize, false)
+}
+
+// checkText checks that s is valid UTF-8 of at most max bytes without control characters,
+// multiline text can also hold line breaks and tabs.
+func checkText(field, s string, max int, multiline bool) error {
+	if len(s) > max {
+		return &InvalidError{Field: field, Reason: "is too long"}
+	}
+
+	if !utf8.ValidString(s) {
+		return &InvalidError{Field: field, Reason: "is not valid UTF-8"}
+	}
+
+	for _, r := range s {
+		if multiline && (r == '\n' || r == '\r' || r == '\t') {
+			continue
+		}
+
+		if unicode.IsControl(r) {
+			return &InvalidError{Field: field, Reason: "holds control characters"}
+		}
+	}
+
+	return nil
+}
+
+// Sanitizer makes text sent by a client safe to render, see EscapeHTML and StripHTML
+type Sanitizer func(string) string
+
+// Sanitize passes the body and meta values of the message through s.
+func (m *Message) Sanitize(s Sanitizer) {
+	if s == nil {
+		return
+	}
+
+	m.Body = s(m.Body)
+
+	for k, v := range m.Meta {
+		m.Meta[k] = s(v)
+	}
+}
+
+// EscapeHTML escapes text so any HTML in it is shown as written rather than rendered.
+func EscapeHTML(text string) string {
+	return html.EscapeString(text)
+}
+
+// StripHTML removes every HTML tag and comment from text, along with any angle bracket left over,
+// so nothing in it can be rendered as markup. Entities are left as they are.
+func StripHTML(text string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '<' && i+1 < len(text) && isTagStart(text[i+1]):
+			end := strings.IndexByte(text[i:], '>')
+
+			if strings.HasPrefix(text[i:], "<!--") {
+				if e := strings.Index(text[i:], "-->"); e >= 0 {
+					end = e + 2
+				} else {
+					end = -1
+				}
+			}
+
+			if end < 0 {
+				return b.String()
+			}
+
+			i += end
+		case c == '<' || c == '>':
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// isTagStart reports whether c can follow the < that opens a tag, closing tag, comment or processing instruction
+func isTagStart(c byte) bool {
+	return c == '/' || c == '!' || c == '?' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -0,0 +1,95 @@
+package racer_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tinylttl/racer"
+)
+
+func TestMessage_Validate(t *testing.T) {
+	meta := make(map[string]string)
+	for i := 0; i < 17; i++ {
+		meta[strings.Repeat("k", i+1)] = "v"
+	}
+
+	cases := []struct {
+		name  string
+		msg   racer.Message
+		field string // the field named by the error, empty if the message is valid
+	}{
+		{name: "It accepts multiline text", msg: racer.Message{Type: racer.TypeText, Body: "hi\r\n\t👋"}},
+		{name: "It accepts messages that need no body", msg: racer.Message{Type: racer.TypeDelete, ParentID: "a"}},
+		{name: "It rejects bodies over the limit", msg: racer.Message{Type: racer.TypeText, Body: strings.Repeat("a", 11)}, field: "body"},
+		{name: "It rejects invalid UTF-8", msg: racer.Message{Type: racer.TypeText, Body: "a\xffb"}, field: "body"},
+		{name: "It rejects control characters", msg: racer.Message{Type: racer.TypeText, Body: "a\x1bb"}, field: "body"},
+		{name: "It rejects empty text", msg: racer.Message{Type: racer.TypeText, Body: " \n "}, field: "body"},
+		{name: "It rejects line breaks in a parentID", msg: racer.Message{Type: racer.TypeDelete, ParentID: "a\nb"}, field: "parentID"},
+		{name: "It rejects long chatIDs", msg: racer.Message{Type: racer.TypeSubscribe, ChatID: strings.Repeat("a", 129)}, field: "chatID"},
+		{name: "It rejects meta with too many entries", msg: racer.Message{Type: racer.TypeFile, Meta: meta}, field: "meta"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.msg.Validate(10)
+
+			if tc.field == "" {
+				if err != nil {
+					t.Fatalf("got: %v, want: nil", err)
+				}
+				return
+			}
+
+			ierr, ok := err.(*racer.InvalidError)
+
+			if !ok || ierr.Field != tc.field {
+				t.Fatalf("got: %v, want an error about %s", err, tc.field)
+			}
+		})
+	}
+}
+
+func TestValidateChatID(t *testing.T) {
+	cases := []struct {
+		name    string
+		chatID  string
+		invalid bool
+	}{
+		{name: "It accepts a chatID a message could name", chatID: "general"},
+		{name: "It rejects long chatIDs", chatID: strings.Repeat("a", 129), invalid: true},
+		{name: "It rejects control characters", chatID: "\x00keys", invalid: true},
+		{name: "It rejects invalid UTF-8", chatID: "a\xffb", invalid: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := racer.ValidateChatID(tc.chatID)
+
+			if (err != nil) != tc.invalid {
+				t.Fatalf("got: %v, want invalid: %v", err, tc.invalid)
+			}
+		})
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "It strips tags", text: `<b onclick="x()">bold</b> move`, want: "bold move"},
+		{name: "It strips comments", text: "a<!-- <b> -->b", want: "ab"},
+		{name: "It strips left over brackets", text: "1 < 2 > 0", want: "1  2  0"},
+		{name: "It drops an unclosed tag", text: "hi <script src=x", want: "hi "},
+		{name: "It leaves entities as they are", text: "&lt;b&gt;", want: "&lt;b&gt;"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := racer.StripHTML(tc.text); got != tc.want {
+				t.Fatalf("got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+// Package wal implements racer.Journal with write-ahead logs kept on the local disk.
+//
+// Every log lives in a directory of its own inside the journals directory, named after the hex encoded id of the room
+// it holds messages for. A log is split into segment files named after their number, each segment holds a run of records:
+//
+//	length  uint32, big endian length of the payload
+//	crc     uint32, big endian crc32 (IEEE) checksum of the payload
+//	payload json encoded racer.Message
+//
+// A record that was only partially written when the process crashed fails its checksum and is ignored along with anything after it.
+// Only the last segment of a log can end in such a record, and an intact record must decode.
+// A log that breaks either rule, or whose records are sealed without a data key to open them, is never replayed or removed.
+//
+// A journal with a keyring gives every log a data key of its own, which it keeps wrapped by the keyrings master key in the logs directory.
+// The payload of every record is then sealed with the data key, bound to the id of the room, see keyring.Seal.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/keyring"
+)
+
+var _ racer.Journal = &Journal{}
+var _ racer.Log = &Log{}
+
+const (
+	segmentExt    = ".wal"
+	keyFile       = "datakey" // the wrapped data key of a sealed log
+	headerSize    = 8
+	maxRecordSize = 1 << 24 // anything larger is taken to be a corrupt header
+)
+
+// Journal opens logs in a single directory.
+type Journal struct {
+	dir     string
+	logs    uint64           // number of logs opened, keeps the directory names of logs opened in the same instant distinct
+	keyring *keyring.Keyring // wraps the data key of every log, nil to write records as plaintext, see WithKeyring
+}
+
+// NewJournal returns a journal that keeps its logs in dir, which is created if it does not exist.
+// It can take a variadic number of functional options.
+func NewJournal(dir string, opts ...func(*Journal)) *Journal {
+	j := &Journal{dir: dir}
+
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	return j
+}
+
+// WithKeyring seals the records of every log the journal opens with a data key of the logs own, wrapped by the master keys of k.
+// Logs written before the journal was encrypted are still replayed as they are. Use with NewJournal()
+func WithKeyring(k *keyring.Keyring) func(*Journal) {
+	return func(j *Journal) {
+		j.keyring = k
+	}
+}
+
+// Open creates a new log for the room identified by id.
+func (j *Journal) Open(id string) (racer.Log, error) {
+	n := atomic.AddUint64(&j.logs, 1)
+	dir := filepath.Join(j.dir, fmt.Sprintf("%s-%x-%x", hex.EncodeToString([]byte(id)), time.Now().UnixNano(), n))
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create log directory")
+	}
+
+	l := &Log{dir: dir, ad: []byte(id)}
+
+	if j.keyring == nil {
+		return l, nil
+	}
+
+	key, wrapped, err := j.keyring.NewDataKey(l.ad)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKey(filepath.Join(dir, keyFile), wrapped); err != nil {
+		return nil, err
+	}
+
+	l.key = key
+
+	return l, nil
+}
+
+// Replay puts every message left in the journals logs into repo and removes the logs.
+// It must be called before any logs are opened, usually when the process starts,
+// to recover the messages that had not been backed up when the process last exited.
+// It returns an error for the first log that cannot be replayed in full, which is left in place along with every log after it.
+func (j *Journal) Replay(repo racer.MessageRepo) error {
+	entries, err := ioutil.ReadDir(j.dir)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "could not read journal directory")
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		id, err := roomID(entry.Name())
+
+		if err != nil {
+			return err
+		}
+
+		dir := filepath.Join(j.dir, entry.Name())
+		segs, err := segments(dir)
+
+		if err != nil {
+			return err
+		}
+
+		var key []byte
+
+		// a log that crashed before its first record may have been left without a whole data key
+		if len(segs) > 0 {
+			if key, err = j.dataKey(dir, id); err != nil {
+				return err
+			}
+		}
+
+		for i, seg := range segs {
+			msgs, torn, err := readSegment(filepath.Join(dir, segmentName(seg)), key, []byte(id))
+
+			if err != nil {
+				return errors.Wrapf(err, "could not replay %s", entry.Name())
+			}
+
+			// a crash can only tear the segment being written, records were lost from any other
+			if torn && i < len(segs)-1 {
+				return errors.Errorf("could not replay %s: segment %d is corrupt", entry.Name(), seg)
+			}
+
+			if len(msgs) == 0 {
+				continue
+			}
+
+			if err := repo.Put(id, msgs...); err != nil {
+				return errors.Wrapf(err, "could not replay segment %d of %s", seg, entry.Name())
+			}
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrap(err, "could not remove replayed log")
+		}
+	}
+
+	return nil
+}
+
+// dataKey returns the data key of the log in dir that holds messages for the room identified by id, nil if its records are plaintext.
+func (j *Journal) dataKey(dir, id string) ([]byte, error) {
+	wrapped, err := ioutil.ReadFile(filepath.Join(dir, keyFile))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read data key")
+	}
+
+	if j.keyring == nil {
+		return nil, errors.Errorf("log %s is sealed but the journal has no keyring", filepath.Base(dir))
+	}
+
+	key, err := j.keyring.Unwrap(wrapped, []byte(id))
+
+	return key, errors.Wrapf(err, "could not unwrap data key of %s", filepath.Base(dir))
+}
+
+// Log is a write-ahead log of the messages held by a single racer.Backupper.
+type Log struct {
+	mu  sync.Mutex
+	dir string
+	seg uint64   // number of the current segment
+	f   *os.File // the current segment, nil until a message is appended to it
+	key []byte   // the data key records are sealed with, nil to write them as plaintext
+	ad  []byte   // the id of the room, every sealed record is bound to it
+}
+
+// Append writes msgs to the current segment and syncs it to disk.
+func (l *Log) Append(msgs ...*racer.Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		f, err := os.OpenFile(filepath.Join(l.dir, segmentName(l.seg)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+		if err != nil {
+			return errors.Wrap(err, "could not create segment")
+		}
+
+		l.f = f
+	}
+
+	info, err := l.f.Stat()
+
+	if err != nil {
+		return errors.Wrap(err, "could not stat segment")
+	}
+
+	w := bufio.NewWriter(l.f)
+
+	for _, msg := range msgs {
+		payload, err := json.Marshal(msg)
+
+		if err != nil {
+			return errors.Wrap(err, "could not marshall msg")
+		}
+
+		if l.key != nil {
+			if payload, err = keyring.Seal(l.key, payload, l.ad); err != nil {
+				return errors.Wrap(err, "could not seal msg")
+			}
+		}
+
+		header := make([]byte, headerSize)
+		binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+
+		w.Write(header)
+		w.Write(payload)
+	}
+
+	if err := w.Flush(); err != nil {
+		// drop anything partially written so later records are not lost behind a torn one
+		l.f.Truncate(info.Size())
+		return errors.Wrap(err, "could not write to segment")
+	}
+
+	return errors.Wrap(l.f.Sync(), "could not sync segment")
+}
+
+// Rotate closes the current segment and returns its number.
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seg := l.seg
+	l.seg++
+
+	if l.f == nil {
+		return seg, nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return seg, errors.Wrap(err, "could not close segment")
+}
+
+// Truncate removes every closed segment numbered up to and including seg.
+func (l *Log) Truncate(seg uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segs, err := segments(l.dir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segs {
+		if s > seg || s >= l.seg {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(l.dir, segmentName(s))); err != nil {
+			return errors.Wrap(err, "could not remove segment")
+		}
+	}
+
+	return nil
+}
+
+// Close closes the current segment. If no messages are left in the log its directory is removed,
+// otherwise it is left for the journal to replay.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		if err := l.f.Close(); err != nil {
+			return errors.Wrap(err, "could not close segment")
+		}
+
+		l.f = nil
+	}
+
+	segs, err := segments(l.dir)
+
+	if err != nil {
+		return err
+	}
+
+	if len(segs) > 0 {
+		return nil
+	}
+
+	return errors.Wrap(os.RemoveAll(l.dir), "could not remove log directory")
+}
+
+// writeKey durably writes the wrapped data key of a log to path
+func writeKey(path string, wrapped []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+
+	if err != nil {
+		return errors.Wrap(err, "could not create data key")
+	}
+
+	_, err = f.Write(wrapped)
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return errors.Wrap(err, "could not write data key")
+}
+
+// segmentName returns the file name of segment seg
+func segmentName(seg uint64) string {
+	return fmt.Sprintf("%016x%s", seg, segmentExt)
+}
+
+// segments returns the numbers of the segments in dir in ascending order
+func segments(dir string) ([]uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read log directory")
+	}
+
+	segs := make([]uint64, 0, len(entries))
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		seg, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+
+		if err != nil {
+			continue
+		}
+
+		segs = append(segs, seg)
+	}
+
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+
+	return segs, nil
+}
+
+// roomID returns the id of the room a log holds messages for from the name of its directory
+func roomID(name string) (string, error) {
+	i := strings.Index(name, "-")
+
+	if i < 0 {
+		return "", errors.Errorf("%s is not a log directory", name)
+	}
+
+	id, err := hex.DecodeString(name[:i])
+
+	if err != nil {
+		return "", errors.Wrapf(err, "%s is not a log directory", name)
+	}
+
+	return string(id), nil
+}
+
+// readSegment reads every intact record of the segment at path, opening sealed records with key and ad.
+// Reading stops at the first torn or corrupt record, which can only be the last one written before a crash, and reports it as torn.
+// An intact record that cannot be opened or decoded is an error, it was sealed with another key, tampered with,
+// or sealed in a log that has lost its data key.
+func readSegment(path string, key, ad []byte) (msgs []*racer.Message, torn bool, err error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, false, errors.Wrap(err, "could not open segment")
+	}
+
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	msgs = make([]*racer.Message, 0)
+	header := make([]byte, headerSize)
+
+	for {
+		n, err := io.ReadFull(r, header)
+
+		if err != nil {
+			return msgs, n > 0, nil
+		}
+
+		size := binary.BigEndian.Uint32(header[:4])
+
+		if size > maxRecordSize {
+			return msgs, true, nil
+		}
+
+		payload := make([]byte, size)
+
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return msgs, true, nil
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return msgs, true, nil
+		}
+
+		if key != nil {
+			if payload, err = keyring.Open(key, payload, ad); err != nil {
+				return nil, false, errors.Wrapf(err, "could not open record %d of %s", len(msgs), filepath.Base(path))
+			}
+		} else if keyring.Sealed(payload) {
+			return nil, false, errors.Errorf("record %d of %s is sealed but its log has no data key", len(msgs), filepath.Base(path))
+		}
+
+		msg := &racer.Message{}
+
+		if err := json.Unmarshal(payload, msg); err != nil {
+			return nil, false, errors.Wrapf(err, "could not decode record %d of %s", len(msgs), filepath.Base(path))
+		}
+
+		msgs = append(msgs, msg)
+	}
+}
@@ -0,0 +1,349 @@
+package wal_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/tinylttl/racer"
+	"github.com/tinylttl/racer/keyring"
+	"github.com/tinylttl/racer/wal"
+)
+
+// testrepo records every message put into it by room
+type testrepo struct {
+	msgs map[string][]*racer.Message
+}
+
+func newTestRepo() *testrepo {
+	return &testrepo{msgs: make(map[string][]*racer.Message)}
+}
+
+func (tr *testrepo) Fetch(ID string, msgID string) (*racer.Message, error) { return nil, nil }
+func (tr *testrepo) FetchX(ID string, x int) ([]*racer.Message, error)     { return nil, nil }
+func (tr *testrepo) FetchSince(ID string, seq uint64, x int) ([]*racer.Message, error) {
+	return nil, nil
+}
+
+func (tr *testrepo) Put(ID string, msgs ...*racer.Message) error {
+	tr.msgs[ID] = append(tr.msgs[ID], msgs...)
+	return nil
+}
+
+// newJournal returns a journal in a fresh temporary directory along with a func that removes it
+func newJournal(t *testing.T) (*wal.Journal, string, func()) {
+	dir, err := ioutil.TempDir("", "wal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wal.NewJournal(dir), dir, func() { os.RemoveAll(dir) }
+}
+
+// record encodes payload as a record with a valid checksum
+func record(payload []byte) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+
+	return append(header, payload...)
+}
+
+// entries returns the number of files or directories in dir
+func entries(t *testing.T, dir string) int {
+	infos, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(infos)
+}
+
+func TestJournal_Replay(t *testing.T) {
+	t.Run("It recovers every message left in a log", func(t *testing.T) {
+		j, dir, cleanup := newJournal(t)
+		defer cleanup()
+
+		l, err := j.Open("room/23")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l.Append(&racer.Message{ID: "1"}, &racer.Message{ID: "2"})
+		l.Rotate()
+		l.Append(&racer.Message{ID: "3"})
+
+		// the log is never closed, as if the process crashed
+		repo := newTestRepo()
+		if err := wal.NewJournal(dir).Replay(repo); err != nil {
+			t.Fatal(err)
+		}
+
+		got := repo.msgs["room/23"]
+		if len(got) != 3 {
+			t.Fatalf("got: %d messages, want: %d", len(got), 3)
+		}
+
+		for i, msg := range got {
+			if want := []string{"1", "2", "3"}[i]; msg.ID != want {
+				t.Fatalf("got: %s, want: %s", msg.ID, want)
+			}
+		}
+
+		if n := entries(t, dir); n != 0 {
+			t.Fatalf("got: %d logs left after replaying, want: %d", n, 0)
+		}
+	})
+
+	t.Run("It ignores a torn record", func(t *testing.T) {
+		j, dir, cleanup := newJournal(t)
+		defer cleanup()
+
+		l, _ := j.Open("23")
+		l.Append(&racer.Message{ID: "1"})
+
+		logs, _ := ioutil.ReadDir(dir)
+		segs, _ := filepath.Glob(filepath.Join(dir, logs[0].Name(), "*.wal"))
+
+		f, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, '{'})
+		f.Close()
+
+		repo := newTestRepo()
+		if err := j.Replay(repo); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := repo.msgs["23"]; len(got) != 1 || got[0].ID != "1" {
+			t.Fatalf("got: %+v, want only message 1", got)
+		}
+	})
+
+	t.Run("It keeps a log with an intact record it cannot decode", func(t *testing.T) {
+		j, dir, cleanup := newJournal(t)
+		defer cleanup()
+
+		l, _ := j.Open("23")
+		l.Append(&racer.Message{ID: "1"})
+
+		logs, _ := ioutil.ReadDir(dir)
+		segs, _ := filepath.Glob(filepath.Join(dir, logs[0].Name(), "*.wal"))
+
+		f, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(record([]byte("not json")))
+		f.Close()
+
+		if err := j.Replay(newTestRepo()); err == nil {
+			t.Fatalf("got: nil error, want the record that cannot be decoded to fail the replay")
+		}
+
+		if n := entries(t, dir); n != 1 {
+			t.Fatalf("got: %d logs, want: %d", n, 1)
+		}
+	})
+
+	t.Run("It keeps a log torn before its last segment", func(t *testing.T) {
+		j, dir, cleanup := newJournal(t)
+		defer cleanup()
+
+		l, _ := j.Open("23")
+		l.Append(&racer.Message{ID: "1"})
+		l.Rotate()
+		l.Append(&racer.Message{ID: "2"})
+
+		logs, _ := ioutil.ReadDir(dir)
+		segs, _ := filepath.Glob(filepath.Join(dir, logs[0].Name(), "*.wal"))
+		sort.Strings(segs)
+
+		f, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, '{'})
+		f.Close()
+
+		if err := j.Replay(newTestRepo()); err == nil {
+			t.Fatalf("got: nil error, want the torn segment to fail the replay")
+		}
+
+		if n := entries(t, dir); n != 1 {
+			t.Fatalf("got: %d logs, want: %d", n, 1)
+		}
+	})
+
+	t.Run("It does nothing when the journal directory does not exist", func(t *testing.T) {
+		if err := wal.NewJournal(filepath.Join(os.TempDir(), "wal-does-not-exist")).Replay(newTestRepo()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLog(t *testing.T) {
+	t.Run("It removes itself once every segment has been truncated", func(t *testing.T) {
+		j, dir, cleanup := newJournal(t)
+		defer cleanup()
+
+		l, _ := j.Open("23")
+		l.Append(&racer.Message{ID: "1"})
+
+		seg, err := l.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := l.Truncate(seg); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := entries(t, dir); n != 0 {
+			t.Fatalf("got: %d logs, want: %d", n, 0)
+		}
+	})
+
+	t.Run("It keeps the segments that have not been truncated", func(t *testing.T) {
+		j, dir, cleanup := newJournal(t)
+		defer cleanup()
+
+		l, _ := j.Open("23")
+		l.Append(&racer.Message{ID: "1"})
+		seg, _ := l.Rotate()
+		l.Append(&racer.Message{ID: "2"})
+		l.Truncate(seg)
+		l.Close()
+
+		repo := newTestRepo()
+		if err := wal.NewJournal(dir).Replay(repo); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := repo.msgs["23"]; len(got) != 1 || got[0].ID != "2" {
+			t.Fatalf("got: %+v, want only message 2", got)
+		}
+	})
+}
+
+func TestJournal_Encryption(t *testing.T) {
+	master := sha256.Sum256([]byte("master"))
+	k, err := keyring.New(master[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sealedLog leaves a log that was never closed in a fresh journal sealed by k
+	sealedLog := func(t *testing.T) (string, func()) {
+		_, dir, cleanup := newJournal(t)
+
+		l, err := wal.NewJournal(dir, wal.WithKeyring(k)).Open("23")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := l.Append(&racer.Message{ID: "1", Body: "attack at dawn"}); err != nil {
+			t.Fatal(err)
+		}
+
+		return dir, cleanup
+	}
+
+	t.Run("It never writes bodies in plaintext", func(t *testing.T) {
+		dir, cleanup := sealedLog(t)
+		defer cleanup()
+
+		segs, _ := filepath.Glob(filepath.Join(dir, "*", "*.wal"))
+		if len(segs) != 1 {
+			t.Fatalf("got: %d segments, want: %d", len(segs), 1)
+		}
+
+		raw, err := ioutil.ReadFile(segs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(raw, []byte("attack at")) {
+			t.Fatalf("got: a body in plaintext on disk, want every record sealed")
+		}
+
+		repo := newTestRepo()
+		if err := wal.NewJournal(dir, wal.WithKeyring(k)).Replay(repo); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := repo.msgs["23"]; len(got) != 1 || got[0].Body != "attack at dawn" {
+			t.Fatalf("got: %+v, want the sealed message", got)
+		}
+	})
+
+	t.Run("It refuses to replay a sealed log without the master key", func(t *testing.T) {
+		dir, cleanup := sealedLog(t)
+		defer cleanup()
+
+		other := sha256.Sum256([]byte("other"))
+		wrong, _ := keyring.New(other[:])
+
+		for _, j := range []*wal.Journal{wal.NewJournal(dir), wal.NewJournal(dir, wal.WithKeyring(wrong))} {
+			if err := j.Replay(newTestRepo()); err == nil {
+				t.Fatalf("got: nil error, want the sealed log to be left for a journal with the master key")
+			}
+		}
+
+		if n := entries(t, dir); n != 1 {
+			t.Fatalf("got: %d logs, want: %d", n, 1)
+		}
+	})
+
+	t.Run("It keeps a sealed log that lost its data key", func(t *testing.T) {
+		dir, cleanup := sealedLog(t)
+		defer cleanup()
+
+		keys, _ := filepath.Glob(filepath.Join(dir, "*", "datakey"))
+		if len(keys) != 1 {
+			t.Fatalf("got: %d data keys, want: %d", len(keys), 1)
+		}
+
+		os.Remove(keys[0])
+
+		if err := wal.NewJournal(dir, wal.WithKeyring(k)).Replay(newTestRepo()); err == nil {
+			t.Fatalf("got: nil error, want the sealed records to fail the replay")
+		}
+
+		if n := entries(t, dir); n != 1 {
+			t.Fatalf("got: %d logs, want: %d", n, 1)
+		}
+	})
+
+	t.Run("It removes a sealed log once every segment has been truncated", func(t *testing.T) {
+		_, dir, cleanup := newJournal(t)
+		defer cleanup()
+
+		l, _ := wal.NewJournal(dir, wal.WithKeyring(k)).Open("23")
+		l.Append(&racer.Message{ID: "1"})
+		seg, _ := l.Rotate()
+		l.Truncate(seg)
+
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := entries(t, dir); n != 0 {
+			t.Fatalf("got: %d logs, want: %d", n, 0)
+		}
+	})
+}